@@ -0,0 +1,479 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	pathpkg "path"
+	"path/filepath"
+	"strings"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+	"github.com/gorilla/mux"
+)
+
+// Each permission includes the ones before it, manage covers everything
+var permissionLevels = map[string]int{
+	"read":   1,
+	"write":  2,
+	"delete": 3,
+	"manage": 4,
+}
+
+// The path access rules are recorded under, forward slashes relative to the
+// share root. A thumbnail has the same permissions as its image.
+func accessRulePath(fullPath string) string {
+	path := filepath.ToSlash(sharePath(filepath.Clean(fullPath)))
+	path = strings.Replace(path, "/.thumbnails/", "/", 1)
+	return pathpkg.Clean("/" + path)
+}
+
+// The access rules and group memberships of a user, loaded once per request
+type accessRules struct {
+	user     *models.User
+	groupIDs map[uint]bool
+	byPath   map[string][]models.AccessRule
+
+	// Whether the user's admin rights apply, they don't through a token that wasn't made for them, or before
+	// they've set up two factor authentication when it's required
+	isAdmin bool
+
+	adminsCanAccessPersonalFolders bool
+}
+
+func loadAccessRules(h *Handler, user *models.User) (*accessRules, error) {
+	var rules []models.AccessRule
+	result := h.DB.Find(&rules)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	groupIDs, err := userGroupIDs(h, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	settings, err := models.GetSettings(h.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	loaded := &accessRules{
+		user:     user,
+		groupIDs: groupIDs,
+		byPath:   map[string][]models.AccessRule{},
+		isAdmin:  user.IsAdmin && !adminNeedsTwoFactor(h, user),
+
+		adminsCanAccessPersonalFolders: settings.AdminsCanAccessPersonalFolders,
+	}
+	for _, rule := range rules {
+		loaded.byPath[rule.Path] = append(loaded.byPath[rule.Path], rule)
+	}
+
+	return loaded, nil
+}
+
+// Whether a rule grants something to the user, directly or through one of their groups
+func (rules *accessRules) appliesTo(rule models.AccessRule) bool {
+	if rule.UserID != nil {
+		return *rule.UserID == rules.user.ID
+	}
+	return rule.GroupID != nil && rules.groupIDs[*rule.GroupID]
+}
+
+// The permission level the user has on the item at fullPath. Rules on a directory
+// apply to everything under it. Anything with no rules on it or above it is
+// open to every user who can homeshare, as it was before access rules existed.
+// Personal folders belong to their owner alone, access rules don't apply in them.
+func (rules *accessRules) level(fullPath string) int {
+	path := accessRulePath(fullPath)
+
+	// The directory holding the personal folders can't be touched from the shared scope
+	if path == "/"+personalDirName {
+		return 0
+	}
+
+	if ownerID, isFolder, ok := personalFolderOwner(path); ok {
+		if ownerID != rules.user.ID && !(rules.isAdmin && rules.adminsCanAccessPersonalFolders) {
+			return 0
+		}
+
+		// The folder itself can be written into but not deleted, moved or renamed
+		if isFolder {
+			return permissionLevels["write"]
+		}
+		return permissionLevels["manage"]
+	}
+
+	if rules.isAdmin {
+		return permissionLevels["manage"]
+	}
+
+	level := 0
+	isRestricted := false
+
+	for {
+		for _, rule := range rules.byPath[path] {
+			isRestricted = true
+			if rules.appliesTo(rule) && permissionLevels[rule.Permission] > level {
+				level = permissionLevels[rule.Permission]
+			}
+		}
+
+		if path == "/" {
+			break
+		}
+		path = pathpkg.Dir(path)
+	}
+
+	if !isRestricted {
+		return permissionLevels["manage"]
+	}
+
+	return level
+}
+
+// Whether an access rule is on a path, which is relative to the homeshare root, or on a directory above it.
+// Without one the path is open to everyone, and a rule there would shut out everyone it doesn't grant.
+func isRestrictedPath(h *Handler, path string) (bool, error) {
+	paths := []string{path}
+	for path != "/" {
+		path = pathpkg.Dir(path)
+		paths = append(paths, path)
+	}
+
+	var count int64
+	result := h.DB.Model(&models.AccessRule{}).Where("path IN ?", paths).Count(&count)
+	return count > 0, result.Error
+}
+
+// Whether the user who made a share or drop link can still do what it lets anyone do, it stops working once they're
+// banned or lose access to its path
+func linkCreatorAllows(h *Handler, userID uint, fullPath string, permission string) (bool, error) {
+	var user models.User
+	result := h.DB.First(&user, userID)
+	if result.Error != nil {
+		return false, nil
+	}
+
+	if (!user.IsEmailVerified && !user.IsAdmin) || isBanned(&user) {
+		return false, nil
+	}
+
+	rules, err := loadAccessRules(h, &user)
+	if err != nil {
+		return false, err
+	}
+	return rules.allows(fullPath, permission), nil
+}
+
+func (rules *accessRules) allows(fullPath string, permission string) bool {
+	return rules.level(fullPath) >= permissionLevels[permission]
+}
+
+// The logged in user, if they're allowed to homeshare at all
+func homeshareUser(h *Handler, r *http.Request) *models.User {
+	userID := requestUserID(h, r)
+	if userID == 0 {
+		return nil
+	}
+
+	var user models.User
+	result := h.DB.First(&user, userID)
+	if result.Error != nil {
+		return nil
+	}
+
+	if !user.IsEmailVerified && !user.IsAdmin {
+		return nil
+	}
+
+	return &user
+}
+
+const accessRulesContextKey contextKey = "accessRules"
+
+// A request's access rules, kept once they've been loaded
+type requestAccess struct {
+	loaded bool
+	rules  *accessRules
+	err    error
+}
+
+// Gives each request somewhere to keep its access rules, so checking several paths only loads them once
+func (h *Handler) AccessRulesMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), accessRulesContextKey, &requestAccess{})))
+	})
+}
+
+// The access rules of the logged in user, nil if they can't homeshare. Loaded on the first call for a request.
+func requestAccessRules(h *Handler, r *http.Request) (*accessRules, error) {
+	cached, _ := r.Context().Value(accessRulesContextKey).(*requestAccess)
+	if cached != nil && cached.loaded {
+		return cached.rules, cached.err
+	}
+
+	var rules *accessRules
+	var err error
+
+	user := homeshareUser(h, r)
+	if user != nil {
+		rules, err = loadAccessRules(h, user)
+	}
+
+	// A token only acts as an admin if it was made for it
+	if token := requestAPIToken(r); rules != nil && token != nil && token.Scope != "admin" {
+		rules.isAdmin = false
+	}
+
+	if cached != nil {
+		cached.loaded = true
+		cached.rules = rules
+		cached.err = err
+	}
+
+	return rules, err
+}
+
+// Whether the logged in user has at least permission on the item at fullPath
+func CheckPermission(h *Handler, r *http.Request, fullPath string, permission string) bool {
+	rules, err := requestAccessRules(h, r)
+	if err != nil || rules == nil {
+		return false
+	}
+
+	return rules.allows(fullPath, permission)
+}
+
+// Returns a filter for walks over the share that only lets through what the logged in user can read
+func readableFilter(h *Handler, r *http.Request) func(fullPath string) bool {
+	rules, err := requestAccessRules(h, r)
+
+	return func(fullPath string) bool {
+		return err == nil && rules != nil && rules.allows(fullPath, "read")
+	}
+}
+
+type GetAccessRulesResponse struct {
+	Rules []AccessRuleResponse `json:"rules"`
+}
+
+type AccessRuleResponse struct {
+	models.AccessRule
+	Username  string `json:"username,omitempty"`
+	GroupName string `json:"groupName,omitempty"`
+}
+
+// @Router /admin/access-rules [get]
+// @Tags admin
+// @Summary Access Rules
+// @Description List access rules, optionally only those on a path
+// @Produce json
+// @Param path query string false "Path"
+// @Success 200 {object} GetAccessRulesResponse "Access Rules"
+func (h *Handler) GetAccessRulesHandler(w http.ResponseWriter, r *http.Request) {
+	isAdmin := CheckIsAdmin(h, r)
+	if !isAdmin {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query := h.DB.Preload("User").Preload("Group").Order("path")
+
+	path := r.URL.Query().Get("path")
+	if path != "" {
+		fullPath := processPath(homeShareRoot() + path)
+		if !checkPathInRoot(fullPath) {
+			http.Error(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+		query = query.Where("path = ?", accessRulePath(fullPath))
+	}
+
+	var rules []models.AccessRule
+	result := query.Find(&rules)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := GetAccessRulesResponse{
+		Rules: []AccessRuleResponse{},
+	}
+
+	for _, rule := range rules {
+		response.Rules = append(response.Rules, AccessRuleResponse{
+			AccessRule: rule,
+			Username:   rule.User.Username,
+			GroupName:  rule.Group.Name,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Exactly one of UserID and GroupID
+type AccessRuleRequest struct {
+	Path       string `json:"path"`
+	UserID     *uint  `json:"userId"`
+	GroupID    *uint  `json:"groupId"`
+	Permission string `json:"permission"`
+}
+
+// @Router /admin/access-rules [post]
+// @Tags admin
+// @Summary Create Access Rule
+// @Description Grant a user or group a permission on a directory and everything under it
+// @Accept json
+// @Produce json
+// @Param body body AccessRuleRequest true "Body"
+// @Success 201 {object} models.AccessRule "Access Rule"
+func (h *Handler) CreateAccessRuleHandler(w http.ResponseWriter, r *http.Request) {
+	isAdmin := CheckIsAdmin(h, r)
+	if !isAdmin {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var accessRuleRequest AccessRuleRequest
+	err := json.NewDecoder(r.Body).Decode(&accessRuleRequest)
+	if err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	fullPath := processPath(homeShareRoot() + accessRuleRequest.Path)
+	if !checkPathInRoot(fullPath) {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := permissionLevels[accessRuleRequest.Permission]; !ok {
+		http.Error(w, "Invalid permission", http.StatusBadRequest)
+		return
+	}
+
+	if (accessRuleRequest.UserID == nil) == (accessRuleRequest.GroupID == nil) {
+		http.Error(w, "Either a user or a group is required", http.StatusBadRequest)
+		return
+	}
+
+	rule := models.AccessRule{
+		Path:       accessRulePath(fullPath),
+		Permission: accessRuleRequest.Permission,
+	}
+
+	if accessRuleRequest.UserID != nil {
+		var user models.User
+		result := h.DB.First(&user, *accessRuleRequest.UserID)
+		if result.Error != nil {
+			http.Error(w, "User not found", http.StatusBadRequest)
+			return
+		}
+		rule.UserID = &user.ID
+	} else {
+		var group models.Group
+		result := h.DB.First(&group, *accessRuleRequest.GroupID)
+		if result.Error != nil {
+			http.Error(w, "Group not found", http.StatusBadRequest)
+			return
+		}
+		rule.GroupID = &group.ID
+	}
+
+	result := h.DB.Create(&rule)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rule)
+}
+
+type UpdateAccessRuleRequest struct {
+	Permission string `json:"permission"`
+}
+
+// @Router /admin/access-rules/{ruleId} [post]
+// @Tags admin
+// @Summary Update Access Rule
+// @Description Change the permission an access rule grants
+// @Accept json
+// @Produce json
+// @Param ruleId path int true "Access Rule ID"
+// @Param body body UpdateAccessRuleRequest true "Body"
+// @Success 200 {object} models.AccessRule "Access Rule"
+func (h *Handler) UpdateAccessRuleHandler(w http.ResponseWriter, r *http.Request) {
+	isAdmin := CheckIsAdmin(h, r)
+	if !isAdmin {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	ruleId := vars["ruleId"]
+
+	var updateRequest UpdateAccessRuleRequest
+	err := json.NewDecoder(r.Body).Decode(&updateRequest)
+	if err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := permissionLevels[updateRequest.Permission]; !ok {
+		http.Error(w, "Invalid permission", http.StatusBadRequest)
+		return
+	}
+
+	var rule models.AccessRule
+	result := h.DB.First(&rule, ruleId)
+	if result.Error != nil {
+		http.Error(w, "Access rule not found", http.StatusNotFound)
+		return
+	}
+
+	rule.Permission = updateRequest.Permission
+
+	result = h.DB.Save(&rule)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+// @Router /admin/access-rules/{ruleId} [delete]
+// @Tags admin
+// @Summary Delete Access Rule
+// @Description Remove an access rule
+// @Param ruleId path int true "Access Rule ID"
+// @Success 200
+func (h *Handler) DeleteAccessRuleHandler(w http.ResponseWriter, r *http.Request) {
+	isAdmin := CheckIsAdmin(h, r)
+	if !isAdmin {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	ruleId := vars["ruleId"]
+
+	result := h.DB.Unscoped().Delete(&models.AccessRule{}, ruleId)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if result.RowsAffected == 0 {
+		http.Error(w, "Access rule not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
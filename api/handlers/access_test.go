@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+)
+
+func TestAccessRulesLevel(t *testing.T) {
+	t.Setenv("HOME_SHARE_ROOT", "/share")
+
+	owner := &models.User{ID: 1}
+	outsider := &models.User{ID: 2}
+	member := &models.User{ID: 3}
+
+	ownerID := owner.ID
+	groupID := uint(5)
+
+	byPath := map[string][]models.AccessRule{
+		"/private":        {{Path: "/private", UserID: &ownerID, Permission: "manage"}},
+		"/private/shared": {{Path: "/private/shared", GroupID: &groupID, Permission: "read"}},
+		"/team":           {{Path: "/team", GroupID: &groupID, Permission: "write"}},
+	}
+
+	rulesFor := func(user *models.User, isAdmin bool, adminsCanAccessPersonalFolders bool) *accessRules {
+		groupIDs := map[uint]bool{}
+		if user != outsider {
+			groupIDs[groupID] = true
+		}
+
+		return &accessRules{
+			user:     user,
+			groupIDs: groupIDs,
+			byPath:   byPath,
+			isAdmin:  isAdmin,
+
+			adminsCanAccessPersonalFolders: adminsCanAccessPersonalFolders,
+		}
+	}
+
+	none := 0
+	read := permissionLevels["read"]
+	write := permissionLevels["write"]
+	manage := permissionLevels["manage"]
+
+	tests := []struct {
+		name  string
+		rules *accessRules
+		path  string
+		want  int
+	}{
+		// Nothing restricts it, so everyone has it all
+		{"unrestricted", rulesFor(outsider, false, false), "/public/a.txt", manage},
+		{"root", rulesFor(outsider, false, false), "/", manage},
+
+		// A rule on a directory covers everything under it, for everyone it doesn't grant too
+		{"own rule", rulesFor(owner, false, false), "/private/a.txt", manage},
+		{"no rule", rulesFor(outsider, false, false), "/private/a.txt", none},
+		{"no rule on the directory", rulesFor(outsider, false, false), "/private", none},
+		{"group rule", rulesFor(member, false, false), "/team/a.txt", write},
+		{"not in the group", rulesFor(outsider, false, false), "/team/a.txt", none},
+
+		// The highest of the rules on it and above it wins
+		{"narrower rule", rulesFor(member, false, false), "/private/shared/a.txt", read},
+		{"wider rule", rulesFor(owner, false, false), "/private/shared/a.txt", manage},
+		{"outside the narrower rule", rulesFor(member, false, false), "/private/a.txt", none},
+
+		// A name that only starts the same isn't under it
+		{"sibling", rulesFor(outsider, false, false), "/private2/a.txt", manage},
+
+		// Thumbnails go by their image
+		{"thumbnail", rulesFor(outsider, false, false), "/private/.thumbnails/a.jpg", none},
+		{"own thumbnail", rulesFor(owner, false, false), "/private/.thumbnails/a.jpg", manage},
+
+		// Admins aren't held back by rules, unless their rights don't apply to the request
+		{"admin", rulesFor(outsider, true, false), "/private/a.txt", manage},
+
+		// Personal folders are their owner's alone
+		{"own personal file", rulesFor(owner, false, false), "/.personal/1/a.txt", manage},
+		{"own personal folder", rulesFor(owner, false, false), "/.personal/1", write},
+		{"someone else's personal file", rulesFor(outsider, false, false), "/.personal/1/a.txt", none},
+		{"admin in a personal folder", rulesFor(outsider, true, false), "/.personal/1/a.txt", none},
+		{"admin allowed in personal folders", rulesFor(outsider, true, true), "/.personal/1/a.txt", manage},
+		{"admin without their rights", rulesFor(outsider, false, true), "/.personal/1/a.txt", none},
+		{"personal folders directory", rulesFor(owner, true, true), "/.personal", none},
+	}
+
+	for _, test := range tests {
+		got := test.rules.level(processPath("/share" + test.path))
+		if got != test.want {
+			t.Errorf("%s: %s got %d, want %d", test.name, test.path, got, test.want)
+		}
+	}
+}
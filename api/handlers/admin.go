@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -10,13 +11,14 @@ import (
 )
 
 func CheckIsAdmin(h *Handler, r *http.Request) bool {
-	session, err := h.Store.Get(r, "session")
-	if err != nil {
+	// A token only acts as an admin if it was made for it
+	token := requestAPIToken(r)
+	if token != nil && token.Scope != "admin" {
 		return false
 	}
 
-	userID := session.Values["id"]
-	if userID == nil {
+	userID := requestUserID(h, r)
+	if userID == 0 {
 		return false
 	}
 
@@ -26,7 +28,7 @@ func CheckIsAdmin(h *Handler, r *http.Request) bool {
 		return false
 	}
 
-	return user.IsAdmin
+	return user.IsAdmin && !adminNeedsTwoFactor(h, &user)
 }
 
 type GetUsersResponse struct {
@@ -40,33 +42,14 @@ type GetUsersResponse struct {
 // @Produce json
 // @Success 200
 func (h *Handler) GetUsersHandler(w http.ResponseWriter, r *http.Request) {
-	session, err := h.Store.Get(r, "session")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return
-	}
-
-	userID := session.Values["id"]
-	if userID == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	// Check if user is admin
-	var user models.User
-	result := h.DB.First(&user, userID)
-	if result.Error != nil {
-		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	if !user.IsAdmin {
+	isAdmin := CheckIsAdmin(h, r)
+	if !isAdmin {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
 	var users []models.User
-	result = h.DB.Find(&users)
+	result := h.DB.Find(&users)
 	if result.Error != nil {
 		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
 		return
@@ -129,6 +112,14 @@ func (h *Handler) BanUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Tokens are turned away from here on, sessions are logged out and SFTP stays connected until it's cut off
+	closeSFTPConnections(targetUser.ID)
+	err = revokeUserSessions(h, targetUser.ID, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(targetUser)
@@ -177,3 +168,220 @@ func (h *Handler) UnBanUserHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(targetUser)
 }
+
+// @Router /admin/user/{userId}/verify [post]
+// @Tags admin
+// @Summary Verify User
+// @Description Mark a user's email as verified so they can use the site, for when they can't be sent a link
+// @Produce json
+// @Param userId path int true "User ID"
+// @Success 200 {object} models.User
+func (h *Handler) VerifyUserHandler(w http.ResponseWriter, r *http.Request) {
+	isAdmin := CheckIsAdmin(h, r)
+	if !isAdmin {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var targetUser models.User
+	result := h.DB.First(&targetUser, mux.Vars(r)["userId"])
+	if result.Error != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if targetUser.IsEmailVerified {
+		http.Error(w, "User is already verified", http.StatusBadRequest)
+		return
+	}
+
+	result = h.DB.Model(&targetUser).Update("is_email_verified", true)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(targetUser)
+}
+
+type UpdateSettingsRequest struct {
+	TrashRetentionDays *int `json:"trashRetentionDays"`
+	VersionKeepCount   *int `json:"versionKeepCount"`
+	VersionKeepDays    *int `json:"versionKeepDays"`
+
+	AdminsCanAccessPersonalFolders *bool `json:"adminsCanAccessPersonalFolders"`
+	RequireAdminTwoFactor          *bool `json:"requireAdminTwoFactor"`
+
+	LockoutThreshold *int `json:"lockoutThreshold"`
+	LockoutMinutes   *int `json:"lockoutMinutes"`
+
+	PasswordMinLength        *int  `json:"passwordMinLength"`
+	PasswordRequireUppercase *bool `json:"passwordRequireUppercase"`
+	PasswordRequireLowercase *bool `json:"passwordRequireLowercase"`
+	PasswordRequireDigit     *bool `json:"passwordRequireDigit"`
+	PasswordRequireSymbol    *bool `json:"passwordRequireSymbol"`
+	PasswordHistoryCount     *int  `json:"passwordHistoryCount"`
+	PasswordCheckBreached    *bool `json:"passwordCheckBreached"`
+
+	RegistrationMode *string `json:"registrationMode"`
+}
+
+// @Router /admin/settings [get]
+// @Tags admin
+// @Summary Get Settings
+// @Description Get site wide settings
+// @Produce json
+// @Success 200 {object} models.Settings
+func (h *Handler) GetSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	isAdmin := CheckIsAdmin(h, r)
+	if !isAdmin {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	settings, err := models.GetSettings(h.DB)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// @Router /admin/settings [post]
+// @Tags admin
+// @Summary Update Settings
+// @Description Update site wide settings, fields left out are unchanged
+// @Accept json
+// @Produce json
+// @Param body body UpdateSettingsRequest true "Body"
+// @Success 200 {object} models.Settings
+func (h *Handler) UpdateSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	isAdmin := CheckIsAdmin(h, r)
+	if !isAdmin {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var updateSettingsRequest UpdateSettingsRequest
+	err := json.NewDecoder(r.Body).Decode(&updateSettingsRequest)
+	if err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	settings, err := models.GetSettings(h.DB)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if updateSettingsRequest.TrashRetentionDays != nil {
+		if *updateSettingsRequest.TrashRetentionDays < 0 {
+			http.Error(w, "Trash retention can't be negative", http.StatusBadRequest)
+			return
+		}
+		settings.TrashRetentionDays = *updateSettingsRequest.TrashRetentionDays
+	}
+
+	if updateSettingsRequest.VersionKeepCount != nil {
+		if *updateSettingsRequest.VersionKeepCount < 0 {
+			http.Error(w, "Versions to keep can't be negative", http.StatusBadRequest)
+			return
+		}
+		settings.VersionKeepCount = *updateSettingsRequest.VersionKeepCount
+	}
+
+	if updateSettingsRequest.VersionKeepDays != nil {
+		if *updateSettingsRequest.VersionKeepDays < 0 {
+			http.Error(w, "Version retention can't be negative", http.StatusBadRequest)
+			return
+		}
+		settings.VersionKeepDays = *updateSettingsRequest.VersionKeepDays
+	}
+
+	if updateSettingsRequest.AdminsCanAccessPersonalFolders != nil {
+		settings.AdminsCanAccessPersonalFolders = *updateSettingsRequest.AdminsCanAccessPersonalFolders
+	}
+
+	if updateSettingsRequest.RequireAdminTwoFactor != nil {
+		// Otherwise the admin turning it on would be shut out of the setting straight away
+		user := homeshareUser(h, r)
+		if *updateSettingsRequest.RequireAdminTwoFactor && (user == nil || !hasTwoFactor(h, user)) {
+			http.Error(w, "Set up two factor authentication before requiring it", http.StatusBadRequest)
+			return
+		}
+		settings.RequireAdminTwoFactor = *updateSettingsRequest.RequireAdminTwoFactor
+	}
+
+	if updateSettingsRequest.LockoutThreshold != nil {
+		if *updateSettingsRequest.LockoutThreshold < 0 {
+			http.Error(w, "Lockout threshold can't be negative", http.StatusBadRequest)
+			return
+		}
+		settings.LockoutThreshold = *updateSettingsRequest.LockoutThreshold
+	}
+
+	if updateSettingsRequest.LockoutMinutes != nil {
+		if *updateSettingsRequest.LockoutMinutes < 1 {
+			http.Error(w, "Lockouts have to last at least a minute", http.StatusBadRequest)
+			return
+		}
+		settings.LockoutMinutes = *updateSettingsRequest.LockoutMinutes
+	}
+
+	if updateSettingsRequest.PasswordMinLength != nil {
+		if *updateSettingsRequest.PasswordMinLength < 1 || *updateSettingsRequest.PasswordMinLength > maxPasswordBytes {
+			http.Error(w, fmt.Sprintf("Minimum password length has to be between 1 and %d", maxPasswordBytes), http.StatusBadRequest)
+			return
+		}
+		settings.PasswordMinLength = *updateSettingsRequest.PasswordMinLength
+	}
+
+	if updateSettingsRequest.PasswordRequireUppercase != nil {
+		settings.PasswordRequireUppercase = *updateSettingsRequest.PasswordRequireUppercase
+	}
+
+	if updateSettingsRequest.PasswordRequireLowercase != nil {
+		settings.PasswordRequireLowercase = *updateSettingsRequest.PasswordRequireLowercase
+	}
+
+	if updateSettingsRequest.PasswordRequireDigit != nil {
+		settings.PasswordRequireDigit = *updateSettingsRequest.PasswordRequireDigit
+	}
+
+	if updateSettingsRequest.PasswordRequireSymbol != nil {
+		settings.PasswordRequireSymbol = *updateSettingsRequest.PasswordRequireSymbol
+	}
+
+	if updateSettingsRequest.PasswordHistoryCount != nil {
+		if *updateSettingsRequest.PasswordHistoryCount < 0 || *updateSettingsRequest.PasswordHistoryCount > maxPasswordHistory {
+			http.Error(w, fmt.Sprintf("Password history has to be between 0 and %d", maxPasswordHistory), http.StatusBadRequest)
+			return
+		}
+		settings.PasswordHistoryCount = *updateSettingsRequest.PasswordHistoryCount
+	}
+
+	if updateSettingsRequest.PasswordCheckBreached != nil {
+		settings.PasswordCheckBreached = *updateSettingsRequest.PasswordCheckBreached
+	}
+
+	if updateSettingsRequest.RegistrationMode != nil {
+		if !registrationModes[*updateSettingsRequest.RegistrationMode] {
+			http.Error(w, "Registration mode has to be open, invite-only or closed", http.StatusBadRequest)
+			return
+		}
+		settings.RegistrationMode = *updateSettingsRequest.RegistrationMode
+	}
+
+	result := h.DB.Save(&settings)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
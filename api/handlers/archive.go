@@ -0,0 +1,305 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Something that archive entries can be streamed into, zip or tar.gz
+type archiveWriter interface {
+	addDirectory(name string, info os.FileInfo) error
+	addFile(name string, path string, info os.FileInfo) error
+	Close() error
+}
+
+type zipArchiveWriter struct {
+	zip *zip.Writer
+}
+
+func (a *zipArchiveWriter) addDirectory(name string, info os.FileInfo) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name + "/"
+
+	_, err = a.zip.CreateHeader(header)
+	return err
+}
+
+func (a *zipArchiveWriter) addFile(name string, path string, info os.FileInfo) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+
+	entry, err := a.zip.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(entry, file)
+	return err
+}
+
+func (a *zipArchiveWriter) Close() error {
+	return a.zip.Close()
+}
+
+type tarGzArchiveWriter struct {
+	gzip *gzip.Writer
+	tar  *tar.Writer
+}
+
+func (a *tarGzArchiveWriter) addDirectory(name string, info os.FileInfo) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name + "/"
+
+	return a.tar.WriteHeader(header)
+}
+
+func (a *tarGzArchiveWriter) addFile(name string, path string, info os.FileInfo) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+
+	err = a.tar.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(a.tar, file)
+	return err
+}
+
+func (a *tarGzArchiveWriter) Close() error {
+	err := a.tar.Close()
+	if err != nil {
+		return err
+	}
+	return a.gzip.Close()
+}
+
+// Sets the Content-Type for format and starts streaming an archive into the response
+func newArchiveWriter(w http.ResponseWriter, format string) archiveWriter {
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		return &zipArchiveWriter{zip: zip.NewWriter(w)}
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	gzipWriter := gzip.NewWriter(w)
+	return &tarGzArchiveWriter{gzip: gzipWriter, tar: tar.NewWriter(gzipWriter)}
+}
+
+// Adds a file or directory tree to the archive under name, skipping
+// .thumbnails and dotfiles the same way directory listings do.
+// canRead, if not nil, leaves out anything it returns false for.
+func addToArchive(archive archiveWriter, name string, root string, canRead func(fullPath string) bool) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path != root && (strings.HasPrefix(info.Name(), ".") || (canRead != nil && !canRead(path))) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		entryName := name
+		if relativePath != "." {
+			entryName += "/" + filepath.ToSlash(relativePath)
+		}
+
+		if info.IsDir() {
+			return archive.addDirectory(entryName, info)
+		}
+
+		// Symlinks, sockets and the like have no content worth archiving
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		return archive.addFile(entryName, path, info)
+	})
+}
+
+// Gives an item a top level name no other item in the archive has, "photo.jpg", "photo (2).jpg", ...
+func uniqueArchiveName(name string, isDir bool, used map[string]bool) string {
+	extension := ""
+	if !isDir {
+		extension = filepath.Ext(name)
+	}
+	base := strings.TrimSuffix(name, extension)
+
+	candidate := name
+	for i := 2; used[candidate]; i++ {
+		candidate = fmt.Sprintf("%s (%d)%s", base, i, extension)
+	}
+
+	used[candidate] = true
+	return candidate
+}
+
+// Names the archive after what's in it
+func archiveFileName(root string, paths []string, extension string) string {
+	name := "homeshare"
+
+	if len(paths) == 1 {
+		base := filepath.Base(paths[0])
+		if filepath.Clean(paths[0]) != filepath.Clean(root) && base != PathDelimiter {
+			name = base
+		}
+	} else {
+		parent := filepath.Dir(paths[0])
+		for _, path := range paths[1:] {
+			if filepath.Dir(path) != parent {
+				parent = ""
+				break
+			}
+		}
+
+		if parent != "" && parent != filepath.Clean(root) {
+			name = filepath.Base(parent)
+		}
+	}
+
+	return name + extension
+}
+
+// @Router /download-archive [get]
+// @Tags homeshare
+// @Summary Download Archive
+// @Description Stream one or more directories or files as a zip or tar.gz archive
+// @Produce application/zip
+// @Produce application/gzip
+// @Param path query []string true "Paths" collectionFormat(multi)
+// @Param format query string false "zip (default) or tar.gz"
+// @Param scope query string false "shared (default) or personal"
+func (h *Handler) DownloadArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	isAuthorized := CheckCanHomeshare(h, r)
+	if !isAuthorized {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	paths := r.URL.Query()["path"]
+	if len(paths) == 0 {
+		http.Error(w, "No paths provided", http.StatusBadRequest)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "zip"
+	}
+
+	if format != "zip" && format != "tar.gz" {
+		http.Error(w, "Invalid format", http.StatusBadRequest)
+		return
+	}
+
+	root, ok := scopeRoot(h, w, r)
+	if !ok {
+		return
+	}
+
+	// Validate everything up front, once streaming starts errors can't be reported
+	itemPaths := []string{}
+	itemInfos := []os.FileInfo{}
+	seen := map[string]bool{}
+	for _, path := range paths {
+		itemPath := processPath(root + path)
+
+		if !checkPathInRoot(itemPath) {
+			http.Error(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+
+		itemPath = filepath.Clean(itemPath)
+
+		info, err := os.Stat(itemPath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if !CheckPermission(h, r, itemPath, "read") {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		// The same path asked for twice only goes in once
+		if seen[itemPath] {
+			continue
+		}
+		seen[itemPath] = true
+
+		itemPaths = append(itemPaths, itemPath)
+		itemInfos = append(itemInfos, info)
+	}
+
+	archive := newArchiveWriter(w, format)
+
+	canRead := readableFilter(h, r)
+
+	fileName := archiveFileName(root, itemPaths, "."+format)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+
+	// Items from different directories can share a name, entries mustn't
+	usedNames := map[string]bool{}
+
+	for i, itemPath := range itemPaths {
+		name := filepath.Base(itemPath)
+		if itemPath == filepath.Clean(root) {
+			name = "homeshare"
+		}
+		name = uniqueArchiveName(name, itemInfos[i].IsDir(), usedNames)
+
+		err := addToArchive(archive, name, itemPath, canRead)
+		if err != nil {
+			log.Printf("Error streaming archive %s: %v", fileName, err)
+			return
+		}
+	}
+
+	err := archive.Close()
+	if err != nil {
+		log.Printf("Error streaming archive %s: %v", fileName, err)
+	}
+}
@@ -3,7 +3,9 @@ package handlers
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"os"
@@ -13,6 +15,7 @@ import (
 	"github.com/PoppedBit/HomeShareDrive/models"
 	"github.com/gorilla/mux"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 )
 
 var DisallowedUsernames = []string{
@@ -32,6 +35,16 @@ func GenerateSalt() (string, error) {
 	return base64.StdEncoding.EncodeToString(salt), nil
 }
 
+// GenerateToken creates a random, url safe token from the given number of bytes
+func GenerateToken(size int) (string, error) {
+	token := make([]byte, size)
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
 // HashPassword hashes a password with the given salt
 func HashPassword(password, salt string) (string, error) {
 	saltAndPassword := salt + password
@@ -46,6 +59,8 @@ type RegisterRequest struct {
 	Username string `json:"username"`
 	Email    string `json:"email"`
 	Password string `json:"password"`
+
+	InviteCode string `json:"inviteCode"` // Needed when registration is invite only
 }
 
 // @Router /register [post]
@@ -65,6 +80,26 @@ func (h *Handler) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	mode, err := registrationMode(h)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if mode == "closed" {
+		http.Error(w, "Registration is closed", http.StatusForbidden)
+		return
+	}
+
+	// An invite can still be used to join its groups when registration is open
+	var invite *models.Invite
+	if mode == "invite-only" || registerRequest.InviteCode != "" {
+		invite = findInvite(h, w, registerRequest.InviteCode)
+		if invite == nil {
+			return
+		}
+	}
+
 	// Access the identifier and password from the parsed object
 	username := registerRequest.Username
 	email := registerRequest.Email
@@ -95,7 +130,9 @@ func (h *Handler) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// TODO Validate Password
+	if !checkPassword(h, w, nil, password) {
+		return
+	}
 
 	// Hash the password
 	salt, err := GenerateSalt()
@@ -119,12 +156,25 @@ func (h *Handler) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		isAdmin = true
 	}
 
-	// First two users are automatically verified
+	// First two users are automatically verified, and so is anyone an admin invited
 	isEmailVerified := false
-	if len(users) < 2 {
+	if len(users) < 2 || invite != nil {
 		isEmailVerified = true
 	}
 
+	if invite != nil {
+		claimed, err := claimInvite(h, invite)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if !claimed {
+			http.Error(w, "Invite has been used up", http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Create the user
 	user = models.User{
 		Username:         username,
@@ -138,13 +188,68 @@ func (h *Handler) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 
 	result := h.DB.Create(&user)
 	if result.Error != nil {
+		if invite != nil {
+			releaseInvite(h, invite)
+		}
 		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if invite != nil {
+		err = applyInvite(h, invite, &user)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = createPersonalFolder(user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Without email set up an admin has to verify them instead
+	if !user.IsEmailVerified && user.Email != "" && h.Mailer != nil {
+		err = sendVerificationEmail(h, &user)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
 	w.WriteHeader(http.StatusCreated)
 }
 
+// Checked against when there's no account, so a login takes as long either way and doesn't give away which it was
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+
+// Looks up a user by username or email, nil if there isn't one
+func findLoginUser(h *Handler, identifier string) *models.User {
+	var user models.User
+	result := h.DB.Where("username = ? OR original_username = ? OR email = ?", identifier, identifier, identifier).First(&user)
+	if result.Error != nil {
+		return nil
+	}
+	return &user
+}
+
+// Looks up a user by username or email and checks their password, nil if either doesn't match
+func checkCredentials(h *Handler, identifier string, password string) *models.User {
+	user := findLoginUser(h, identifier)
+	if user == nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(user.PasswordSalt+password))
+	if err != nil {
+		return nil
+	}
+
+	return user
+}
+
 type LoginRequest struct {
 	Identifier string `json:"identifier"`
 	Password   string `json:"password"`
@@ -168,16 +273,14 @@ func (h *Handler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	identifier := loginRequest.Identifier
 	password := loginRequest.Password
 
-	var user models.User
-	result := h.DB.Where("username = ? OR original_username = ? OR email = ?", identifier, identifier, identifier).First(&user)
-	if result.Error != nil {
-		http.Error(w, "Invalid username or email", http.StatusBadRequest)
+	user, throttle := throttledCheckCredentials(h, identifier, password, clientIP(r), "password")
+	if throttle != nil {
+		throttle.write(w)
 		return
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(user.PasswordSalt+password))
-	if err != nil {
-		http.Error(w, "Invalid username or email", http.StatusBadRequest)
+	if user == nil {
+		http.Error(w, "Invalid username, email or password", http.StatusBadRequest)
 		return
 	}
 
@@ -187,9 +290,32 @@ func (h *Handler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	session.Values["id"] = user.ID
+	// The session is held back until the second factor is given at /login/2fa or /login/passkey
+	if hasTwoFactor(h, user) {
+		startPendingLogin(session, user)
 
-	err = session.Save(r, w)
+		err = session.Save(r, w)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(LoginResponse{
+			TwoFactorRequired: true,
+			TwoFactorMethods:  twoFactorMethods(h, user),
+		})
+		return
+	}
+
+	if isBanned(user) {
+		writeBanned(w, user)
+		return
+	}
+
+	recordLoginSuccess(h, user)
+
+	err = finishLogin(w, r, session, user)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -197,7 +323,11 @@ func (h *Handler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 
 	// TODO Update last login and last active
 
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LoginResponse{
+		TwoFactorMethods:       []string{},
+		TwoFactorSetupRequired: adminNeedsTwoFactor(h, user),
+	})
 }
 
 type UserSession struct {
@@ -213,13 +343,7 @@ type UserSession struct {
 // @Produce json
 // @Success 200
 func (h *Handler) CheckSessionHandler(w http.ResponseWriter, r *http.Request) {
-	session, err := h.Store.Get(r, "session")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	userID := session.Values["id"]
+	userID := requestUserID(h, r)
 
 	userSession := UserSession{
 		ID:        0,
@@ -228,18 +352,29 @@ func (h *Handler) CheckSessionHandler(w http.ResponseWriter, r *http.Request) {
 		NameColor: "",
 	}
 
-	if userID != nil {
+	if userID != 0 {
 		var user models.User
 		result := h.DB.First(&user, userID)
 
-		// TODO - Invalidate session since user doesn't exist
+		// The user was deleted, so the session goes with them
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) && requestAPIToken(r) == nil {
+			session, err := h.Store.Get(r, "session")
+			if err == nil {
+				session.Options.MaxAge = -1
+				session.Save(r, w)
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(userSession)
+			return
+		}
 
 		if result.Error != nil {
 			http.Error(w, result.Error.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		userSession.ID = userID.(uint)
+		userSession.ID = userID
 		userSession.Username = user.Username
 		userSession.IsAdmin = user.IsAdmin
 		userSession.NameColor = user.NameColor
@@ -273,22 +408,22 @@ func (h *Handler) LogoutHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 type AccountSettings struct {
-	Username         string `json:"username"`
-	OriginalUsername string `json:"originalUsername"`
-	Email            string `json:"email"`
-	IsEmailVerified  bool   `json:"IsEmailVerified"`
-	NameColor        string `json:"nameColor"`
-	PFP              string `json:"pfp"`
+	Username         string       `json:"username"`
+	OriginalUsername string       `json:"originalUsername"`
+	Email            string       `json:"email"`
+	IsEmailVerified  bool         `json:"IsEmailVerified"`
+	NameColor        string       `json:"nameColor"`
+	PFP              string       `json:"pfp"`
+	StorageUsed      int64        `json:"storageUsed"`
+	Quotas           []QuotaUsage `json:"quotas"`
+
+	TOTPEnabled            bool `json:"totpEnabled"`
+	RecoveryCodesLeft      int  `json:"recoveryCodesLeft"`
+	TwoFactorSetupRequired bool `json:"twoFactorSetupRequired"`
 }
 
 func (h *Handler) AccountSettingsHandler(w http.ResponseWriter, r *http.Request) {
-	session, err := h.Store.Get(r, "session")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	userID := session.Values["id"]
+	userID := requestUserID(h, r)
 	if userID == 0 {
 		http.Error(w, "Not logged in", http.StatusUnauthorized)
 		return
@@ -309,6 +444,21 @@ func (h *Handler) AccountSettingsHandler(w http.ResponseWriter, r *http.Request)
 		pfpFileName = pfp.FileName
 	}
 
+	storageUsed, err := storageUsed(h, user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	quotas, err := userQuotas(h, user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var recoveryCodesLeft int64
+	h.DB.Model(&models.RecoveryCode{}).Where("user_id = ?", user.ID).Count(&recoveryCodesLeft)
+
 	accountSettings := AccountSettings{
 		Username:         user.Username,
 		OriginalUsername: user.OriginalUsername,
@@ -316,6 +466,21 @@ func (h *Handler) AccountSettingsHandler(w http.ResponseWriter, r *http.Request)
 		IsEmailVerified:  user.IsEmailVerified,
 		NameColor:        user.NameColor,
 		PFP:              pfpFileName,
+		StorageUsed:      storageUsed,
+		Quotas:           []QuotaUsage{},
+
+		TOTPEnabled:            user.TOTPEnabled,
+		RecoveryCodesLeft:      int(recoveryCodesLeft),
+		TwoFactorSetupRequired: adminNeedsTwoFactor(h, &user),
+	}
+
+	for _, quota := range quotas {
+		usage, err := quotaUsage(h, quota)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		accountSettings.Quotas = append(accountSettings.Quotas, usage)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -340,15 +505,7 @@ func (h *Handler) UpdatePasswordHandler(w http.ResponseWriter, r *http.Request)
 	oldPassword := updatePasswordRequest.OldPassword
 	newPassword := updatePasswordRequest.NewPassword
 
-	// TODO make sure password meets requirements
-
-	session, err := h.Store.Get(r, "session")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	userID := session.Values["id"]
+	userID := requestUserID(h, r)
 	if userID == 0 {
 		http.Error(w, "Not logged in", http.StatusUnauthorized)
 		return
@@ -367,6 +524,10 @@ func (h *Handler) UpdatePasswordHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if !checkPassword(h, w, &user, newPassword) {
+		return
+	}
+
 	salt, err := GenerateSalt()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -379,6 +540,8 @@ func (h *Handler) UpdatePasswordHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	recordPasswordHistory(h, &user)
+
 	user.PasswordHash = passwordHash
 	user.PasswordSalt = salt
 
@@ -388,6 +551,13 @@ func (h *Handler) UpdatePasswordHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// Anywhere else the old password was used to log in is logged out
+	err = revokeUserSessions(h, user.ID, currentSessionToken(h, r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -409,14 +579,8 @@ func (h *Handler) UpdateUsernameHandler(w http.ResponseWriter, r *http.Request)
 	username := updateUsernameRequest.Username
 	nameColor := updateUsernameRequest.NameColor
 
-	session, err := h.Store.Get(r, "session")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	userID := session.Values["id"]
-	if userID == nil {
+	userID := requestUserID(h, r)
+	if userID == 0 {
 		http.Error(w, "Not logged in", http.StatusUnauthorized)
 		return
 	}
@@ -465,14 +629,8 @@ func (h *Handler) UpdateProfilePictureHandler(w http.ResponseWriter, r *http.Req
 	}
 	defer file.Close()
 
-	session, err := h.Store.Get(r, "session")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	userID := session.Values["id"]
-	if userID == nil {
+	userID := requestUserID(h, r)
+	if userID == 0 {
 		http.Error(w, "Not logged in", http.StatusUnauthorized)
 		return
 	}
@@ -544,13 +702,7 @@ func (h *Handler) GetProfilePictureHandler(w http.ResponseWriter, r *http.Reques
 
 	// If no userID is provided, get the profile picture of the logged in user
 	if _, ok := vars["userID"]; !ok {
-		session, err := h.Store.Get(r, "session")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		userID = session.Values["id"].(uint)
+		userID = requestUserID(h, r)
 
 		if userID == 0 {
 			http.Error(w, "Not logged in", http.StatusUnauthorized)
@@ -584,14 +736,8 @@ func (h *Handler) GetProfilePictureHandler(w http.ResponseWriter, r *http.Reques
 }
 
 func (h *Handler) DeleteProfilePictureHandler(w http.ResponseWriter, r *http.Request) {
-	session, err := h.Store.Get(r, "session")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	userID := session.Values["id"]
-	if userID == nil {
+	userID := requestUserID(h, r)
+	if userID == 0 {
 		http.Error(w, "Not logged in", http.StatusUnauthorized)
 		return
 	}
@@ -611,7 +757,7 @@ func (h *Handler) DeleteProfilePictureHandler(w http.ResponseWriter, r *http.Req
 	}
 
 	// If upload.UploadPath exists, delete it
-	_, err = os.Stat(upload.UploadPath)
+	_, err := os.Stat(upload.UploadPath)
 	if err == nil {
 		err = os.Remove(upload.UploadPath)
 		if err != nil {
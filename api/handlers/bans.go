@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+)
+
+// Whether a user is banned right now, a ban that's run out counts as lifted even before it's cleared
+func isBanned(user *models.User) bool {
+	return user.IsBanned && (user.UnBanDate == nil || user.UnBanDate.After(time.Now()))
+}
+
+type BannedResponse struct {
+	Error     string     `json:"error"`
+	BanReason string     `json:"banReason"`
+	UnBanDate *time.Time `json:"unBanDate"`
+}
+
+// Writes a 403 telling the user why they're banned and until when
+func writeBanned(w http.ResponseWriter, user *models.User) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(BannedResponse{
+		Error:     "Banned",
+		BanReason: user.BanReason,
+		UnBanDate: user.UnBanDate,
+	})
+}
+
+// Turns away every request from a banned user, logging their session out as it goes
+func (h *Handler) BanMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := requestUserID(h, r)
+		if userID == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var user models.User
+		result := h.DB.First(&user, userID)
+		if result.Error != nil || !isBanned(&user) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if requestAPIToken(r) == nil {
+			session, err := h.Store.Get(r, "session")
+			if err == nil {
+				delete(session.Values, "id")
+				session.Save(r, w)
+			}
+		}
+
+		writeBanned(w, &user)
+	})
+}
+
+// Periodically lifts bans whose unban date has passed
+func (h *Handler) LiftExpiredBans(interval time.Duration) {
+	for {
+		result := h.DB.Model(&models.User{}).Where("is_banned = ? AND un_ban_date < ?", true, time.Now()).Updates(map[string]any{
+			"is_banned":   false,
+			"ban_reason":  "",
+			"un_ban_date": nil,
+		})
+		if result.Error != nil {
+			log.Printf("Error lifting expired bans: %v", result.Error)
+		}
+
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Length of the hash prefix passwords are looked up by, the same as the Pwned Passwords range API
+const breachedPasswordPrefixLength = 5
+
+// Passwords known to have leaked, in a file in the Have I Been Pwned format: the password's SHA-1 in hex on each line,
+// optionally followed by :count, sorted by hash. The file is searched where it is rather than loaded, so it can be the
+// full list, and it's looked up a range at a time so checking a password never needs more of its hash than the prefix.
+type BreachedPasswords struct {
+	file *os.File
+	size int64
+}
+
+func LoadBreachedPasswords(path string) (*BreachedPasswords, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	breached := &BreachedPasswords{
+		file: file,
+		size: info.Size(),
+	}
+
+	// Catches being pointed at the wrong file, rather than every lookup quietly finding nothing
+	first, err := breached.hashAt(0)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !isSHA1Hex(first) {
+		file.Close()
+		return nil, errors.New(path + " isn't a list of SHA-1 hashes")
+	}
+
+	return breached, nil
+}
+
+func isSHA1Hex(hash string) bool {
+	if len(hash) != sha1.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// The hash on a line, without its count
+func lineHash(line string) string {
+	hash, _, _ := strings.Cut(strings.TrimSpace(line), ":")
+	return strings.ToUpper(hash)
+}
+
+// Reads the file a line at a time from the first line starting at or after offset
+func (b *BreachedPasswords) linesFrom(offset int64) (*bufio.Reader, error) {
+	if offset == 0 {
+		return bufio.NewReaderSize(io.NewSectionReader(b.file, 0, b.size), 256), nil
+	}
+
+	// Starts a byte early and skips to the end of that line, so a line starting right at offset isn't missed
+	reader := bufio.NewReaderSize(io.NewSectionReader(b.file, offset-1, b.size-offset+1), 256)
+	_, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+// The hash on the first line that isn't blank starting at or after offset, empty once there are no more
+func (b *BreachedPasswords) hashAt(offset int64) (string, error) {
+	reader, err := b.linesFrom(offset)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+
+		hash := lineHash(line)
+		if hash != "" || err == io.EOF {
+			return hash, nil
+		}
+	}
+}
+
+// The suffixes of every breached hash starting with prefix
+func (b *BreachedPasswords) Range(prefix string) ([]string, error) {
+	prefix = strings.ToUpper(prefix)
+
+	// Binary searches for the first line that isn't before the prefix, the file being sorted
+	var searchErr error
+	start := sort.Search(int(b.size), func(i int) bool {
+		if searchErr != nil {
+			return true
+		}
+
+		hash, err := b.hashAt(int64(i))
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		return hash == "" || hash >= prefix
+	})
+	if searchErr != nil {
+		return nil, searchErr
+	}
+
+	reader, err := b.linesFrom(int64(start))
+	if err != nil {
+		return nil, err
+	}
+
+	suffixes := []string{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		hash := lineHash(line)
+		if hash != "" && !strings.HasPrefix(hash, prefix) {
+			return suffixes, nil
+		}
+
+		if isSHA1Hex(hash) {
+			suffixes = append(suffixes, hash[len(prefix):])
+		}
+
+		if err == io.EOF {
+			return suffixes, nil
+		}
+	}
+}
+
+// Whether a password is on the list
+func (b *BreachedPasswords) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	suffixes, err := b.Range(hash[:breachedPasswordPrefixLength])
+	if err != nil {
+		return false, err
+	}
+
+	for _, suffix := range suffixes {
+		if suffix == hash[breachedPasswordPrefixLength:] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func writeBreachedPasswords(t *testing.T, contents string) *BreachedPasswords {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "pwned.txt")
+	err := os.WriteFile(path, []byte(contents), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	breached, err := LoadBreachedPasswords(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { breached.file.Close() })
+	return breached
+}
+
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func TestBreachedPasswordsContains(t *testing.T) {
+	leaked := []string{}
+	for i := 0; i < 5000; i++ {
+		leaked = append(leaked, fmt.Sprintf("leaked%d", i))
+	}
+
+	hashes := []string{}
+	for _, password := range leaked {
+		hashes = append(hashes, sha1Hex(password))
+	}
+	sort.Strings(hashes)
+
+	// Counts, Windows line endings and a stray blank line, as the downloads can have
+	var b strings.Builder
+	for i, hash := range hashes {
+		fmt.Fprintf(&b, "%s:%d\r\n", hash, i+1)
+		if i == len(hashes)/2 {
+			b.WriteString("\r\n")
+		}
+	}
+	breached := writeBreachedPasswords(t, b.String())
+
+	for _, password := range leaked {
+		got, err := breached.Contains(password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got {
+			t.Fatalf("%s wasn't found", password)
+		}
+	}
+
+	for i := 0; i < 5000; i++ {
+		password := fmt.Sprintf("safe%d", i)
+		got, err := breached.Contains(password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got {
+			t.Fatalf("%s was found", password)
+		}
+	}
+}
+
+func TestBreachedPasswordsRange(t *testing.T) {
+	breached := writeBreachedPasswords(t, strings.Join([]string{
+		"0000000000000000000000000000000000000001:3",
+		"00000FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF:1",
+		"00001000000000000000000000000000000000AA:2",
+		"00001000000000000000000000000000000000BB",
+		"FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF:9",
+	}, "\n"))
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"00000", []string{"00000000000000000000000000000000001", "FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF"}},
+		{"00001", []string{"000000000000000000000000000000000AA", "000000000000000000000000000000000BB"}},
+		{"00002", []string{}},
+		{"fffff", []string{"FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF"}},
+	}
+
+	for _, test := range tests {
+		got, err := breached.Range(test.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("%s: got %v, want %v", test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestLoadBreachedPasswordsRejectsOtherFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passwords.txt")
+	os.WriteFile(path, []byte("password\n123456\n"), 0644)
+
+	_, err := LoadBreachedPasswords(path)
+	if err == nil {
+		t.Error("a list of plain passwords was accepted")
+	}
+}
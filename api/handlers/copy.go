@@ -0,0 +1,448 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// How long a finished copy job can still be polled
+var copyJobRetention = time.Hour
+
+type CopyFailure struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+type CopyJob struct {
+	ID          string        `json:"id"`
+	UserID      uint          `json:"-"`
+	Path        string        `json:"path"`
+	Destination string        `json:"destination"`
+	Status      string        `json:"status"` // running, completed, completedWithErrors
+	TotalBytes  int64         `json:"totalBytes"`
+	BytesDone   int64         `json:"bytesDone"`
+	TotalFiles  int           `json:"totalFiles"`
+	FilesDone   int           `json:"filesDone"`
+	CurrentFile string        `json:"currentFile"`
+	Failures    []CopyFailure `json:"failures"`
+	StartedAt   time.Time     `json:"startedAt"`
+	FinishedAt  *time.Time    `json:"finishedAt"`
+
+	// Only what the user who started the job can read gets copied
+	canRead func(fullPath string) bool
+	// The root of the scope the job's paths are relative to
+	root string
+	// Whether whatever is at the destination when the copy finishes gets replaced
+	overwrite bool
+	mu        sync.Mutex
+}
+
+var copyJobs = struct {
+	sync.Mutex
+	jobs map[string]*CopyJob
+}{jobs: map[string]*CopyJob{}}
+
+// Converts an absolute path back into a path relative to the share root
+func sharePath(fullPath string) string {
+	return scopePath(homeShareRoot(), fullPath)
+}
+
+// Returns a copy of the job that is safe to encode while the copy is running
+func (job *CopyJob) snapshot() CopyJob {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	return CopyJob{
+		ID:          job.ID,
+		Path:        job.Path,
+		Destination: job.Destination,
+		Status:      job.Status,
+		TotalBytes:  job.TotalBytes,
+		BytesDone:   job.BytesDone,
+		TotalFiles:  job.TotalFiles,
+		FilesDone:   job.FilesDone,
+		CurrentFile: job.CurrentFile,
+		Failures:    append([]CopyFailure{}, job.Failures...),
+		StartedAt:   job.StartedAt,
+		FinishedAt:  job.FinishedAt,
+	}
+}
+
+func (job *CopyJob) fail(path string, err error) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	job.Failures = append(job.Failures, CopyFailure{
+		Path:  scopePath(job.root, path),
+		Error: err.Error(),
+	})
+}
+
+// Walks the source once up front so progress has something to be measured against
+func (job *CopyJob) measure(src string) {
+	totalFiles := 0
+	var totalBytes int64
+
+	filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if info.IsDir() {
+			if info.Name() == ".thumbnails" || !job.canRead(path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !job.canRead(path) {
+			return nil
+		}
+
+		totalFiles++
+		totalBytes += info.Size()
+		return nil
+	})
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	job.TotalFiles = totalFiles
+	job.TotalBytes = totalBytes
+}
+
+// Copies one file and its thumbnail, recording a failure instead of stopping the job
+func (job *CopyJob) copyOne(h *Handler, src string, dst string) {
+	job.mu.Lock()
+	job.CurrentFile = scopePath(job.root, src)
+	job.mu.Unlock()
+
+	// The copy counts towards the quota of the user who started the job
+	info, err := os.Stat(src)
+	if err != nil {
+		job.fail(src, err)
+		return
+	}
+
+	reserved, release, err := reserveQuota(h, job.UserID, info.Size())
+	defer release()
+	if err == nil && reserved >= 0 && info.Size() > reserved {
+		err = errQuotaExceeded
+	}
+	if err != nil {
+		job.fail(src, err)
+		return
+	}
+
+	_, err = copyFile(src, dst, func(n int64) {
+		job.mu.Lock()
+		job.BytesDone += n
+		job.mu.Unlock()
+	})
+	if err != nil {
+		job.fail(src, err)
+		return
+	}
+
+	err = recordFile(h, job.UserID, dst)
+	if err != nil {
+		job.fail(src, err)
+	}
+
+	srcThumbnail := thumbnailPath(src)
+	if _, err := os.Stat(srcThumbnail); err == nil {
+		dstThumbnail := thumbnailPath(dst)
+		err = os.MkdirAll(filepath.Dir(dstThumbnail), 0755)
+		if err == nil {
+			_, err = copyFile(srcThumbnail, dstThumbnail, nil)
+		}
+		if err != nil {
+			job.fail(srcThumbnail, err)
+		}
+	}
+
+	job.mu.Lock()
+	job.FilesDone++
+	job.mu.Unlock()
+}
+
+// Puts the finished copy at stagedPath in place at dst. Whatever is already there goes to the trash, unless
+// part of the copy failed, then it's kept and the copy thrown away.
+func (job *CopyJob) finish(h *Handler, stagedPath string, dst string) {
+	_, err := os.Stat(dst)
+	exists := err == nil
+
+	job.mu.Lock()
+	failed := len(job.Failures) > 0
+	job.mu.Unlock()
+
+	if exists && (!job.overwrite || failed) {
+		if !job.overwrite {
+			job.fail(dst, errors.New("Destination already exists"))
+		}
+		removeItem(stagedPath)
+		forgetFiles(h, stagedPath)
+		return
+	}
+
+	info, err := os.Stat(stagedPath)
+	if err != nil {
+		job.fail(dst, err)
+		return
+	}
+
+	err = replaceItem(h, job.UserID, stagedPath, dst)
+	if err == nil {
+		err = moveRecordedFiles(h, stagedPath, dst)
+	}
+	if err == nil && !info.IsDir() {
+		err = moveThumbnail(stagedPath, dst)
+	}
+	if err != nil {
+		job.fail(dst, err)
+	}
+}
+
+func (job *CopyJob) run(h *Handler, src string, dst string) {
+	job.measure(src)
+
+	// The copy is made next to the destination and only put in its place once it's done
+	stagedPath, err := stagingPath(dst)
+	if err != nil {
+		job.fail(dst, err)
+	} else {
+		job.copy(h, src, stagedPath)
+		job.finish(h, stagedPath, dst)
+	}
+
+	finishedAt := time.Now()
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	job.Status = "completed"
+	if len(job.Failures) > 0 {
+		job.Status = "completedWithErrors"
+	}
+	job.CurrentFile = ""
+	job.FinishedAt = &finishedAt
+}
+
+// Copies everything under src the user can read to dst, file by file
+func (job *CopyJob) copy(h *Handler, src string, dst string) {
+	filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			job.fail(path, err)
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Thumbnails are copied along with the images they belong to
+		if info.IsDir() && info.Name() == ".thumbnails" {
+			return filepath.SkipDir
+		}
+
+		if !job.canRead(path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(src, path)
+		if err != nil {
+			job.fail(path, err)
+			return nil
+		}
+		target := filepath.Join(dst, relativePath)
+
+		if info.IsDir() {
+			err = os.MkdirAll(target, info.Mode().Perm())
+			if err != nil {
+				job.fail(path, err)
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		job.copyOne(h, path, target)
+		return nil
+	})
+}
+
+// Forgets jobs that finished long enough ago that nobody is polling them anymore
+func pruneCopyJobs() {
+	copyJobs.Lock()
+	defer copyJobs.Unlock()
+
+	for id, job := range copyJobs.jobs {
+		snapshot := job.snapshot()
+		if snapshot.FinishedAt != nil && time.Since(*snapshot.FinishedAt) > copyJobRetention {
+			delete(copyJobs.jobs, id)
+		}
+	}
+}
+
+type CopyItemRequest struct {
+	Path        string `json:"path"`
+	Destination string `json:"destination"`
+	Overwrite   bool   `json:"overwrite"`
+}
+
+// @Router /copy-item [post]
+// @Tags homeshare
+// @Summary Copy Item
+// @Description Start a background job copying a directory or file to another path
+// @Accept json
+// @Produce json
+// @Param body body CopyItemRequest true "Body"
+// @Param scope query string false "shared (default) or personal"
+// @Success 202 {object} CopyJob "Copy Job"
+func (h *Handler) CopyItemHandler(w http.ResponseWriter, r *http.Request) {
+	isAuthorized := CheckCanHomeshare(h, r)
+	if !isAuthorized {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	userID := requestUserID(h, r)
+
+	var copyItemRequest CopyItemRequest
+	err := json.NewDecoder(r.Body).Decode(&copyItemRequest)
+	if err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	path := copyItemRequest.Path
+	destination := copyItemRequest.Destination
+
+	root, ok := scopeRoot(h, w, r)
+	if !ok {
+		return
+	}
+
+	srcPath := processPath(root + path)
+	dstPath := processPath(root + destination)
+
+	if !checkPathInRoot(srcPath) || !checkPathInRoot(dstPath) {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	srcPath = filepath.Clean(srcPath)
+	dstPath = filepath.Clean(dstPath)
+
+	if srcPath == dstPath {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	if !CheckPermission(h, r, srcPath, "read") || !CheckPermission(h, r, dstPath, "write") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	// A directory can't be copied inside itself
+	if info.IsDir() && strings.HasPrefix(dstPath, srcPath+PathDelimiter) {
+		http.Error(w, "Cannot copy a directory into itself", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := os.Stat(filepath.Dir(dstPath)); err != nil {
+		http.Error(w, "Destination directory does not exist", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := os.Stat(dstPath); err == nil {
+		if !copyItemRequest.Overwrite {
+			http.Error(w, "Destination already exists", http.StatusConflict)
+			return
+		}
+
+		// It's replaced when the copy finishes
+		if !CheckPermission(h, r, dstPath, "delete") {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
+	jobID, err := GenerateToken(16)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	job := &CopyJob{
+		ID:          jobID,
+		UserID:      userID,
+		Path:        path,
+		Destination: destination,
+		Status:      "running",
+		Failures:    []CopyFailure{},
+		StartedAt:   time.Now(),
+		canRead:     readableFilter(h, r),
+		root:        root,
+		overwrite:   copyItemRequest.Overwrite,
+	}
+
+	pruneCopyJobs()
+
+	copyJobs.Lock()
+	copyJobs.jobs[jobID] = job
+	copyJobs.Unlock()
+
+	go job.run(h, srcPath, dstPath)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job.snapshot())
+}
+
+// @Router /copy-item/{jobId} [get]
+// @Tags homeshare
+// @Summary Copy Job Progress
+// @Description Get the progress of a copy job
+// @Produce json
+// @Param jobId path string true "Job ID"
+// @Success 200 {object} CopyJob "Copy Job"
+func (h *Handler) CopyJobHandler(w http.ResponseWriter, r *http.Request) {
+	isAuthorized := CheckCanHomeshare(h, r)
+	if !isAuthorized {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	userID := requestUserID(h, r)
+
+	vars := mux.Vars(r)
+	jobID := vars["jobId"]
+
+	copyJobs.Lock()
+	job, ok := copyJobs.jobs[jobID]
+	copyJobs.Unlock()
+
+	if !ok || job.UserID != userID {
+		http.Error(w, "Copy job not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job.snapshot())
+}
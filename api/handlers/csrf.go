@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+)
+
+const csrfTokenHeader = "X-CSRF-Token"
+
+// Methods that don't change anything, so don't need a CSRF token
+var csrfSafeMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// Holds requests made with the session cookie to having the session's CSRF token in an X-CSRF-Token header,
+// so another site can't make them on the user's behalf. Bearer tokens aren't sent by the browser on their own, so
+// requests using one don't need it.
+func (h *Handler) CSRFMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if csrfSafeMethods[r.Method] || requestAPIToken(r) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		session, err := h.Store.Get(r, "session")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Without a session there's nothing for a forged request to make use of
+		if session.IsNew {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		expected, _ := session.Values["csrfToken"].(string)
+		given := r.Header.Get(csrfTokenHeader)
+		if expected == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(given)) != 1 {
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+type CSRFTokenResponse struct {
+	CSRFToken string `json:"csrfToken"` // Send as the X-CSRF-Token header
+}
+
+// @Router /csrf-token [get]
+// @Tags auth
+// @Summary CSRF Token
+// @Description The session's CSRF token, to send as the X-CSRF-Token header on anything that isn't a GET.
+// @Description It lasts as long as the session, logging in keeps it.
+// @Produce json
+// @Success 200 {object} CSRFTokenResponse
+func (h *Handler) CSRFTokenHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := h.Store.Get(r, "session")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	token, _ := session.Values["csrfToken"].(string)
+	if token == "" {
+		token, err = GenerateToken(32)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		session.Values["csrfToken"] = token
+		err = session.Save(r, w)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(CSRFTokenResponse{
+		CSRFToken: token,
+	})
+}
@@ -0,0 +1,548 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+var errDropFileTooLarge = errors.New("file is larger than this link allows")
+var errDropLinkFull = errors.New("this link has no space left")
+
+// The address a request came from, without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func dropLinkAllowsExtension(dropLink *models.DropLink, fileName string) bool {
+	if strings.TrimSpace(dropLink.AllowedExtensions) == "" {
+		return true
+	}
+
+	extension := strings.ToLower(filepath.Ext(fileName))
+	for _, allowed := range strings.Split(dropLink.AllowedExtensions, ",") {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if !strings.HasPrefix(allowed, ".") {
+			allowed = "." + allowed
+		}
+
+		if extension == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+type CreateDropLinkRequest struct {
+	Name              string     `json:"name"`
+	Path              string     `json:"path"`
+	ExpiresAt         *time.Time `json:"expiresAt"`
+	MaxFileSize       int64      `json:"maxFileSize"`
+	MaxTotalBytes     int64      `json:"maxTotalBytes"`
+	AllowedExtensions string     `json:"allowedExtensions"`
+}
+
+// @Router /drop-links [post]
+// @Tags drop
+// @Summary Create Drop Link
+// @Description Create a link guests can upload into a directory through
+// @Accept json
+// @Produce json
+// @Param body body CreateDropLinkRequest true "Body"
+// @Param scope query string false "shared (default) or personal"
+// @Success 201 {object} models.DropLink "Drop Link"
+func (h *Handler) CreateDropLinkHandler(w http.ResponseWriter, r *http.Request) {
+	isAuthorized := CheckCanHomeshare(h, r)
+	if !isAuthorized {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	userID := requestUserID(h, r)
+
+	var createDropLinkRequest CreateDropLinkRequest
+	err := json.NewDecoder(r.Body).Decode(&createDropLinkRequest)
+	if err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	path := createDropLinkRequest.Path
+
+	root, ok := scopeRoot(h, w, r)
+	if !ok {
+		return
+	}
+
+	directory := processPath(root + path)
+
+	if !checkPathInRoot(directory) {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	if !CheckPermission(h, r, directory, "manage") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	info, err := os.Stat(directory)
+	if err != nil || !info.IsDir() {
+		http.Error(w, "Directory not found", http.StatusNotFound)
+		return
+	}
+
+	if createDropLinkRequest.ExpiresAt != nil && createDropLinkRequest.ExpiresAt.Before(time.Now()) {
+		http.Error(w, "Expiry date is in the past", http.StatusBadRequest)
+		return
+	}
+
+	if createDropLinkRequest.MaxFileSize < 0 || createDropLinkRequest.MaxTotalBytes < 0 {
+		http.Error(w, "Invalid size limit", http.StatusBadRequest)
+		return
+	}
+
+	token, err := GenerateToken(32)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	dropLink := models.DropLink{
+		Token:             token,
+		CreatedUserID:     userID,
+		Name:              createDropLinkRequest.Name,
+		Path:              sharePath(filepath.Clean(root)) + path,
+		ExpiresAt:         createDropLinkRequest.ExpiresAt,
+		MaxFileSize:       createDropLinkRequest.MaxFileSize,
+		MaxTotalBytes:     createDropLinkRequest.MaxTotalBytes,
+		AllowedExtensions: createDropLinkRequest.AllowedExtensions,
+	}
+
+	result := h.DB.Create(&dropLink)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(dropLink)
+}
+
+type GetDropLinksResponse struct {
+	DropLinks []models.DropLink `json:"dropLinks"`
+}
+
+// @Router /drop-links [get]
+// @Tags drop
+// @Summary Drop Links
+// @Description List your drop links, or every drop link for admins
+// @Produce json
+// @Success 200 {object} GetDropLinksResponse "Drop Links"
+func (h *Handler) GetDropLinksHandler(w http.ResponseWriter, r *http.Request) {
+	isAuthorized := CheckCanHomeshare(h, r)
+	if !isAuthorized {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	userID := requestUserID(h, r)
+
+	query := h.DB.Order("created_at desc")
+	if !CheckIsAdmin(h, r) {
+		query = query.Where("created_user_id = ?", userID)
+	}
+
+	dropLinks := []models.DropLink{}
+	result := query.Find(&dropLinks)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := GetDropLinksResponse{
+		DropLinks: dropLinks,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Loads the drop link with the id in the url, only for its creator or an admin
+func getOwnDropLink(h *Handler, w http.ResponseWriter, r *http.Request) (*models.DropLink, bool) {
+	userID := requestUserID(h, r)
+
+	vars := mux.Vars(r)
+	linkId := vars["linkId"]
+
+	var dropLink models.DropLink
+	result := h.DB.First(&dropLink, linkId)
+	if result.Error != nil {
+		http.Error(w, "Drop link not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	if dropLink.CreatedUserID != userID && !CheckIsAdmin(h, r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	return &dropLink, true
+}
+
+// @Router /drop-links/{linkId} [delete]
+// @Tags drop
+// @Summary Revoke Drop Link
+// @Description Revoke a drop link, files already uploaded through it stay
+// @Param linkId path int true "Drop Link ID"
+// @Success 200
+func (h *Handler) RevokeDropLinkHandler(w http.ResponseWriter, r *http.Request) {
+	isAuthorized := CheckCanHomeshare(h, r)
+	if !isAuthorized {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	dropLink, ok := getOwnDropLink(h, w, r)
+	if !ok {
+		return
+	}
+
+	// Soft delete, so the record of what was uploaded through it is kept
+	result := h.DB.Delete(dropLink)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+type GetDropUploadsResponse struct {
+	Uploads []models.DropUpload `json:"uploads"`
+}
+
+// @Router /drop-links/{linkId}/uploads [get]
+// @Tags drop
+// @Summary Drop Link Uploads
+// @Description List the files guests uploaded through a drop link
+// @Produce json
+// @Param linkId path int true "Drop Link ID"
+// @Success 200 {object} GetDropUploadsResponse "Uploads"
+func (h *Handler) GetDropUploadsHandler(w http.ResponseWriter, r *http.Request) {
+	isAuthorized := CheckCanHomeshare(h, r)
+	if !isAuthorized {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	dropLink, ok := getOwnDropLink(h, w, r)
+	if !ok {
+		return
+	}
+
+	uploads := []models.DropUpload{}
+	result := h.DB.Where("drop_link_id = ?", dropLink.ID).Order("created_at desc").Find(&uploads)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := GetDropUploadsResponse{
+		Uploads: uploads,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Loads the drop link named in the url, making sure it can still be uploaded through
+func getDropLink(h *Handler, w http.ResponseWriter, r *http.Request) (*models.DropLink, bool) {
+	vars := mux.Vars(r)
+	token := vars["token"]
+
+	var dropLink models.DropLink
+	result := h.DB.Where("token = ?", token).First(&dropLink)
+	if result.Error != nil {
+		http.Error(w, "Drop link not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	if dropLink.ExpiresAt != nil && dropLink.ExpiresAt.Before(time.Now()) {
+		http.Error(w, "Drop link has expired", http.StatusGone)
+		return nil, false
+	}
+
+	isAllowed, err := linkCreatorAllows(h, dropLink.CreatedUserID, processPath(homeShareRoot()+dropLink.Path), "write")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if !isAllowed {
+		http.Error(w, "Drop link is no longer available", http.StatusGone)
+		return nil, false
+	}
+
+	return &dropLink, true
+}
+
+type PublicDropLinkResponse struct {
+	Name              string     `json:"name"`
+	ExpiresAt         *time.Time `json:"expiresAt"`
+	MaxFileSize       int64      `json:"maxFileSize"`
+	BytesRemaining    *int64     `json:"bytesRemaining"`
+	AllowedExtensions string     `json:"allowedExtensions"`
+}
+
+// @Router /d/{token} [get]
+// @Tags drop
+// @Summary Drop Link
+// @Description Describe the limits of a drop link, no account needed
+// @Produce json
+// @Param token path string true "Drop Link Token"
+// @Success 200 {object} PublicDropLinkResponse "Drop Link"
+func (h *Handler) PublicDropLinkHandler(w http.ResponseWriter, r *http.Request) {
+	dropLink, ok := getDropLink(h, w, r)
+	if !ok {
+		return
+	}
+
+	var bytesRemaining *int64
+	if dropLink.MaxTotalBytes > 0 {
+		remaining := dropLink.MaxTotalBytes - dropLink.BytesUploaded
+		bytesRemaining = &remaining
+	}
+
+	response := PublicDropLinkResponse{
+		Name:              dropLink.Name,
+		ExpiresAt:         dropLink.ExpiresAt,
+		MaxFileSize:       dropLink.MaxFileSize,
+		BytesRemaining:    bytesRemaining,
+		AllowedExtensions: dropLink.AllowedExtensions,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Streams one uploaded file into the drop link's directory, enforcing its limits as it goes
+func receiveDropFile(h *Handler, dropLink *models.DropLink, part *multipart.Part) (string, int64, error) {
+	directory := filepath.Clean(processPath(homeShareRoot() + dropLink.Path))
+
+	// Written under a hidden name, so it only shows up once it's complete
+	tempFile, err := os.CreateTemp(directory, ".drop-*")
+	if err != nil {
+		return "", 0, err
+	}
+	tempPath := tempFile.Name()
+
+	limit := dropLink.MaxFileSize
+	if dropLink.MaxTotalBytes > 0 {
+		var current models.DropLink
+		h.DB.First(&current, dropLink.ID)
+
+		remaining := dropLink.MaxTotalBytes - current.BytesUploaded
+		if limit == 0 || remaining < limit {
+			limit = remaining
+		}
+	}
+
+	// Dropped files count towards the quota of whoever made the link
+	quotaLeft, err := quotaRemaining(h, dropLink.CreatedUserID)
+	if err != nil {
+		tempFile.Close()
+		os.Remove(tempPath)
+		return "", 0, err
+	}
+
+	hasLimit := dropLink.MaxFileSize > 0 || dropLink.MaxTotalBytes > 0 || quotaLeft >= 0
+	if quotaLeft >= 0 && (limit == 0 || quotaLeft < limit) {
+		limit = quotaLeft
+	}
+
+	var reader io.Reader = part
+	if hasLimit {
+		// One byte past the limit tells us it was exceeded
+		reader = io.LimitReader(part, limit+1)
+	}
+
+	size, err := io.Copy(tempFile, reader)
+	tempFile.Close()
+	if err != nil {
+		os.Remove(tempPath)
+		return "", 0, err
+	}
+
+	if hasLimit && size > limit {
+		os.Remove(tempPath)
+		if dropLink.MaxFileSize > 0 && size > dropLink.MaxFileSize {
+			return "", 0, errDropFileTooLarge
+		}
+		if quotaLeft >= 0 && size > quotaLeft {
+			return "", 0, errQuotaExceeded
+		}
+		return "", 0, errDropLinkFull
+	}
+
+	// Set the quota aside now the size is known, another write may have used it up in the meantime
+	reserved, release, err := reserveQuota(h, dropLink.CreatedUserID, size)
+	if err != nil {
+		os.Remove(tempPath)
+		return "", 0, err
+	}
+	defer release()
+
+	if reserved >= 0 && size > reserved {
+		os.Remove(tempPath)
+		return "", 0, errQuotaExceeded
+	}
+
+	// Claim the space, another upload may have used it up in the meantime
+	query := h.DB.Model(&models.DropLink{}).Where("id = ?", dropLink.ID)
+	if dropLink.MaxTotalBytes > 0 {
+		query = query.Where("bytes_uploaded + ? <= max_total_bytes", size)
+	}
+	result := query.UpdateColumn("bytes_uploaded", gorm.Expr("bytes_uploaded + ?", size))
+	if result.Error != nil || result.RowsAffected == 0 {
+		os.Remove(tempPath)
+		return "", 0, errDropLinkFull
+	}
+
+	// Guests can't see what's there, so never overwrite. The name is claimed first and the upload renamed over it.
+	filePath, err := reserveAvailablePath(filepath.Join(directory, filepath.Base(part.FileName())), false)
+	if err != nil {
+		os.Remove(tempPath)
+		return "", 0, err
+	}
+
+	err = os.Rename(tempPath, filePath)
+	if err != nil {
+		os.Remove(tempPath)
+		os.Remove(filePath)
+		return "", 0, err
+	}
+
+	err = finishUpload(filePath)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return filePath, size, recordFile(h, dropLink.CreatedUserID, filePath)
+}
+
+type DropUploadResponse struct {
+	Files []string `json:"files"`
+}
+
+// @Router /d/{token}/upload [post]
+// @Tags drop
+// @Summary Drop Link Upload
+// @Description Upload one or more files through a drop link, no account needed
+// @Accept multipart/form-data
+// @Produce json
+// @Param token path string true "Drop Link Token"
+// @Param name formData string false "Who is uploading, sent before the files"
+// @Param file formData file true "Files"
+// @Success 201 {object} DropUploadResponse "Uploaded Files"
+func (h *Handler) DropUploadHandler(w http.ResponseWriter, r *http.Request) {
+	dropLink, ok := getDropLink(h, w, r)
+	if !ok {
+		return
+	}
+
+	// Read part by part instead of ParseMultipartForm, limits are enforced while streaming
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	uploaderName := ""
+	response := DropUploadResponse{
+		Files: []string{},
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if part.FormName() == "name" {
+			value, _ := io.ReadAll(io.LimitReader(part, 256))
+			uploaderName = strings.TrimSpace(string(value))
+			continue
+		}
+
+		if part.FileName() == "" {
+			continue
+		}
+
+		fileName := filepath.Base(part.FileName())
+		if strings.HasPrefix(fileName, ".") || !dropLinkAllowsExtension(dropLink, fileName) {
+			http.Error(w, "File type not allowed: "+fileName, http.StatusBadRequest)
+			return
+		}
+
+		filePath, size, err := receiveDropFile(h, dropLink, part)
+		if err == errDropFileTooLarge || err == errDropLinkFull {
+			http.Error(w, fileName+": "+err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err == errQuotaExceeded {
+			http.Error(w, fileName+": "+err.Error(), http.StatusInsufficientStorage)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		dropUpload := models.DropUpload{
+			DropLinkID:   dropLink.ID,
+			FileName:     fileName,
+			Path:         sharePath(filePath),
+			Size:         size,
+			UploaderName: uploaderName,
+			UploaderIP:   clientIP(r),
+		}
+
+		result := h.DB.Create(&dropUpload)
+		if result.Error != nil {
+			http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response.Files = append(response.Files, filepath.Base(filePath))
+	}
+
+	if len(response.Files) == 0 {
+		http.Error(w, "No files uploaded", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,328 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+)
+
+const (
+	verifyEmailTokenLifetime   = 24 * time.Hour
+	resetPasswordTokenLifetime = time.Hour
+)
+
+type emailTokenPayload struct {
+	UserID    uint   `json:"u"`
+	Purpose   string `json:"p"` // verify-email or reset-password
+	ExpiresAt int64  `json:"e"`
+}
+
+// What a token is tied to, so using it once is enough to stop it working again.
+// A verification token dies when the email is verified or changed, a reset token when the password changes.
+func emailTokenState(user *models.User, purpose string) string {
+	if purpose == "reset-password" {
+		return user.PasswordHash
+	}
+	return user.Email
+}
+
+func signEmailToken(payload string, state string) string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("COOKIE_SECRET")))
+	mac.Write([]byte("email-token\x00" + state + "\x00" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func newEmailToken(user *models.User, purpose string, lifetime time.Duration) (string, error) {
+	encoded, err := json.Marshal(emailTokenPayload{
+		UserID:    user.ID,
+		Purpose:   purpose,
+		ExpiresAt: time.Now().Add(lifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(encoded)
+	return payload + "." + signEmailToken(payload, emailTokenState(user, purpose)), nil
+}
+
+// The user a token was made for, if it's for purpose, hasn't expired and hasn't been used
+func checkEmailToken(h *Handler, token string, purpose string) (*models.User, error) {
+	invalid := errors.New("invalid or expired link")
+
+	payload, signature, found := strings.Cut(token, ".")
+	if !found {
+		return nil, invalid
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, invalid
+	}
+
+	var claims emailTokenPayload
+	err = json.Unmarshal(decoded, &claims)
+	if err != nil || claims.Purpose != purpose || time.Now().Unix() > claims.ExpiresAt {
+		return nil, invalid
+	}
+
+	var user models.User
+	result := h.DB.First(&user, claims.UserID)
+	if result.Error != nil {
+		return nil, invalid
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(signEmailToken(payload, emailTokenState(&user, purpose)))) {
+		return nil, invalid
+	}
+
+	return &user, nil
+}
+
+// The address the site is reached at, for links in emails
+func siteURL() string {
+	site := os.Getenv("SITE_URL")
+	if site == "" {
+		site = "http://localhost:" + os.Getenv("PORT")
+	}
+	return strings.TrimSuffix(site, "/")
+}
+
+type emailLinkData struct {
+	Username  string
+	Link      string
+	ExpiresIn string
+}
+
+// A lifetime in words, such as 24 hours
+func formatLifetime(lifetime time.Duration) string {
+	hours := int(lifetime.Hours())
+	if hours == 1 {
+		return "1 hour"
+	}
+	return fmt.Sprintf("%d hours", hours)
+}
+
+// Sends an email in the background, so a slow mail server doesn't hold up the request
+func sendEmail(h *Handler, to string, templateName string, data any) {
+	go func() {
+		err := h.Mailer.Send(to, templateName, data)
+		if err != nil {
+			log.Printf("Error sending %s email: %v", templateName, err)
+		}
+	}()
+}
+
+// Sends an email with a link carrying a token
+func sendTokenEmail(h *Handler, user *models.User, templateName string, page string, token string, lifetime time.Duration) {
+	sendEmail(h, user.Email, templateName, emailLinkData{
+		Username:  user.Username,
+		Link:      siteURL() + "/app/" + page + "?token=" + url.QueryEscape(token),
+		ExpiresIn: formatLifetime(lifetime),
+	})
+}
+
+// Emails the user a link to verify their address
+func sendVerificationEmail(h *Handler, user *models.User) error {
+	token, err := newEmailToken(user, "verify-email", verifyEmailTokenLifetime)
+	if err != nil {
+		return err
+	}
+
+	sendTokenEmail(h, user, "verify_email", "verify-email", token, verifyEmailTokenLifetime)
+	return nil
+}
+
+// Writes the error response when email isn't set up on the server
+func checkMailer(h *Handler, w http.ResponseWriter) bool {
+	if h.Mailer == nil {
+		http.Error(w, "Email isn't set up on this server", http.StatusNotImplemented)
+		return false
+	}
+	return true
+}
+
+// @Router /account/email/verify [post]
+// @Tags auth
+// @Summary Resend Verification Email
+// @Description Send another email with a link to verify the account's email
+// @Success 200
+func (h *Handler) SendVerificationEmailHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkMailer(h, w) {
+		return
+	}
+
+	user := accountUser(h, w, r)
+	if user == nil {
+		return
+	}
+
+	if user.IsEmailVerified {
+		http.Error(w, "Email already verified", http.StatusBadRequest)
+		return
+	}
+
+	if user.Email == "" {
+		http.Error(w, "No email on the account", http.StatusBadRequest)
+		return
+	}
+
+	err := sendVerificationEmail(h, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"` // From the link in the email
+}
+
+// @Router /verify-email [post]
+// @Tags auth
+// @Summary Verify Email
+// @Description Verify an account's email with the token from the link sent to it
+// @Accept json
+// @Param body body VerifyEmailRequest true "Body"
+// @Success 200
+func (h *Handler) VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var verifyEmailRequest VerifyEmailRequest
+	err := json.NewDecoder(r.Body).Decode(&verifyEmailRequest)
+	if err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	user, err := checkEmailToken(h, verifyEmailRequest.Token, "verify-email")
+	if err != nil || user.IsEmailVerified {
+		http.Error(w, "Invalid or expired link", http.StatusBadRequest)
+		return
+	}
+
+	result := h.DB.Model(user).Update("is_email_verified", true)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+type ForgotPasswordRequest struct {
+	Identifier string `json:"identifier"` // Username or email
+}
+
+// @Router /forgot-password [post]
+// @Tags auth
+// @Summary Forgot Password
+// @Description Email a link to reset the password, if the account exists and has an email.
+// @Description The response is the same either way so it can't be used to find accounts.
+// @Accept json
+// @Param body body ForgotPasswordRequest true "Body"
+// @Success 200
+func (h *Handler) ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkMailer(h, w) {
+		return
+	}
+
+	var forgotPasswordRequest ForgotPasswordRequest
+	err := json.NewDecoder(r.Body).Decode(&forgotPasswordRequest)
+	if err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	identifier := strings.TrimSpace(forgotPasswordRequest.Identifier)
+
+	var user models.User
+	result := h.DB.Where("username = ? OR original_username = ? OR email = ?", identifier, identifier, identifier).First(&user)
+	if identifier != "" && result.Error == nil && user.Email != "" {
+		token, err := newEmailToken(&user, "reset-password", resetPasswordTokenLifetime)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendTokenEmail(h, &user, "reset_password", "reset-password", token, resetPasswordTokenLifetime)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"` // From the link in the email
+	Password string `json:"password"`
+}
+
+// @Router /reset-password [post]
+// @Tags auth
+// @Summary Reset Password
+// @Description Set a new password with the token from the link sent by /forgot-password
+// @Accept json
+// @Param body body ResetPasswordRequest true "Body"
+// @Success 200
+func (h *Handler) ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var resetPasswordRequest ResetPasswordRequest
+	err := json.NewDecoder(r.Body).Decode(&resetPasswordRequest)
+	if err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	user, err := checkEmailToken(h, resetPasswordRequest.Token, "reset-password")
+	if err != nil {
+		http.Error(w, "Invalid or expired link", http.StatusBadRequest)
+		return
+	}
+
+	if !checkPassword(h, w, user, resetPasswordRequest.Password) {
+		return
+	}
+
+	salt, err := GenerateSalt()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	passwordHash, err := HashPassword(resetPasswordRequest.Password, salt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recordPasswordHistory(h, user)
+
+	// The link was sent to the account's email, so following it proves the address too
+	result := h.DB.Model(user).Updates(map[string]any{
+		"password_hash":     passwordHash,
+		"password_salt":     salt,
+		"is_email_verified": true,
+	})
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Whoever knew the old password is logged out
+	err = revokeUserSessions(h, user.ID, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
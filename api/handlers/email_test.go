@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+)
+
+func TestCheckEmailToken(t *testing.T) {
+	h := newTestHandler(t)
+	t.Setenv("COOKIE_SECRET", "test secret")
+
+	user := createTestUser(t, h, "alice", false)
+	other := createTestUser(t, h, "bob", false)
+
+	newToken := func(user *models.User, purpose string, lifetime time.Duration) string {
+		token, err := newEmailToken(user, purpose, lifetime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	// The same signature on a payload claiming to be for someone else
+	forged := func() string {
+		token := newToken(user, "verify-email", time.Hour)
+		_, signature, _ := strings.Cut(token, ".")
+		encoded, _ := json.Marshal(emailTokenPayload{UserID: other.ID, Purpose: "verify-email", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+		return base64.RawURLEncoding.EncodeToString(encoded) + "." + signature
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		purpose string
+		change  func()
+		wantOK  bool
+	}{
+		{"verify", newToken(user, "verify-email", time.Hour), "verify-email", nil, true},
+		{"reset", newToken(user, "reset-password", time.Hour), "reset-password", nil, true},
+		{"wrong purpose", newToken(user, "verify-email", time.Hour), "reset-password", nil, false},
+		{"expired", newToken(user, "verify-email", -time.Minute), "verify-email", nil, false},
+		{"forged user", forged(), "verify-email", nil, false},
+		{"bad signature", newToken(user, "verify-email", time.Hour) + "x", "verify-email", nil, false},
+		{"no signature", strings.Split(newToken(user, "verify-email", time.Hour), ".")[0], "verify-email", nil, false},
+		{"garbage", "not a token", "verify-email", nil, false},
+		{"empty", "", "verify-email", nil, false},
+
+		// Using a token changes what it's tied to, so it only works once
+		{"email changed", newToken(user, "verify-email", time.Hour), "verify-email", func() {
+			h.DB.Model(user).Update("email", "alice@example.org")
+		}, false},
+		{"password changed", newToken(user, "reset-password", time.Hour), "reset-password", func() {
+			h.DB.Model(user).Update("password_hash", "changed")
+		}, false},
+		{"different secret", newToken(other, "verify-email", time.Hour), "verify-email", func() {
+			t.Setenv("COOKIE_SECRET", "another secret")
+		}, false},
+	}
+
+	for _, test := range tests {
+		if test.change != nil {
+			test.change()
+		}
+
+		got, err := checkEmailToken(h, test.token, test.purpose)
+		if (err == nil) != test.wantOK {
+			t.Errorf("%s: got error %v, want ok %v", test.name, err, test.wantOK)
+			continue
+		}
+		if test.wantOK && got.ID != user.ID {
+			t.Errorf("%s: got user %d, want %d", test.name, got.ID, user.ID)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Thumbnail Path = {fileDir}/.thumbnails/{fileName}
+func thumbnailPath(filePath string) string {
+	return filepath.Dir(filePath) + PathDelimiter + ".thumbnails" + PathDelimiter + filepath.Base(filePath)
+}
+
+// Windows reports ERROR_NOT_SAME_DEVICE instead of EXDEV
+const errorNotSameDevice = 17
+
+// Reports whether a rename failed because source and destination are on different filesystems
+func isCrossDeviceError(err error) bool {
+	var linkErr *os.LinkError
+	if !errors.As(err, &linkErr) {
+		return false
+	}
+
+	if errors.Is(linkErr.Err, syscall.EXDEV) {
+		return true
+	}
+
+	errno, ok := linkErr.Err.(syscall.Errno)
+	return ok && IsWindows && errno == errorNotSameDevice
+}
+
+// Counts bytes as they're written so long copies can report progress
+type progressWriter struct {
+	writer   io.Writer
+	progress func(int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.writer.Write(b)
+	p.progress(int64(n))
+	return n, err
+}
+
+// Copies a single file, preserving its permissions and modification time.
+// progress, if not nil, is called with the number of bytes written as the copy goes.
+func copyFile(src string, dst string, progress func(int64)) (int64, error) {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer srcFile.Close()
+
+	info, err := srcFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	dstFile, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return 0, err
+	}
+
+	var writer io.Writer = dstFile
+	if progress != nil {
+		writer = &progressWriter{writer: dstFile, progress: progress}
+	}
+
+	written, err := io.Copy(writer, srcFile)
+	if err != nil {
+		dstFile.Close()
+		return written, err
+	}
+
+	err = dstFile.Close()
+	if err != nil {
+		return written, err
+	}
+
+	return written, os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// Copies a file or directory tree, including any .thumbnails directories inside it
+func copyTree(src string, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relativePath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, relativePath)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+
+		_, err = copyFile(path, target, nil)
+		return err
+	})
+}
+
+// Moves a file or directory tree, falling back to copy-then-delete across filesystems
+func moveItem(src string, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || !isCrossDeviceError(err) {
+		return err
+	}
+
+	err = copyTree(src, dst)
+	if err != nil {
+		// Don't leave a partial copy behind, the source is still intact
+		os.RemoveAll(dst)
+		return err
+	}
+
+	return os.RemoveAll(src)
+}
+
+// Moves the thumbnail of a file along with it, if there is one
+func moveThumbnail(src string, dst string) error {
+	srcThumbnail := thumbnailPath(src)
+	if _, err := os.Stat(srcThumbnail); err != nil {
+		return nil
+	}
+
+	dstThumbnail := thumbnailPath(dst)
+	err := os.MkdirAll(filepath.Dir(dstThumbnail), 0755)
+	if err != nil {
+		return err
+	}
+
+	return moveItem(srcThumbnail, dstThumbnail)
+}
+
+// Removes a file or directory, along with the thumbnail of a file
+func removeItem(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		thumbnail := thumbnailPath(path)
+		if _, err := os.Stat(thumbnail); err == nil {
+			err = os.Remove(thumbnail)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return os.RemoveAll(path)
+}
+
+// A hidden path next to dst to keep an item at until it can take the place of whatever is at dst
+func stagingPath(dst string) (string, error) {
+	token, err := GenerateToken(8)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(dst), ".staging-"+token), nil
+}
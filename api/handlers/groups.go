@@ -0,0 +1,331 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+	"github.com/gorilla/mux"
+)
+
+// The IDs of the groups a user is a member of
+func userGroupIDs(h *Handler, userID uint) (map[uint]bool, error) {
+	var ids []uint
+	result := h.DB.Table("group_members").Where("user_id = ?", userID).Pluck("group_id", &ids)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	groupIDs := map[uint]bool{}
+	for _, id := range ids {
+		groupIDs[id] = true
+	}
+
+	return groupIDs, nil
+}
+
+type GroupMember struct {
+	ID       uint   `json:"id"`
+	Username string `json:"username"`
+}
+
+type GroupResponse struct {
+	models.Group
+	Members []GroupMember `json:"members"`
+}
+
+func groupResponse(group models.Group) GroupResponse {
+	response := GroupResponse{
+		Group:   group,
+		Members: []GroupMember{},
+	}
+
+	for _, user := range group.Users {
+		response.Members = append(response.Members, GroupMember{
+			ID:       user.ID,
+			Username: user.Username,
+		})
+	}
+
+	return response
+}
+
+// Loads a group and its members, writing an error response if it can't
+func getGroup(h *Handler, w http.ResponseWriter, groupId string) *models.Group {
+	var group models.Group
+	result := h.DB.Preload("Users").First(&group, groupId)
+	if result.Error != nil {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return nil
+	}
+
+	return &group
+}
+
+type GetGroupsResponse struct {
+	Groups []GroupResponse `json:"groups"`
+}
+
+// @Router /admin/groups [get]
+// @Tags admin
+// @Summary Groups
+// @Description List groups and their members
+// @Produce json
+// @Success 200 {object} GetGroupsResponse "Groups"
+func (h *Handler) GetGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	isAdmin := CheckIsAdmin(h, r)
+	if !isAdmin {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var groups []models.Group
+	result := h.DB.Preload("Users").Order("name").Find(&groups)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := GetGroupsResponse{
+		Groups: []GroupResponse{},
+	}
+
+	for _, group := range groups {
+		response.Groups = append(response.Groups, groupResponse(group))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+type GroupRequest struct {
+	Name string `json:"name"`
+}
+
+// Decodes and validates a GroupRequest, writing an error response if it's invalid
+func decodeGroupRequest(h *Handler, w http.ResponseWriter, r *http.Request, groupID uint) (string, bool) {
+	var groupRequest GroupRequest
+	err := json.NewDecoder(r.Body).Decode(&groupRequest)
+	if err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return "", false
+	}
+
+	name := strings.TrimSpace(groupRequest.Name)
+	if name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return "", false
+	}
+
+	var count int64
+	h.DB.Model(&models.Group{}).Where("name = ? AND id <> ?", name, groupID).Count(&count)
+	if count > 0 {
+		http.Error(w, "Group name already in use", http.StatusConflict)
+		return "", false
+	}
+
+	return name, true
+}
+
+// @Router /admin/groups [post]
+// @Tags admin
+// @Summary Create Group
+// @Description Create an empty group
+// @Accept json
+// @Produce json
+// @Param body body GroupRequest true "Body"
+// @Success 201 {object} GroupResponse "Group"
+func (h *Handler) CreateGroupHandler(w http.ResponseWriter, r *http.Request) {
+	isAdmin := CheckIsAdmin(h, r)
+	if !isAdmin {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	name, ok := decodeGroupRequest(h, w, r, 0)
+	if !ok {
+		return
+	}
+
+	group := models.Group{
+		Name: name,
+	}
+
+	result := h.DB.Create(&group)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(groupResponse(group))
+}
+
+// @Router /admin/groups/{groupId} [post]
+// @Tags admin
+// @Summary Rename Group
+// @Description Rename a group
+// @Accept json
+// @Produce json
+// @Param groupId path int true "Group ID"
+// @Param body body GroupRequest true "Body"
+// @Success 200 {object} GroupResponse "Group"
+func (h *Handler) RenameGroupHandler(w http.ResponseWriter, r *http.Request) {
+	isAdmin := CheckIsAdmin(h, r)
+	if !isAdmin {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	group := getGroup(h, w, mux.Vars(r)["groupId"])
+	if group == nil {
+		return
+	}
+
+	name, ok := decodeGroupRequest(h, w, r, group.ID)
+	if !ok {
+		return
+	}
+
+	result := h.DB.Model(group).Update("name", name)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groupResponse(*group))
+}
+
+// @Router /admin/groups/{groupId} [delete]
+// @Tags admin
+// @Summary Delete Group
+// @Description Delete a group along with its memberships and the access rules granted to it
+// @Param groupId path int true "Group ID"
+// @Success 200
+func (h *Handler) DeleteGroupHandler(w http.ResponseWriter, r *http.Request) {
+	isAdmin := CheckIsAdmin(h, r)
+	if !isAdmin {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	group := getGroup(h, w, mux.Vars(r)["groupId"])
+	if group == nil {
+		return
+	}
+
+	err := h.DB.Model(group).Association("Users").Clear()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := h.DB.Unscoped().Where("group_id = ?", group.ID).Delete(&models.AccessRule{})
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Hard delete so the name can be reused
+	result = h.DB.Unscoped().Delete(group)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+type GroupMemberRequest struct {
+	UserID uint `json:"userId"`
+}
+
+// @Router /admin/groups/{groupId}/members [post]
+// @Tags admin
+// @Summary Add Group Member
+// @Description Add a user to a group
+// @Accept json
+// @Produce json
+// @Param groupId path int true "Group ID"
+// @Param body body GroupMemberRequest true "Body"
+// @Success 200 {object} GroupResponse "Group"
+func (h *Handler) AddGroupMemberHandler(w http.ResponseWriter, r *http.Request) {
+	isAdmin := CheckIsAdmin(h, r)
+	if !isAdmin {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	group := getGroup(h, w, mux.Vars(r)["groupId"])
+	if group == nil {
+		return
+	}
+
+	var memberRequest GroupMemberRequest
+	err := json.NewDecoder(r.Body).Decode(&memberRequest)
+	if err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	var user models.User
+	result := h.DB.First(&user, memberRequest.UserID)
+	if result.Error != nil {
+		http.Error(w, "User not found", http.StatusBadRequest)
+		return
+	}
+
+	for _, member := range group.Users {
+		if member.ID == user.ID {
+			http.Error(w, "User is already a member", http.StatusConflict)
+			return
+		}
+	}
+
+	err = h.DB.Model(group).Association("Users").Append(&user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groupResponse(*group))
+}
+
+// @Router /admin/groups/{groupId}/members/{userId} [delete]
+// @Tags admin
+// @Summary Remove Group Member
+// @Description Remove a user from a group
+// @Param groupId path int true "Group ID"
+// @Param userId path int true "User ID"
+// @Success 200
+func (h *Handler) RemoveGroupMemberHandler(w http.ResponseWriter, r *http.Request) {
+	isAdmin := CheckIsAdmin(h, r)
+	if !isAdmin {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	group := getGroup(h, w, vars["groupId"])
+	if group == nil {
+		return
+	}
+
+	result := h.DB.Exec("DELETE FROM group_members WHERE group_id = ? AND user_id = ?", group.ID, vars["userId"])
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if result.RowsAffected == 0 {
+		http.Error(w, "User is not a member", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
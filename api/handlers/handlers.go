@@ -1,11 +1,17 @@
 package handlers
 
 import (
+	"github.com/PoppedBit/HomeShareDrive/mail"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/gorilla/sessions"
 	"gorm.io/gorm"
 )
 
 type Handler struct {
-	DB    *gorm.DB
-	Store *sessions.CookieStore
+	DB       *gorm.DB
+	Store    sessions.Store
+	WebAuthn *webauthn.WebAuthn // nil when passkeys aren't set up
+	Mailer   *mail.Mailer       // nil when email isn't set up
+
+	BreachedPasswords *BreachedPasswords // nil when no list is loaded
 }
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// A handler backed by a fresh in-memory database, with the homeshare in a temporary directory
+func newTestHandler(t *testing.T) *Handler {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every connection to :memory: is a database of its own
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	models.Migrate(db)
+
+	t.Setenv("HOME_SHARE_ROOT", t.TempDir())
+
+	return &Handler{
+		DB:    db,
+		Store: NewDBSessionStore(db, []byte("0123456789abcdef0123456789abcdef")),
+	}
+}
+
+func createTestUser(t *testing.T, h *Handler, username string, isAdmin bool) *models.User {
+	t.Helper()
+
+	user := models.User{
+		Username:        username,
+		Email:           username + "@example.com",
+		IsEmailVerified: true,
+		IsAdmin:         isAdmin,
+		PasswordHash:    "-",
+		PasswordSalt:    "-",
+	}
+
+	result := h.DB.Create(&user)
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	return &user
+}
+
+// Makes a request as user, authenticated the way a bearer token is
+func asTestUser(r *http.Request, user *models.User, scope string) *http.Request {
+	token := &models.APIToken{UserID: user.ID, Scope: scope}
+	return r.WithContext(context.WithValue(r.Context(), apiTokenContextKey, token))
+}
+
+// Writes a file at a share relative path, making the directories above it, and returns its full path
+func writeTestFile(t *testing.T, path string, contents string) string {
+	t.Helper()
+
+	fullPath := processPath(homeShareRoot() + path)
+	err := os.MkdirAll(filepath.Dir(fullPath), 0755)
+	if err == nil {
+		err = os.WriteFile(fullPath, []byte(contents), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fullPath
+}
+
+func readTestFile(t *testing.T, fullPath string) string {
+	t.Helper()
+
+	contents, err := os.ReadFile(fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(contents)
+}
@@ -2,18 +2,20 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
 	"image/jpeg"
 	"image/png"
 	"io"
+	"log"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
 
-	"github.com/PoppedBit/HomeShareDrive/models"
 	"golang.org/x/image/draw"
 )
 
@@ -37,6 +39,13 @@ func checkPathInRoot(path string) bool {
 		return false
 	}
 
+	// The trash and version history are only reachable through their own endpoints
+	for _, segment := range strings.Split(path, PathDelimiter) {
+		if segment == trashDirName || segment == versionsDirName {
+			return false
+		}
+	}
+
 	return strings.HasPrefix(path, homeShareRoot())
 }
 
@@ -54,23 +63,7 @@ type FileInfo struct {
 
 // only verified users can homeshare
 func CheckCanHomeshare(h *Handler, r *http.Request) bool {
-	session, err := h.Store.Get(r, "session")
-	if err != nil {
-		return false
-	}
-
-	userID := session.Values["id"]
-	if userID == nil {
-		return false
-	}
-
-	var user models.User
-	result := h.DB.First(&user, userID)
-	if result.Error != nil {
-		return false
-	}
-
-	return user.IsEmailVerified || user.IsAdmin
+	return homeshareUser(h, r) != nil
 }
 
 type GetDirectoryContentsResponse struct {
@@ -85,6 +78,7 @@ type GetDirectoryContentsResponse struct {
 // @Accept json
 // @Produce json
 // @Param path query string true "Path"
+// @Param scope query string false "shared (default) or personal"
 // @Success 200 {object} GetDirectoryContentsResponse "Directory Contents"
 func (h *Handler) DirectoryContentsHandler(w http.ResponseWriter, r *http.Request) {
 	isAuthorized := CheckCanHomeshare(h, r)
@@ -95,25 +89,53 @@ func (h *Handler) DirectoryContentsHandler(w http.ResponseWriter, r *http.Reques
 
 	path := r.URL.Query().Get("path")
 
-	directory := processPath(homeShareRoot() + path)
+	root, ok := scopeRoot(h, w, r)
+	if !ok {
+		return
+	}
+
+	directory := processPath(root + path)
 
 	if !checkPathInRoot(directory) {
 		http.Error(w, "Invalid path", http.StatusBadRequest)
 		return
 	}
 
-	files, err := os.ReadDir(directory)
+	if !CheckPermission(h, r, directory, "read") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	fileInfos, err := listDirectory(root, path, readableFilter(h, r))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	response := GetDirectoryContentsResponse{
+		Path:  path,
+		Items: fileInfos,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Lists the visible contents of root + path, with paths relative to root.
+// canSee, if not nil, hides entries it returns false for.
+func listDirectory(root string, path string, canSee func(fullPath string) bool) ([]FileInfo, error) {
+	directory := processPath(root + path)
+
+	files, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+
 	fileInfos := []FileInfo{}
 	for _, file := range files {
 		info, err := file.Info()
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return nil, err
 		}
 
 		fileName := file.Name()
@@ -130,11 +152,15 @@ func (h *Handler) DirectoryContentsHandler(w http.ResponseWriter, r *http.Reques
 
 		filePath += fileName
 
+		if canSee != nil && !canSee(processPath(root+filePath)) {
+			continue
+		}
+
 		// Return thumbnail path if it exists
 		thumbnailPath := ""
 		if !info.IsDir() {
 			thumbnailPath = path + PathDelimiter + ".thumbnails" + PathDelimiter + fileName
-			thumbnailFullPath := homeShareRoot() + thumbnailPath
+			thumbnailFullPath := root + thumbnailPath
 			if _, err := os.Stat(thumbnailFullPath); os.IsNotExist(err) {
 				thumbnailPath = ""
 			}
@@ -163,13 +189,7 @@ func (h *Handler) DirectoryContentsHandler(w http.ResponseWriter, r *http.Reques
 		}
 	}
 
-	response := GetDirectoryContentsResponse{
-		Path:  path,
-		Items: fileInfos,
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	return fileInfos, nil
 }
 
 type CreateDirectoryRequest struct {
@@ -189,6 +209,7 @@ type CreateDirectoryResponse struct {
 // @Accept json
 // @Produce json
 // @Param body body CreateDirectoryRequest true "Body"
+// @Param scope query string false "shared (default) or personal"
 // @Success 200 {object} CreateDirectoryResponse "New Directory"
 func (h *Handler) CreateDirectoryHandler(w http.ResponseWriter, r *http.Request) {
 	isAuthorized := CheckCanHomeshare(h, r)
@@ -208,13 +229,23 @@ func (h *Handler) CreateDirectoryHandler(w http.ResponseWriter, r *http.Request)
 	path := createDirectoryRequest.Path
 	name := createDirectoryRequest.Name
 
-	directory := processPath(homeShareRoot() + path)
+	root, ok := scopeRoot(h, w, r)
+	if !ok {
+		return
+	}
+
+	directory := processPath(root + path)
 
 	if !checkPathInRoot(directory) {
 		http.Error(w, "Invalid path", http.StatusBadRequest)
 		return
 	}
 
+	if !CheckPermission(h, r, directory, "write") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
 	newDirectory := directory + PathDelimiter + name
 
 	err = os.Mkdir(newDirectory, 0755)
@@ -257,10 +288,11 @@ type DeleteItemResponse struct {
 // @Router /delete-item [delete]
 // @Tags homeshare
 // @Summary Delete Item
-// @Description Delete a directory or file
+// @Description Move a directory or file to the trash
 // @Accept json
 // @Produce json
 // @Param body body DeleteItemRequest true "Body"
+// @Param scope query string false "shared (default) or personal"
 // @Success 200 {object} DeleteItemResponse "Deleted Item"
 func (h *Handler) DeleteItemHandler(w http.ResponseWriter, r *http.Request) {
 	isAuthorized := CheckCanHomeshare(h, r)
@@ -278,35 +310,32 @@ func (h *Handler) DeleteItemHandler(w http.ResponseWriter, r *http.Request) {
 
 	path := deleteItemRequest.Path
 
-	itemPath := processPath(homeShareRoot() + path)
+	root, ok := scopeRoot(h, w, r)
+	if !ok {
+		return
+	}
+
+	itemPath := processPath(root + path)
 
 	if !checkPathInRoot(itemPath) {
 		http.Error(w, "Invalid path", http.StatusBadRequest)
 		return
 	}
 
-	info, err := os.Stat(itemPath)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if filepath.Clean(itemPath) == filepath.Clean(root) {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
 		return
 	}
 
-	// Delete thumbnail if it exists
-	if !info.IsDir() {
-		fileDir := filepath.Dir(itemPath)
-		fileName := filepath.Base(itemPath)
-		thumbnailPath := fileDir + PathDelimiter + ".thumbnails" + PathDelimiter + fileName
-
-		if _, err := os.Stat(thumbnailPath); err == nil {
-			err = os.Remove(thumbnailPath)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-		}
+	if !CheckPermission(h, r, itemPath, "delete") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
 	}
 
-	err = os.RemoveAll(itemPath)
+	userID := requestUserID(h, r)
+
+	// Deleted items go to the trash, they're only removed for good when purged
+	_, err = moveToTrash(h, userID, sharePath(filepath.Clean(itemPath)), itemPath)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -337,6 +366,7 @@ type RenameItemResponse struct {
 // @Accept json
 // @Produce json
 // @Param body body RenameItemRequest true "Body"
+// @Param scope query string false "shared (default) or personal"
 // @Success 200 {object} RenameItemResponse "Renamed Item"
 func (h *Handler) RenameItemHandler(w http.ResponseWriter, r *http.Request) {
 	isAuthorized := CheckCanHomeshare(h, r)
@@ -355,23 +385,72 @@ func (h *Handler) RenameItemHandler(w http.ResponseWriter, r *http.Request) {
 	path := renameItemRequest.Path
 	newName := renameItemRequest.Name
 
-	oldPath := processPath(homeShareRoot() + path)
+	root, ok := scopeRoot(h, w, r)
+	if !ok {
+		return
+	}
+
+	oldPath := processPath(root + path)
 
 	if !checkPathInRoot(oldPath) {
 		http.Error(w, "Invalid path", http.StatusBadRequest)
 		return
 	}
 
+	// The new name can only be of something in the same directory
+	if newName == "" || newName == "." || strings.Contains(newName, "/") || strings.Contains(newName, PathDelimiter) {
+		http.Error(w, "Invalid name", http.StatusBadRequest)
+		return
+	}
+
 	directory := oldPath[:len(oldPath)-len(oldPath[strings.LastIndex(oldPath, PathDelimiter):])]
 	newPath := directory + PathDelimiter + newName
 
+	if !checkPathInRoot(newPath) {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	if !CheckPermission(h, r, oldPath, "delete") || !CheckPermission(h, r, newPath, "write") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	info, err := os.Stat(oldPath)
+	if err != nil {
+		http.Error(w, "Item not found", http.StatusNotFound)
+		return
+	}
+
+	// Renaming never replaces anything, only a change of case on a filesystem that ignores it finds itself
+	if existing, err := os.Stat(newPath); err == nil && !os.SameFile(info, existing) {
+		http.Error(w, "An item named "+newName+" already exists", http.StatusConflict)
+		return
+	}
+
 	err = os.Rename(oldPath, newPath)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// TODO: Image thumbnails
+	err = moveRecordedFiles(h, oldPath, newPath)
+	if err == nil {
+		err = moveVersions(h, oldPath, newPath)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Directories carry their .thumbnails with them, files need theirs moved
+	if !info.IsDir() {
+		err = moveThumbnail(oldPath, newPath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 
 	response := RenameItemResponse{
 		Path: path,
@@ -382,6 +461,138 @@ func (h *Handler) RenameItemHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+type MoveItemRequest struct {
+	Path        string `json:"path"`
+	Destination string `json:"destination"`
+	Overwrite   bool   `json:"overwrite"`
+}
+
+type MoveItemResponse struct {
+	Path        string `json:"path"`
+	Destination string `json:"destination"`
+}
+
+// @Router /move-item [post]
+// @Tags homeshare
+// @Summary Move Item
+// @Description Move a directory or file to another path
+// @Accept json
+// @Produce json
+// @Param body body MoveItemRequest true "Body"
+// @Param scope query string false "shared (default) or personal"
+// @Success 200 {object} MoveItemResponse "Moved Item"
+func (h *Handler) MoveItemHandler(w http.ResponseWriter, r *http.Request) {
+	isAuthorized := CheckCanHomeshare(h, r)
+	if !isAuthorized {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var moveItemRequest MoveItemRequest
+	err := json.NewDecoder(r.Body).Decode(&moveItemRequest)
+	if err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	path := moveItemRequest.Path
+	destination := moveItemRequest.Destination
+
+	root, ok := scopeRoot(h, w, r)
+	if !ok {
+		return
+	}
+
+	srcPath := processPath(root + path)
+	dstPath := processPath(root + destination)
+
+	if !checkPathInRoot(srcPath) || !checkPathInRoot(dstPath) {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	srcPath = filepath.Clean(srcPath)
+	dstPath = filepath.Clean(dstPath)
+
+	if srcPath == filepath.Clean(root) || srcPath == dstPath {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	if !CheckPermission(h, r, srcPath, "delete") || !CheckPermission(h, r, dstPath, "write") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	// A directory can't be moved inside itself
+	if info.IsDir() && strings.HasPrefix(dstPath, srcPath+PathDelimiter) {
+		http.Error(w, "Cannot move a directory into itself", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := os.Stat(filepath.Dir(dstPath)); err != nil {
+		http.Error(w, "Destination directory does not exist", http.StatusBadRequest)
+		return
+	}
+
+	replacing := false
+	if _, err := os.Stat(dstPath); err == nil {
+		if !moveItemRequest.Overwrite {
+			http.Error(w, "Destination already exists", http.StatusConflict)
+			return
+		}
+
+		if !CheckPermission(h, r, dstPath, "delete") {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		replacing = true
+	}
+
+	if replacing {
+		err = moveOver(h, requestUserID(h, r), srcPath, dstPath)
+	} else {
+		err = moveItem(srcPath, dstPath)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = moveRecordedFiles(h, srcPath, dstPath)
+	if err == nil {
+		err = moveVersions(h, srcPath, dstPath)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Directories carry their .thumbnails with them, files need theirs moved
+	if !info.IsDir() {
+		err = moveThumbnail(srcPath, dstPath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	response := MoveItemResponse{
+		Path:        path,
+		Destination: destination,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
 // @Router /download-file [get]
 // @Tags homeshare
 // @Summary Download File
@@ -389,6 +600,7 @@ func (h *Handler) RenameItemHandler(w http.ResponseWriter, r *http.Request) {
 // @Accept json
 // @Produce json
 // @Param path query string true "Path"
+// @Param scope query string false "shared (default) or personal"
 func (h *Handler) DownloadFileHandler(w http.ResponseWriter, r *http.Request) {
 	isAuthorized := CheckCanHomeshare(h, r)
 	if !isAuthorized {
@@ -398,13 +610,23 @@ func (h *Handler) DownloadFileHandler(w http.ResponseWriter, r *http.Request) {
 
 	path := r.URL.Query().Get("path")
 
-	filePath := processPath(homeShareRoot() + path)
+	root, ok := scopeRoot(h, w, r)
+	if !ok {
+		return
+	}
+
+	filePath := processPath(root + path)
 
 	if !checkPathInRoot(filePath) {
 		http.Error(w, "Invalid path", http.StatusBadRequest)
 		return
 	}
 
+	if !CheckPermission(h, r, filePath, "read") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
 	_, err := os.Stat(filePath)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -420,6 +642,7 @@ func (h *Handler) DownloadFileHandler(w http.ResponseWriter, r *http.Request) {
 // @Description Upload a file
 // @Accept json
 // @Produce json
+// @Param scope query string false "shared (default) or personal"
 func (h *Handler) UploadFileHandler(w http.ResponseWriter, r *http.Request) {
 	isAuthorized := CheckCanHomeshare(h, r)
 	if !isAuthorized {
@@ -429,70 +652,122 @@ func (h *Handler) UploadFileHandler(w http.ResponseWriter, r *http.Request) {
 
 	path := r.URL.Query().Get("path")
 
-	// Request has formdata
-	err := r.ParseMultipartForm(10 << 20) // 10 MB
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	root, ok := scopeRoot(h, w, r)
+	if !ok {
 		return
 	}
 
-	file, handler, err := r.FormFile("file")
+	userID := requestUserID(h, r)
+
+	// Read part by part instead of ParseMultipartForm, so the quota limits the file itself as it's written
+	reader, err := r.MultipartReader()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
 
-	filePath := processPath(homeShareRoot() + path + PathDelimiter + handler.Filename)
+	var part *multipart.Part
+	for {
+		part, err = reader.NextPart()
+		if err == io.EOF {
+			http.Error(w, "No file uploaded", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if part.FormName() == "file" && part.FileName() != "" {
+			break
+		}
+	}
+
+	filePath := processPath(root + path + PathDelimiter + part.FileName())
 
 	if !checkPathInRoot(filePath) {
 		http.Error(w, "Invalid path", http.StatusBadRequest)
 		return
 	}
 
-	newFile, err := os.Create(filePath)
+	if !CheckPermission(h, r, filePath, "write") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// The body is at least as big as the file, so setting that much aside covers it
+	reserved, release, err := reserveQuota(h, userID, r.ContentLength)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer newFile.Close()
+	defer release()
 
-	_, err = io.Copy(newFile, file)
+	// Written under a hidden name next to it, so whatever it overwrites is only replaced once it's complete
+	tempFile, err := os.CreateTemp(filepath.Dir(filePath), ".upload-*")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	tempPath := tempFile.Name()
 
-	// Linux permissions
-	if runtime.GOOS != "windows" {
-		err := os.Chmod(filePath, 0o775)
-		if err != nil {
-			http.Error(w, "Error setting file permissions", http.StatusInternalServerError)
-			return
-		}
+	_, err = io.Copy(tempFile, limitToQuota(part, reserved))
+	tempFile.Close()
+	if errors.Is(err, errQuotaExceeded) {
+		os.Remove(tempPath)
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	// Thumbnails
+	// Keeps whatever this overwrites as a version
+	err = placeStagedFile(h, userID, tempPath, filePath)
+	if err != nil {
+		os.Remove(tempPath)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	setQuotaWarning(h, w, userID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func isImageFile(filePath string) bool {
 	extension := filepath.Ext(filePath)
 	extension = strings.ToLower(extension)
 
-	isImage := false
 	for _, imageExtension := range imageExtensions {
 		if extension == imageExtension {
-			isImage = true
-			break
+			return true
 		}
 	}
 
-	if isImage {
-		err = generateThumbnail(filePath)
+	return false
+}
+
+// Steps every file that lands in the homeshare goes through, however it was uploaded
+func finishUpload(filePath string) error {
+	// Linux permissions
+	if runtime.GOOS != "windows" {
+		err := os.Chmod(filePath, 0o775)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return fmt.Errorf("error setting file permissions: %w", err)
 		}
 	}
 
-	w.WriteHeader(http.StatusCreated)
+	// Thumbnails
+	if isImageFile(filePath) {
+		err := generateThumbnail(filePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func generateThumbnail(filePath string) error {
@@ -580,7 +855,7 @@ func (h *Handler) EnsureThumbnailsHandler(w http.ResponseWriter, r *http.Request
 
 	count := createDirectoryThumbnails(homeShareRoot())
 
-	fmt.Sprintf("Generated %d thumbnails", count)
+	log.Printf("Generated %d thumbnails", count)
 
 	w.WriteHeader(http.StatusOK)
 }
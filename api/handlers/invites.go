@@ -0,0 +1,335 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+var registrationModes = map[string]bool{
+	"open":        true,
+	"invite-only": true,
+	"closed":      true,
+}
+
+func hashInviteCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// Loads the invite a code is for, writing an error response if there isn't one or it can't be used anymore
+func findInvite(h *Handler, w http.ResponseWriter, code string) *models.Invite {
+	if strings.TrimSpace(code) == "" {
+		http.Error(w, "An invite code is needed to register", http.StatusForbidden)
+		return nil
+	}
+
+	var invite models.Invite
+	result := h.DB.Preload("Groups").Preload("Rules").Where("code_hash = ?", hashInviteCode(code)).First(&invite)
+	if result.Error != nil {
+		http.Error(w, "Invalid invite code", http.StatusBadRequest)
+		return nil
+	}
+
+	if invite.ExpiresAt != nil && invite.ExpiresAt.Before(time.Now()) {
+		http.Error(w, "Invite has expired", http.StatusBadRequest)
+		return nil
+	}
+
+	if invite.MaxUses > 0 && invite.Uses >= invite.MaxUses {
+		http.Error(w, "Invite has been used up", http.StatusBadRequest)
+		return nil
+	}
+
+	return &invite
+}
+
+// Counts a use of an invite, false if it was used up by someone else in the meantime
+func claimInvite(h *Handler, invite *models.Invite) (bool, error) {
+	result := h.DB.Model(&models.Invite{}).
+		Where("id = ? AND (max_uses = 0 OR uses < max_uses)", invite.ID).
+		Update("uses", gorm.Expr("uses + 1"))
+	return result.RowsAffected > 0, result.Error
+}
+
+// Gives a use back when registering fails after the invite was claimed
+func releaseInvite(h *Handler, invite *models.Invite) {
+	h.DB.Model(&models.Invite{}).Where("id = ? AND uses > 0", invite.ID).Update("uses", gorm.Expr("uses - 1"))
+}
+
+// Puts a newly registered user in the invite's groups and grants them its access rules
+func applyInvite(h *Handler, invite *models.Invite, user *models.User) error {
+	for _, group := range invite.Groups {
+		err := h.DB.Model(&group).Association("Users").Append(user)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, inviteRule := range invite.Rules {
+		// The rules restricting it may have been taken away since the invite was made
+		isRestricted, err := isRestrictedPath(h, inviteRule.Path)
+		if err != nil {
+			return err
+		}
+		if !isRestricted {
+			log.Printf("Skipping invite %d's rule on %s, nothing restricts it anymore", invite.ID, inviteRule.Path)
+			continue
+		}
+
+		rule := models.AccessRule{
+			Path:       inviteRule.Path,
+			UserID:     &user.ID,
+			Permission: inviteRule.Permission,
+		}
+
+		result := h.DB.Create(&rule)
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+
+	return nil
+}
+
+// The registration mode in effect, open while there are no accounts yet so the first admin can register
+func registrationMode(h *Handler) (string, error) {
+	var userCount int64
+	result := h.DB.Model(&models.User{}).Count(&userCount)
+	if result.Error != nil {
+		return "", result.Error
+	}
+
+	if userCount == 0 {
+		return "open", nil
+	}
+
+	settings, err := models.GetSettings(h.DB)
+	if err != nil {
+		return "", err
+	}
+
+	return settings.RegistrationMode, nil
+}
+
+type RegistrationResponse struct {
+	Mode string `json:"mode"` // open, invite-only or closed
+}
+
+// @Router /registration [get]
+// @Tags auth
+// @Summary Registration
+// @Description Whether new accounts can be made, and if they need an invite code
+// @Produce json
+// @Success 200 {object} RegistrationResponse
+func (h *Handler) RegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	mode, err := registrationMode(h)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RegistrationResponse{
+		Mode: mode,
+	})
+}
+
+type GetInvitesResponse struct {
+	Invites []models.Invite `json:"invites"`
+}
+
+// @Router /admin/invites [get]
+// @Tags admin
+// @Summary Invites
+// @Description List invite codes, newest first
+// @Produce json
+// @Success 200 {object} GetInvitesResponse "Invites"
+func (h *Handler) GetInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	isAdmin := CheckIsAdmin(h, r)
+	if !isAdmin {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	response := GetInvitesResponse{
+		Invites: []models.Invite{},
+	}
+
+	result := h.DB.Preload("Groups").Preload("Rules").Order("created_at DESC").Find(&response.Invites)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+type InviteRuleRequest struct {
+	Path       string `json:"path"`
+	Permission string `json:"permission"` // read, write, delete or manage
+}
+
+type CreateInviteRequest struct {
+	Name      string              `json:"name"`
+	MaxUses   *int                `json:"maxUses"` // 1 when left out, 0 means no limit
+	ExpiresAt *time.Time          `json:"expiresAt"`
+	GroupIDs  []uint              `json:"groupIds"` // Groups to put whoever registers with it in
+	Rules     []InviteRuleRequest `json:"rules"`    // Access rules to grant whoever registers with it
+}
+
+type CreateInviteResponse struct {
+	models.Invite
+	Code string `json:"code"` // Only ever shown here
+	Link string `json:"link"` // The register page with the code filled in
+}
+
+// @Router /admin/invites [post]
+// @Tags admin
+// @Summary Create Invite
+// @Description Create an invite code to register with, optionally putting whoever uses it in groups and granting them access rules
+// @Accept json
+// @Produce json
+// @Param body body CreateInviteRequest true "Body"
+// @Success 201 {object} CreateInviteResponse "Invite"
+func (h *Handler) CreateInviteHandler(w http.ResponseWriter, r *http.Request) {
+	isAdmin := CheckIsAdmin(h, r)
+	if !isAdmin {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var createInviteRequest CreateInviteRequest
+	err := json.NewDecoder(r.Body).Decode(&createInviteRequest)
+	if err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	maxUses := 1
+	if createInviteRequest.MaxUses != nil {
+		maxUses = *createInviteRequest.MaxUses
+	}
+	if maxUses < 0 {
+		http.Error(w, "Max uses can't be negative", http.StatusBadRequest)
+		return
+	}
+
+	if createInviteRequest.ExpiresAt != nil && createInviteRequest.ExpiresAt.Before(time.Now()) {
+		http.Error(w, "Expiry must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	groups := []models.Group{}
+	for _, groupID := range createInviteRequest.GroupIDs {
+		var group models.Group
+		result := h.DB.First(&group, groupID)
+		if result.Error != nil {
+			http.Error(w, "Group not found", http.StatusBadRequest)
+			return
+		}
+		groups = append(groups, group)
+	}
+
+	rules := []models.InviteRule{}
+	for _, ruleRequest := range createInviteRequest.Rules {
+		fullPath := processPath(homeShareRoot() + ruleRequest.Path)
+		if !checkPathInRoot(fullPath) {
+			http.Error(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+
+		if _, ok := permissionLevels[ruleRequest.Permission]; !ok {
+			http.Error(w, "Invalid permission", http.StatusBadRequest)
+			return
+		}
+
+		path := accessRulePath(fullPath)
+		isRestricted, err := isRestrictedPath(h, path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Everyone can already get to it, granting it to the new user would lock everyone else out
+		if !isRestricted {
+			http.Error(w, "No access rules restrict "+path+" yet, everyone can already get to it", http.StatusBadRequest)
+			return
+		}
+
+		rules = append(rules, models.InviteRule{
+			Path:       path,
+			Permission: ruleRequest.Permission,
+		})
+	}
+
+	code, err := GenerateToken(12)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	invite := models.Invite{
+		Name:        strings.TrimSpace(createInviteRequest.Name),
+		CodeHash:    hashInviteCode(code),
+		Prefix:      code[:6],
+		MaxUses:     maxUses,
+		ExpiresAt:   createInviteRequest.ExpiresAt,
+		CreatedByID: requestUserID(h, r),
+		Groups:      groups,
+		Rules:       rules,
+	}
+
+	result := h.DB.Create(&invite)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreateInviteResponse{
+		Invite: invite,
+		Code:   code,
+		Link:   siteURL() + "/app/register?invite=" + url.QueryEscape(code),
+	})
+}
+
+// @Router /admin/invites/{inviteId} [delete]
+// @Tags admin
+// @Summary Delete Invite
+// @Description Delete an invite so its code can't be used anymore, accounts already made with it are kept
+// @Param inviteId path int true "Invite ID"
+// @Success 200
+func (h *Handler) DeleteInviteHandler(w http.ResponseWriter, r *http.Request) {
+	isAdmin := CheckIsAdmin(h, r)
+	if !isAdmin {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var invite models.Invite
+	result := h.DB.First(&invite, mux.Vars(r)["inviteId"])
+	if result.Error != nil {
+		http.Error(w, "Invite not found", http.StatusNotFound)
+		return
+	}
+
+	result = h.DB.Select("Groups", "Rules").Unscoped().Delete(&invite)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
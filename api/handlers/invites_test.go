@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+)
+
+func TestIsRestrictedPath(t *testing.T) {
+	h := newTestHandler(t)
+	user := createTestUser(t, h, "alice", false)
+
+	h.DB.Create(&models.AccessRule{Path: "/private", UserID: &user.ID, Permission: "read"})
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/private", true},
+		{"/private/a/b.txt", true},
+		{"/private2", false},
+		{"/public", false},
+		{"/", false},
+	}
+
+	for _, test := range tests {
+		got, err := isRestrictedPath(h, test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("%s: got %v, want %v", test.path, got, test.want)
+		}
+	}
+}
+
+// A rule only for whoever registers would shut everyone else out of a path nothing restricts yet
+func TestCreateInviteRulesNeedRestrictedPaths(t *testing.T) {
+	h := newTestHandler(t)
+	admin := createTestUser(t, h, "admin", true)
+
+	h.DB.Create(&models.AccessRule{Path: "/private", UserID: &admin.ID, Permission: "manage"})
+
+	tests := []struct {
+		path       string
+		wantStatus int
+	}{
+		{"/private", http.StatusCreated},
+		{"/private/photos", http.StatusCreated},
+		{"/public", http.StatusBadRequest},
+		{"/", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		body := strings.NewReader(`{"rules":[{"path":"` + test.path + `","permission":"read"}]}`)
+		r := asTestUser(httptest.NewRequest(http.MethodPost, "/admin/invites", body), admin, "admin")
+
+		w := httptest.NewRecorder()
+		h.CreateInviteHandler(w, r)
+		if w.Code != test.wantStatus {
+			t.Errorf("%s: got %d, want %d: %s", test.path, w.Code, test.wantStatus, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+const (
+	// Failed logins let through before each one has to wait, twice as long every time
+	accountFreeFailures = 3
+	ipFreeFailures      = 10
+	maxLoginBackoff     = 15 * time.Minute
+
+	// How far back failed logins from an address count against it
+	ipFailureWindow = 15 * time.Minute
+
+	loginAttemptRetention = 30 * 24 * time.Hour
+)
+
+// How long a login is being held back without its password being checked
+type loginThrottle struct {
+	wait time.Duration
+}
+
+// The same whether the account is locked or doesn't exist, so it can't be used to find out which usernames are taken
+func (t *loginThrottle) write(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(t.wait.Seconds()))))
+	http.Error(w, "Too many failed logins, try again later", http.StatusTooManyRequests)
+}
+
+// How long to wait after the last of a run of failures
+func loginBackoff(failures int, free int) time.Duration {
+	if failures < free {
+		return 0
+	}
+
+	shift := failures - free
+	if shift >= 10 {
+		return maxLoginBackoff
+	}
+	return min(time.Second<<shift, maxLoginBackoff)
+}
+
+// How long logins as an identifier no account has wait, as if it had one. Its failures are replayed the way
+// recordLoginFailure counts an account's, so a username that doesn't exist is held back and locked the same as one
+// that does.
+func unknownAccountWait(h *Handler, identifier string, now time.Time) time.Duration {
+	var attempts []models.LoginAttempt
+	h.DB.Where("identifier = ? AND user_id IS NULL", identifier).Order("created_at").Find(&attempts)
+	if len(attempts) == 0 {
+		return 0
+	}
+
+	settings, err := models.GetSettings(h.DB)
+	if err != nil {
+		return 0
+	}
+
+	failures := 0
+	var lockedUntil time.Time
+	for _, attempt := range attempts {
+		failures++
+		if settings.LockoutThreshold > 0 && failures >= settings.LockoutThreshold {
+			failures = 0
+			lockedUntil = attempt.CreatedAt.Add(time.Duration(settings.LockoutMinutes) * time.Minute)
+		}
+	}
+
+	last := attempts[len(attempts)-1].CreatedAt
+	return max(lockedUntil.Sub(now), last.Add(loginBackoff(failures, accountFreeFailures)).Sub(now))
+}
+
+// Whether a login from ip as identifier, for user if the account exists, has to wait
+func checkLoginThrottle(h *Handler, identifier string, user *models.User, ip string) *loginThrottle {
+	now := time.Now()
+	var wait time.Duration
+
+	var ipFailures int64
+	h.DB.Model(&models.LoginAttempt{}).Where("ip = ? AND created_at > ?", ip, now.Add(-ipFailureWindow)).Count(&ipFailures)
+	if ipFailures >= ipFreeFailures {
+		var last models.LoginAttempt
+		result := h.DB.Where("ip = ?", ip).Order("created_at DESC").First(&last)
+		if result.Error == nil {
+			wait = last.CreatedAt.Add(loginBackoff(int(ipFailures), ipFreeFailures)).Sub(now)
+		}
+	}
+
+	if user != nil {
+		if user.LockedUntil != nil && user.LockedUntil.After(now) {
+			wait = max(wait, user.LockedUntil.Sub(now))
+		}
+
+		if user.LastFailedLoginAt != nil {
+			wait = max(wait, user.LastFailedLoginAt.Add(loginBackoff(user.FailedLoginCount, accountFreeFailures)).Sub(now))
+		}
+	} else if identifier != "" {
+		wait = max(wait, unknownAccountWait(h, identifier, now))
+	}
+
+	if wait <= 0 {
+		return nil
+	}
+	return &loginThrottle{wait: wait}
+}
+
+// Records a failed login, counting it against the account and locking it once there have been too many in a row
+func recordLoginFailure(h *Handler, identifier string, user *models.User, ip string, method string) {
+	attempt := models.LoginAttempt{
+		Identifier: identifier,
+		IP:         ip,
+		Method:     method,
+	}
+	if user != nil {
+		attempt.UserID = &user.ID
+	}
+
+	result := h.DB.Create(&attempt)
+	if result.Error != nil {
+		log.Printf("Error recording failed login: %v", result.Error)
+	}
+
+	if user == nil {
+		return
+	}
+
+	now := time.Now()
+	h.DB.Model(user).Updates(map[string]any{
+		"failed_login_count":   gorm.Expr("failed_login_count + 1"),
+		"last_failed_login_at": now,
+	})
+	h.DB.Select("failed_login_count").First(user, user.ID)
+
+	settings, err := models.GetSettings(h.DB)
+	if err != nil || settings.LockoutThreshold <= 0 || user.FailedLoginCount < settings.LockoutThreshold {
+		return
+	}
+
+	// The count starts over for when the lock runs out
+	lockedUntil := now.Add(time.Duration(settings.LockoutMinutes) * time.Minute)
+	h.DB.Model(user).Updates(map[string]any{
+		"failed_login_count": 0,
+		"locked_until":       lockedUntil,
+	})
+
+	notifyAdminsOfLockout(h, user, ip, lockedUntil)
+}
+
+// Starts the failure count over once the user has logged in
+func recordLoginSuccess(h *Handler, user *models.User) {
+	if user.FailedLoginCount == 0 && user.LastFailedLoginAt == nil {
+		return
+	}
+
+	h.DB.Model(user).Updates(map[string]any{
+		"failed_login_count":   0,
+		"last_failed_login_at": nil,
+	})
+}
+
+type lockoutEmailData struct {
+	Username    string
+	IP          string
+	LockedUntil string
+	Link        string
+}
+
+// Lets the admins know an account was locked, by email if it's set up
+func notifyAdminsOfLockout(h *Handler, user *models.User, ip string, lockedUntil time.Time) {
+	log.Printf("Locked %s until %s after too many failed logins, the last from %s", user.Username, lockedUntil.Format(time.RFC3339), ip)
+
+	if h.Mailer == nil {
+		return
+	}
+
+	var admins []models.User
+	h.DB.Where("is_admin = ? AND email <> ''", true).Find(&admins)
+
+	data := lockoutEmailData{
+		Username:    user.Username,
+		IP:          ip,
+		LockedUntil: lockedUntil.Format(time.RFC1123),
+		Link:        siteURL() + "/app/admin/users",
+	}
+	for _, admin := range admins {
+		sendEmail(h, admin.Email, "account_locked", data)
+	}
+}
+
+// Looks up the account and checks the password like checkCredentials, but turns the login away without checking it
+// while the address or account has been failing too often, and records failures
+func throttledCheckCredentials(h *Handler, identifier string, password string, ip string, method string) (*models.User, *loginThrottle) {
+	account := findLoginUser(h, identifier)
+
+	throttle := checkLoginThrottle(h, identifier, account, ip)
+	if throttle != nil {
+		return nil, throttle
+	}
+
+	user := checkCredentials(h, identifier, password)
+	if user == nil {
+		recordLoginFailure(h, identifier, account, ip, method)
+		return nil, nil
+	}
+
+	return user, nil
+}
+
+// Periodically deletes failed logins too old to matter
+func (h *Handler) PruneLoginAttempts(interval time.Duration) {
+	for {
+		result := h.DB.Where("created_at < ?", time.Now().Add(-loginAttemptRetention)).Delete(&models.LoginAttempt{})
+		if result.Error != nil {
+			log.Printf("Error pruning login attempts: %v", result.Error)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+type Lockout struct {
+	UserID            uint       `json:"userId"`
+	Username          string     `json:"username"`
+	FailedLoginCount  int        `json:"failedLoginCount"`
+	LastFailedLoginAt *time.Time `json:"lastFailedLoginAt"`
+	LockedUntil       *time.Time `json:"lockedUntil"` // nil or past when it's only failures so far
+}
+
+type GetLockoutsResponse struct {
+	Lockouts []Lockout `json:"lockouts"`
+}
+
+// @Router /admin/lockouts [get]
+// @Tags admin
+// @Summary Lockouts
+// @Description List accounts that are locked, or have failed logins since they last logged in
+// @Produce json
+// @Success 200 {object} GetLockoutsResponse "Lockouts"
+func (h *Handler) GetLockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	isAdmin := CheckIsAdmin(h, r)
+	if !isAdmin {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var users []models.User
+	result := h.DB.Where("locked_until > ? OR failed_login_count > 0", time.Now()).Order("last_failed_login_at DESC").Find(&users)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := GetLockoutsResponse{
+		Lockouts: []Lockout{},
+	}
+	for _, user := range users {
+		response.Lockouts = append(response.Lockouts, Lockout{
+			UserID:            user.ID,
+			Username:          user.Username,
+			FailedLoginCount:  user.FailedLoginCount,
+			LastFailedLoginAt: user.LastFailedLoginAt,
+			LockedUntil:       user.LockedUntil,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// @Router /admin/lockouts/{userId} [delete]
+// @Tags admin
+// @Summary Clear Lockout
+// @Description Unlock an account and start its failed login count over
+// @Param userId path int true "User ID"
+// @Success 200
+func (h *Handler) ClearLockoutHandler(w http.ResponseWriter, r *http.Request) {
+	isAdmin := CheckIsAdmin(h, r)
+	if !isAdmin {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var targetUser models.User
+	result := h.DB.First(&targetUser, mux.Vars(r)["userId"])
+	if result.Error != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	result = h.DB.Model(&targetUser).Updates(map[string]any{
+		"failed_login_count":   0,
+		"last_failed_login_at": nil,
+		"locked_until":         nil,
+	})
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+type GetLoginAttemptsResponse struct {
+	Attempts []models.LoginAttempt `json:"attempts"`
+}
+
+// @Router /admin/login-attempts [get]
+// @Tags admin
+// @Summary Failed Logins
+// @Description The most recent failed logins, newest first
+// @Produce json
+// @Param userId query int false "Only failures against this user"
+// @Param ip query string false "Only failures from this address"
+// @Success 200 {object} GetLoginAttemptsResponse "Failed Logins"
+func (h *Handler) GetLoginAttemptsHandler(w http.ResponseWriter, r *http.Request) {
+	isAdmin := CheckIsAdmin(h, r)
+	if !isAdmin {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query := h.DB.Order("created_at DESC").Limit(100)
+
+	userId := r.URL.Query().Get("userId")
+	if userId != "" {
+		query = query.Where("user_id = ?", userId)
+	}
+
+	ip := r.URL.Query().Get("ip")
+	if ip != "" {
+		query = query.Where("ip = ?", ip)
+	}
+
+	response := GetLoginAttemptsResponse{
+		Attempts: []models.LoginAttempt{},
+	}
+
+	result := query.Find(&response.Attempts)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
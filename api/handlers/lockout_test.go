@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+)
+
+func TestLoginBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{8, 32 * time.Second},
+		{20, maxLoginBackoff},
+		{1000, maxLoginBackoff},
+	}
+
+	for _, test := range tests {
+		got := loginBackoff(test.failures, accountFreeFailures)
+		if got != test.want {
+			t.Errorf("%d failures: got %s, want %s", test.failures, got, test.want)
+		}
+	}
+}
+
+// A username that doesn't exist is held back the same as one that does, so throttling doesn't give away which exist
+func TestUnknownUsernamesThrottledLikeAccounts(t *testing.T) {
+	for failures := 1; failures <= 7; failures++ {
+		t.Run(fmt.Sprint(failures), func(t *testing.T) {
+			h := newTestHandler(t)
+			user := createTestUser(t, h, "alice", false)
+
+			settings, _ := models.GetSettings(h.DB)
+			settings.LockoutThreshold = 5
+			settings.LockoutMinutes = 15
+			h.DB.Save(&settings)
+
+			// From a different address each time, so only the account's own failures count
+			for i := 0; i < failures; i++ {
+				ip := fmt.Sprintf("10.0.0.%d", i)
+				recordLoginFailure(h, "alice", user, ip, "password")
+				recordLoginFailure(h, "nobody", nil, ip, "password")
+			}
+
+			h.DB.First(user, user.ID)
+			known := checkLoginThrottle(h, "alice", user, "10.0.1.1")
+			unknown := checkLoginThrottle(h, "nobody", nil, "10.0.1.1")
+
+			if (known == nil) != (unknown == nil) {
+				t.Fatalf("throttled: account %v, unknown username %v", known != nil, unknown != nil)
+			}
+			if known != nil && (known.wait-unknown.wait > time.Second || unknown.wait-known.wait > time.Second) {
+				t.Errorf("waits: account %s, unknown username %s", known.wait, unknown.wait)
+			}
+		})
+	}
+}
@@ -0,0 +1,633 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+)
+
+// How long the browser has to finish a passkey ceremony once it's started
+const passkeyCeremonyLifetime = 5 * time.Minute
+
+// Sets up passkeys for the site at origin, the address it's reached at in the browser such as https://homeshare.lan:8080
+func NewWebAuthn(origin string) (*webauthn.WebAuthn, error) {
+	parsed, err := url.Parse(origin)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := webauthn.TimeoutConfig{
+		Enforce:    true,
+		Timeout:    passkeyCeremonyLifetime,
+		TimeoutUVD: passkeyCeremonyLifetime,
+	}
+
+	return webauthn.New(&webauthn.Config{
+		RPID:          parsed.Hostname(),
+		RPDisplayName: "Home Share Drive",
+		RPOrigins:     []string{strings.TrimSuffix(origin, "/")},
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        timeout,
+			Registration: timeout,
+		},
+	})
+}
+
+// A user along with their passkeys, in the shape the webauthn package wants
+type passkeyUser struct {
+	user     *models.User
+	passkeys []models.Passkey
+}
+
+func loadPasskeyUser(h *Handler, user *models.User) (*passkeyUser, error) {
+	keyUser := &passkeyUser{user: user}
+	result := h.DB.Where("user_id = ?", user.ID).Find(&keyUser.passkeys)
+	return keyUser, result.Error
+}
+
+// The user handle passkeys are saved under, just the user's id
+func passkeyUserHandle(userID uint) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(userID))
+}
+
+func (u *passkeyUser) WebAuthnID() []byte {
+	return passkeyUserHandle(u.user.ID)
+}
+
+func (u *passkeyUser) WebAuthnName() string {
+	return u.user.Username
+}
+
+func (u *passkeyUser) WebAuthnDisplayName() string {
+	return u.user.Username
+}
+
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := []webauthn.Credential{}
+	for _, passkey := range u.passkeys {
+		transports := []protocol.AuthenticatorTransport{}
+		for _, transport := range strings.Split(passkey.Transports, ",") {
+			if transport != "" {
+				transports = append(transports, protocol.AuthenticatorTransport(transport))
+			}
+		}
+
+		credentials = append(credentials, webauthn.Credential{
+			ID:              passkey.CredentialID,
+			PublicKey:       passkey.PublicKey,
+			AttestationType: passkey.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				BackupEligible: passkey.BackupEligible,
+				BackupState:    passkey.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    passkey.AAGUID,
+				SignCount: passkey.SignCount,
+			},
+		})
+	}
+	return credentials
+}
+
+func (u *passkeyUser) passkey(credentialID []byte) *models.Passkey {
+	for i := range u.passkeys {
+		if bytes.Equal(u.passkeys[i].CredentialID, credentialID) {
+			return &u.passkeys[i]
+		}
+	}
+	return nil
+}
+
+// Keeps a ceremony's challenge in the session until the browser answers it
+func savePasskeyCeremony(w http.ResponseWriter, r *http.Request, session *sessions.Session, key string, data *webauthn.SessionData) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	session.Values[key] = string(encoded)
+	return session.Save(r, w)
+}
+
+// Takes a ceremony's challenge back out of the session, it can only be answered once
+func takePasskeyCeremony(w http.ResponseWriter, r *http.Request, session *sessions.Session, key string) (*webauthn.SessionData, error) {
+	encoded, _ := session.Values[key].(string)
+	delete(session.Values, key)
+
+	err := session.Save(r, w)
+	if err != nil {
+		return nil, err
+	}
+
+	if encoded == "" {
+		return nil, errors.New("no passkey ceremony was started")
+	}
+
+	var data webauthn.SessionData
+	err = json.Unmarshal([]byte(encoded), &data)
+	if err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// Writes the error response when passkeys aren't set up on the server
+func checkWebAuthn(h *Handler, w http.ResponseWriter) bool {
+	if h.WebAuthn == nil {
+		http.Error(w, "Passkeys aren't set up on this server", http.StatusNotImplemented)
+		return false
+	}
+	return true
+}
+
+// @Router /account/passkeys/register [post]
+// @Tags auth
+// @Summary Begin Passkey Registration
+// @Description Start adding a passkey or hardware key, pass the options to navigator.credentials.create()
+// @Produce json
+// @Success 200 {object} protocol.CredentialCreation
+func (h *Handler) BeginPasskeyRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkWebAuthn(h, w) {
+		return
+	}
+
+	user := accountUser(h, w, r)
+	if user == nil {
+		return
+	}
+
+	keyUser, err := loadPasskeyUser(h, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	exclusions := []protocol.CredentialDescriptor{}
+	for _, credential := range keyUser.WebAuthnCredentials() {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+
+	// Discoverable so it can be used without typing a username, but hardware keys without room for one still work
+	creation, data, err := h.WebAuthn.BeginRegistration(
+		keyUser,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	session, err := h.Store.Get(r, "session")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = savePasskeyCeremony(w, r, session, "passkeyRegistration", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(creation)
+}
+
+type FinishPasskeyRegistrationRequest struct {
+	Name       string          `json:"name"`
+	Credential json.RawMessage `json:"credential"` // What navigator.credentials.create() returned
+}
+
+type FinishPasskeyRegistrationResponse struct {
+	models.Passkey
+	RecoveryCodes []string `json:"recoveryCodes,omitempty"` // Only when this is the account's first second factor
+}
+
+// @Router /account/passkeys/register/finish [post]
+// @Tags auth
+// @Summary Finish Passkey Registration
+// @Description Save the passkey the browser created
+// @Accept json
+// @Produce json
+// @Param body body FinishPasskeyRegistrationRequest true "Body"
+// @Success 201 {object} FinishPasskeyRegistrationResponse "Passkey"
+func (h *Handler) FinishPasskeyRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkWebAuthn(h, w) {
+		return
+	}
+
+	user := accountUser(h, w, r)
+	if user == nil {
+		return
+	}
+
+	var finishRequest FinishPasskeyRegistrationRequest
+	err := json.NewDecoder(r.Body).Decode(&finishRequest)
+	if err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(finishRequest.Name)
+	if name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	session, err := h.Store.Get(r, "session")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data, err := takePasskeyCeremony(w, r, session, "passkeyRegistration")
+	if err != nil {
+		http.Error(w, "Start adding a passkey first", http.StatusBadRequest)
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(finishRequest.Credential)
+	if err != nil {
+		http.Error(w, "Invalid passkey", http.StatusBadRequest)
+		return
+	}
+
+	keyUser, err := loadPasskeyUser(h, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	hadTwoFactor := hasTwoFactor(h, user)
+
+	credential, err := h.WebAuthn.CreateCredential(keyUser, *data, parsed)
+	if err != nil {
+		http.Error(w, "Invalid passkey", http.StatusBadRequest)
+		return
+	}
+
+	transports := []string{}
+	for _, transport := range credential.Transport {
+		transports = append(transports, string(transport))
+	}
+
+	passkey := models.Passkey{
+		UserID:          user.ID,
+		Name:            name,
+		CredentialID:    credential.ID,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transports:      strings.Join(transports, ","),
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+	}
+
+	result := h.DB.Create(&passkey)
+	if result.Error != nil {
+		http.Error(w, "Passkey already added", http.StatusConflict)
+		return
+	}
+
+	response := FinishPasskeyRegistrationResponse{
+		Passkey: passkey,
+	}
+
+	// Passkeys become a second factor after the password, so there needs to be a way back in without them
+	if !hadTwoFactor {
+		response.RecoveryCodes, err = generateRecoveryCodes(h, user.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+type GetPasskeysResponse struct {
+	Passkeys []models.Passkey `json:"passkeys"`
+}
+
+// @Router /account/passkeys [get]
+// @Tags auth
+// @Summary Passkeys
+// @Description List the passkeys and hardware keys the user can log in with
+// @Produce json
+// @Success 200 {object} GetPasskeysResponse "Passkeys"
+func (h *Handler) GetPasskeysHandler(w http.ResponseWriter, r *http.Request) {
+	user := accountUser(h, w, r)
+	if user == nil {
+		return
+	}
+
+	response := GetPasskeysResponse{
+		Passkeys: []models.Passkey{},
+	}
+
+	result := h.DB.Where("user_id = ?", user.ID).Order("created_at").Find(&response.Passkeys)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// The user's passkey with the id in the path, writing the error response if there isn't one
+func getPasskey(h *Handler, w http.ResponseWriter, r *http.Request, userID uint) *models.Passkey {
+	var passkey models.Passkey
+	result := h.DB.Where("user_id = ?", userID).First(&passkey, mux.Vars(r)["passkeyId"])
+	if result.Error != nil {
+		http.Error(w, "Passkey not found", http.StatusNotFound)
+		return nil
+	}
+	return &passkey
+}
+
+type RenamePasskeyRequest struct {
+	Name string `json:"name"`
+}
+
+// @Router /account/passkeys/{passkeyId} [post]
+// @Tags auth
+// @Summary Rename Passkey
+// @Description Rename a passkey
+// @Accept json
+// @Produce json
+// @Param passkeyId path int true "Passkey ID"
+// @Param body body RenamePasskeyRequest true "Body"
+// @Success 200 {object} models.Passkey "Passkey"
+func (h *Handler) RenamePasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	user := accountUser(h, w, r)
+	if user == nil {
+		return
+	}
+
+	passkey := getPasskey(h, w, r, user.ID)
+	if passkey == nil {
+		return
+	}
+
+	var renameRequest RenamePasskeyRequest
+	err := json.NewDecoder(r.Body).Decode(&renameRequest)
+	if err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(renameRequest.Name)
+	if name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	result := h.DB.Model(passkey).Update("name", name)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(passkey)
+}
+
+// @Router /account/passkeys/{passkeyId} [delete]
+// @Tags auth
+// @Summary Remove Passkey
+// @Description Stop a passkey from logging in as the user
+// @Param passkeyId path int true "Passkey ID"
+// @Success 200
+func (h *Handler) DeletePasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	user := accountUser(h, w, r)
+	if user == nil {
+		return
+	}
+
+	passkey := getPasskey(h, w, r, user.ID)
+	if passkey == nil {
+		return
+	}
+
+	result := h.DB.Unscoped().Delete(passkey)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err := dropUnusedRecoveryCodes(h, user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// @Router /login/passkey [post]
+// @Tags auth
+// @Summary Begin Passkey Login
+// @Description Start logging in with a passkey, pass the options to navigator.credentials.get().
+// @Description After the password was accepted at /login this finishes that login, otherwise the passkey logs in on its own.
+// @Produce json
+// @Success 200 {object} protocol.CredentialAssertion
+func (h *Handler) BeginPasskeyLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkWebAuthn(h, w) {
+		return
+	}
+
+	session, err := h.Store.Get(r, "session")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var assertion *protocol.CredentialAssertion
+	var data *webauthn.SessionData
+
+	user := pendingLoginUser(h, session)
+	if user != nil {
+		var keyUser *passkeyUser
+		keyUser, err = loadPasskeyUser(h, user)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if len(keyUser.passkeys) == 0 {
+			http.Error(w, "No passkeys have been added", http.StatusBadRequest)
+			return
+		}
+
+		assertion, data, err = h.WebAuthn.BeginLogin(keyUser)
+	} else {
+		// On its own the passkey is both factors, so it has to have checked it's the user with a PIN or biometrics
+		assertion, data, err = h.WebAuthn.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = savePasskeyCeremony(w, r, session, "passkeyLogin", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(assertion)
+}
+
+// @Router /login/passkey/finish [post]
+// @Tags auth
+// @Summary Finish Passkey Login
+// @Description Log in with what navigator.credentials.get() returned
+// @Accept json
+// @Produce json
+// @Success 200 {object} LoginResponse
+func (h *Handler) FinishPasskeyLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkWebAuthn(h, w) {
+		return
+	}
+
+	session, err := h.Store.Get(r, "session")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data, err := takePasskeyCeremony(w, r, session, "passkeyLogin")
+	if err != nil {
+		http.Error(w, "Start logging in with a passkey first", http.StatusBadRequest)
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Invalid passkey", http.StatusBadRequest)
+		return
+	}
+
+	// Who the login is for, as far as can be told before the passkey is checked
+	var claimedUser *models.User
+	if data.UserID != nil {
+		claimedUser = pendingLoginUser(h, session)
+		if claimedUser == nil || !bytes.Equal(data.UserID, passkeyUserHandle(claimedUser.ID)) {
+			http.Error(w, "Login again", http.StatusUnauthorized)
+			return
+		}
+	} else if len(parsed.Response.UserHandle) == 8 {
+		var user models.User
+		result := h.DB.First(&user, binary.BigEndian.Uint64(parsed.Response.UserHandle))
+		if result.Error == nil {
+			claimedUser = &user
+		}
+	}
+
+	// Held to the same backoff and lockout as passwords and codes
+	ip := clientIP(r)
+	throttle := checkLoginThrottle(h, "", claimedUser, ip)
+	if throttle != nil {
+		throttle.write(w)
+		return
+	}
+
+	identifier := ""
+	if claimedUser != nil {
+		identifier = claimedUser.Username
+	}
+
+	var keyUser *passkeyUser
+	var credential *webauthn.Credential
+
+	if data.UserID != nil {
+		// The second factor for the login waiting on it
+		user := claimedUser
+
+		keyUser, err = loadPasskeyUser(h, user)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		credential, err = h.WebAuthn.ValidateLogin(keyUser, *data, parsed)
+	} else {
+		// The passkey says whose it is
+		findUser := func(rawID, userHandle []byte) (webauthn.User, error) {
+			if len(userHandle) != 8 {
+				return nil, errors.New("unknown user handle")
+			}
+
+			var user models.User
+			result := h.DB.First(&user, binary.BigEndian.Uint64(userHandle))
+			if result.Error != nil {
+				return nil, result.Error
+			}
+
+			keyUser, err = loadPasskeyUser(h, &user)
+			return keyUser, err
+		}
+
+		_, credential, err = h.WebAuthn.ValidatePasskeyLogin(findUser, *data, parsed)
+	}
+	if err != nil || keyUser == nil {
+		recordLoginFailure(h, identifier, claimedUser, ip, "passkey")
+		http.Error(w, "Invalid passkey", http.StatusUnauthorized)
+		return
+	}
+
+	// A counter going backwards means the key has been copied
+	if credential.Authenticator.CloneWarning {
+		recordLoginFailure(h, identifier, claimedUser, ip, "passkey")
+		http.Error(w, "Invalid passkey", http.StatusUnauthorized)
+		return
+	}
+
+	passkey := keyUser.passkey(credential.ID)
+	if passkey != nil {
+		h.DB.Model(passkey).Updates(map[string]any{
+			"sign_count":   credential.Authenticator.SignCount,
+			"backup_state": credential.Flags.BackupState,
+			"last_used_at": time.Now(),
+		})
+	}
+
+	user := keyUser.user
+	if isBanned(user) {
+		writeBanned(w, user)
+		return
+	}
+
+	recordLoginSuccess(h, user)
+
+	err = finishLogin(w, r, session, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LoginResponse{
+		TwoFactorMethods:       []string{},
+		TwoFactorSetupRequired: adminNeedsTwoFactor(h, user),
+	})
+}
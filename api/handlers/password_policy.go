@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// bcrypt only looks at the first 72 bytes, and the salt takes up 24 of them
+	maxPasswordBytes = 48
+
+	// Old passwords kept per user, the most the history setting can be raised to
+	maxPasswordHistory = 24
+)
+
+type PasswordRuleFailure struct {
+	Rule    string `json:"rule"` // minLength, maxLength, uppercase, lowercase, digit, symbol, reused or breached
+	Message string `json:"message"`
+}
+
+type PasswordRejectedResponse struct {
+	Error    string                `json:"error"`
+	Failures []PasswordRuleFailure `json:"failures"`
+}
+
+// Whether a password matches one hashed with salt
+func passwordMatches(hash string, salt string, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(salt+password)) == nil
+}
+
+// Whether the password is the user's current one, or one of the ones before it the policy says can't be used again
+func isReusedPassword(h *Handler, user *models.User, password string, historyCount int) bool {
+	if passwordMatches(user.PasswordHash, user.PasswordSalt, password) {
+		return true
+	}
+
+	if historyCount <= 1 {
+		return false
+	}
+
+	var history []models.PasswordHistory
+	h.DB.Where("user_id = ?", user.ID).Order("created_at DESC").Limit(historyCount - 1).Find(&history)
+	for _, old := range history {
+		if passwordMatches(old.PasswordHash, old.PasswordSalt, password) {
+			return true
+		}
+	}
+	return false
+}
+
+// The rules a new password breaks, user is nil when the account doesn't exist yet
+func checkPasswordPolicy(h *Handler, user *models.User, password string) ([]PasswordRuleFailure, error) {
+	settings, err := models.GetSettings(h.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	failures := []PasswordRuleFailure{}
+	fail := func(rule string, message string) {
+		failures = append(failures, PasswordRuleFailure{Rule: rule, Message: message})
+	}
+
+	if utf8.RuneCountInString(password) < settings.PasswordMinLength {
+		fail("minLength", fmt.Sprintf("Password must be at least %d characters", settings.PasswordMinLength))
+	}
+
+	if len(password) > maxPasswordBytes {
+		fail("maxLength", fmt.Sprintf("Password can't be longer than %d bytes", maxPasswordBytes))
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsUpper(c):
+			hasUpper = true
+		case unicode.IsLower(c):
+			hasLower = true
+		case unicode.IsDigit(c):
+			hasDigit = true
+		case !unicode.IsLetter(c):
+			hasSymbol = true
+		}
+	}
+
+	if settings.PasswordRequireUppercase && !hasUpper {
+		fail("uppercase", "Password must contain an uppercase letter")
+	}
+
+	if settings.PasswordRequireLowercase && !hasLower {
+		fail("lowercase", "Password must contain a lowercase letter")
+	}
+
+	if settings.PasswordRequireDigit && !hasDigit {
+		fail("digit", "Password must contain a number")
+	}
+
+	if settings.PasswordRequireSymbol && !hasSymbol {
+		fail("symbol", "Password must contain a symbol")
+	}
+
+	if user != nil && settings.PasswordHistoryCount > 0 && isReusedPassword(h, user, password, settings.PasswordHistoryCount) {
+		fail("reused", fmt.Sprintf("Password can't be one of your last %d", settings.PasswordHistoryCount))
+	}
+
+	if settings.PasswordCheckBreached && h.BreachedPasswords != nil {
+		isBreached, err := h.BreachedPasswords.Contains(password)
+		if err != nil {
+			return nil, err
+		}
+
+		if isBreached {
+			fail("breached", "Password has appeared in a data breach, choose another")
+		}
+	}
+
+	return failures, nil
+}
+
+// Writes a 400 listing the rules a new password breaks, false if it breaks any
+func checkPassword(h *Handler, w http.ResponseWriter, user *models.User, password string) bool {
+	failures, err := checkPasswordPolicy(h, user, password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	if len(failures) == 0 {
+		return true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(PasswordRejectedResponse{
+		Error:    "Password doesn't meet the requirements",
+		Failures: failures,
+	})
+	return false
+}
+
+// Keeps the user's current password before it's changed, so it can be turned away if they try it again
+func recordPasswordHistory(h *Handler, user *models.User) {
+	result := h.DB.Create(&models.PasswordHistory{
+		UserID:       user.ID,
+		PasswordHash: user.PasswordHash,
+		PasswordSalt: user.PasswordSalt,
+	})
+	if result.Error != nil {
+		log.Printf("Error recording password history: %v", result.Error)
+		return
+	}
+
+	var stale []models.PasswordHistory
+	h.DB.Where("user_id = ?", user.ID).Order("created_at DESC").Offset(maxPasswordHistory).Find(&stale)
+	if len(stale) > 0 {
+		h.DB.Unscoped().Delete(&stale)
+	}
+}
+
+type PasswordPolicy struct {
+	MinLength        int  `json:"minLength"`
+	MaxLength        int  `json:"maxLength"` // In bytes
+	RequireUppercase bool `json:"requireUppercase"`
+	RequireLowercase bool `json:"requireLowercase"`
+	RequireDigit     bool `json:"requireDigit"`
+	RequireSymbol    bool `json:"requireSymbol"`
+	HistoryCount     int  `json:"historyCount"`  // How many of the last passwords can't be used again
+	CheckBreached    bool `json:"checkBreached"` // Whether passwords from data breaches are turned away
+}
+
+// @Router /password-policy [get]
+// @Tags auth
+// @Summary Password Policy
+// @Description What a new password has to be, to show before one is chosen
+// @Produce json
+// @Success 200 {object} PasswordPolicy
+func (h *Handler) PasswordPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	settings, err := models.GetSettings(h.DB)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PasswordPolicy{
+		MinLength:        settings.PasswordMinLength,
+		MaxLength:        maxPasswordBytes,
+		RequireUppercase: settings.PasswordRequireUppercase,
+		RequireLowercase: settings.PasswordRequireLowercase,
+		RequireDigit:     settings.PasswordRequireDigit,
+		RequireSymbol:    settings.PasswordRequireSymbol,
+		HistoryCount:     settings.PasswordHistoryCount,
+		CheckBreached:    settings.PasswordCheckBreached && h.BreachedPasswords != nil,
+	})
+}
@@ -0,0 +1,585 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+var errQuotaExceeded = errors.New("Storage quota exceeded")
+
+// The path a file is recorded under for storage usage
+func storedFilePath(fullPath string) string {
+	return filepath.ToSlash(sharePath(filepath.Clean(fullPath)))
+}
+
+// Matches a path and everything under it
+func storedFilesUnder(h *Handler, path string) *gorm.DB {
+	escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(path)
+	return h.DB.Unscoped().Model(&models.StoredFile{}).Where("path = ? OR path LIKE ?", path, escaped+"/%")
+}
+
+// Counts the file at fullPath towards userID's storage usage
+func recordFile(h *Handler, userID uint, fullPath string) error {
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return err
+	}
+
+	path := storedFilePath(fullPath)
+
+	result := h.DB.Unscoped().Where("path = ?", path).Delete(&models.StoredFile{})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	return h.DB.Create(&models.StoredFile{
+		Path:   path,
+		UserID: userID,
+		Size:   info.Size(),
+	}).Error
+}
+
+// Keeps usage pointing at files after they've been moved from src to dst
+func moveRecordedFiles(h *Handler, src string, dst string) error {
+	srcPath := storedFilePath(src)
+	dstPath := storedFilePath(dst)
+
+	// Whatever was at dst has been replaced
+	err := forgetFiles(h, dst)
+	if err != nil {
+		return err
+	}
+
+	var files []models.StoredFile
+	result := storedFilesUnder(h, srcPath).Find(&files)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	for _, file := range files {
+		file.Path = dstPath + strings.TrimPrefix(file.Path, srcPath)
+
+		result = h.DB.Save(&file)
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+
+	return nil
+}
+
+// Stops counting the files at or under fullPath once they're gone for good
+func forgetFiles(h *Handler, fullPath string) error {
+	return storedFilesUnder(h, storedFilePath(fullPath)).Delete(&models.StoredFile{}).Error
+}
+
+// Who files with no record of who wrote them are counted against: the owner of the personal folder they're in,
+// whoever deleted them for the trash, whoever made the version for old versions, or else fallbackUserID
+func backfillOwner(h *Handler, path string, fallbackUserID uint) uint {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(segments) < 2 {
+		return fallbackUserID
+	}
+
+	switch segments[0] {
+	case trashDirName:
+		var item models.TrashItem
+		result := h.DB.Where("token = ?", segments[1]).First(&item)
+		if result.Error == nil {
+			return item.DeletedByUserID
+		}
+	case versionsDirName:
+		var version models.FileVersion
+		result := h.DB.Where("token = ?", segments[1]).First(&version)
+		if result.Error == nil {
+			return version.CreatedUserID
+		}
+	default:
+		if ownerID, _, ok := personalFolderOwner(path); ok {
+			return ownerID
+		}
+	}
+
+	return fallbackUserID
+}
+
+// Counts the files that were in the homeshare before usage was, once. Anything without an owner of its own goes
+// against the first admin, so it waits until there is one.
+func (h *Handler) BackfillStoredFiles() {
+	settings, err := models.GetSettings(h.DB)
+	if err != nil {
+		log.Printf("Error loading settings: %v", err)
+		return
+	}
+
+	if settings.StoredFilesBackfilled {
+		return
+	}
+
+	var admin models.User
+	result := h.DB.Where("is_admin = ?", true).Order("id").First(&admin)
+	if result.Error != nil {
+		return
+	}
+
+	root := filepath.Clean(homeShareRoot())
+	count := 0
+
+	err = filepath.Walk(root, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		// Thumbnails and files still being written aren't counted, what's in the site's own directories is
+		name := info.Name()
+		isSiteDir := name == trashDirName || name == versionsDirName || name == personalDirName
+		if fullPath != root && strings.HasPrefix(name, ".") && !isSiteDir {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		path := storedFilePath(fullPath)
+
+		var recorded int64
+		result := h.DB.Unscoped().Model(&models.StoredFile{}).Where("path = ?", path).Count(&recorded)
+		if result.Error != nil {
+			return result.Error
+		}
+		if recorded > 0 {
+			return nil
+		}
+
+		result = h.DB.Create(&models.StoredFile{
+			Path:   path,
+			UserID: backfillOwner(h, path, admin.ID),
+			Size:   info.Size(),
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		count++
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error counting existing files: %v", err)
+		return
+	}
+
+	result = h.DB.Model(&settings).Update("stored_files_backfilled", true)
+	if result.Error != nil {
+		log.Printf("Error saving settings: %v", result.Error)
+		return
+	}
+
+	log.Printf("Counted %d existing files towards storage usage", count)
+}
+
+// The bytes written by a user that are still stored, trash and old versions included
+func storageUsed(h *Handler, userID uint) (int64, error) {
+	var used int64
+	result := h.DB.Model(&models.StoredFile{}).Where("user_id = ?", userID).Select("COALESCE(SUM(size), 0)").Scan(&used)
+	return used, result.Error
+}
+
+// Space set aside for writes still in progress, by user. It counts as used until the write is recorded or
+// given up, so two writes at once can't both fit into the same space.
+var quotaReservations = struct {
+	sync.Mutex
+	reserving sync.Mutex // Held while checking what's left and setting it aside
+	bytes     map[uint]int64
+}{bytes: map[uint]int64{}}
+
+func reservedBytes(userIDs ...uint) int64 {
+	quotaReservations.Lock()
+	defer quotaReservations.Unlock()
+
+	var reserved int64
+	for _, userID := range userIDs {
+		reserved += quotaReservations.bytes[userID]
+	}
+	return reserved
+}
+
+// Sets aside up to size bytes of a user's quota for a write, a size below 0 meaning as much as is left. Returns how
+// much was set aside, less than size if that's all there is, or -1 if the user has no hard limit. release gives it
+// back, call it once what was written has been recorded.
+func reserveQuota(h *Handler, userID uint, size int64) (int64, func(), error) {
+	quotaReservations.reserving.Lock()
+	defer quotaReservations.reserving.Unlock()
+
+	remaining, err := quotaRemaining(h, userID)
+	if err != nil {
+		return 0, func() {}, err
+	}
+
+	if remaining < 0 {
+		return -1, func() {}, nil
+	}
+
+	reserved := remaining
+	if size >= 0 && size < remaining {
+		reserved = size
+	}
+
+	quotaReservations.Lock()
+	quotaReservations.bytes[userID] += reserved
+	quotaReservations.Unlock()
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			quotaReservations.Lock()
+			defer quotaReservations.Unlock()
+
+			quotaReservations.bytes[userID] -= reserved
+			if quotaReservations.bytes[userID] <= 0 {
+				delete(quotaReservations.bytes, userID)
+			}
+		})
+	}
+
+	return reserved, release, nil
+}
+
+// The usage a quota is measured against, a group's is that of all its members together.
+// Space set aside for writes in progress counts too.
+func quotaUsed(h *Handler, quota *models.Quota) (int64, error) {
+	if quota.UserID != nil {
+		used, err := storageUsed(h, *quota.UserID)
+		return used + reservedBytes(*quota.UserID), err
+	}
+
+	var memberIDs []uint
+	result := h.DB.Table("group_members").Where("group_id = ?", quota.GroupID).Pluck("user_id", &memberIDs)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+
+	var used int64
+	result = h.DB.Model(&models.StoredFile{}).Where("user_id IN ?", memberIDs).Select("COALESCE(SUM(size), 0)").Scan(&used)
+	return used + reservedBytes(memberIDs...), result.Error
+}
+
+// The quotas that apply to a user, their own and those of their groups
+func userQuotas(h *Handler, userID uint) ([]models.Quota, error) {
+	groupIDs, err := userGroupIDs(h, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []uint{}
+	for id := range groupIDs {
+		ids = append(ids, id)
+	}
+
+	query := h.DB.Preload("Group").Where("user_id = ?", userID)
+	if len(ids) > 0 {
+		query = query.Or("group_id IN ?", ids)
+	}
+
+	var quotas []models.Quota
+	result := query.Find(&quotas)
+	return quotas, result.Error
+}
+
+// How many more bytes a user can write before reaching a hard limit, -1 if they have none
+func quotaRemaining(h *Handler, userID uint) (int64, error) {
+	quotas, err := userQuotas(h, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	remaining := int64(-1)
+	for _, quota := range quotas {
+		if quota.HardLimit == 0 {
+			continue
+		}
+
+		used, err := quotaUsed(h, &quota)
+		if err != nil {
+			return 0, err
+		}
+
+		left := max(quota.HardLimit-used, 0)
+		if remaining < 0 || left < remaining {
+			remaining = left
+		}
+	}
+
+	return remaining, nil
+}
+
+// Whether a user has gone over any of their soft limits
+func overSoftLimit(h *Handler, userID uint) bool {
+	quotas, err := userQuotas(h, userID)
+	if err != nil {
+		return false
+	}
+
+	for _, quota := range quotas {
+		if quota.SoftLimit == 0 {
+			continue
+		}
+
+		used, err := quotaUsed(h, &quota)
+		if err == nil && used > quota.SoftLimit {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Lets the client know an upload went through but a soft limit has been passed
+func setQuotaWarning(h *Handler, w http.ResponseWriter, userID uint) {
+	if overSoftLimit(h, userID) {
+		w.Header().Set("X-Quota-Warning", "Storage soft limit exceeded")
+	}
+}
+
+// Fails with errQuotaExceeded as soon as more than remaining bytes have been read
+type quotaReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (q *quotaReader) Read(b []byte) (int, error) {
+	n, err := q.reader.Read(b)
+	q.remaining -= int64(n)
+	if q.remaining < 0 {
+		return n, errQuotaExceeded
+	}
+	return n, err
+}
+
+// Wraps reader so it stops once remaining bytes are used up, a negative remaining means no limit
+func limitToQuota(reader io.Reader, remaining int64) io.Reader {
+	if remaining < 0 {
+		return reader
+	}
+	return &quotaReader{reader: reader, remaining: remaining}
+}
+
+type QuotaUsage struct {
+	models.Quota
+	Username      string `json:"username,omitempty"`
+	GroupName     string `json:"groupName,omitempty"`
+	UsedBytes     int64  `json:"usedBytes"`
+	OverSoftLimit bool   `json:"overSoftLimit"`
+}
+
+func quotaUsage(h *Handler, quota models.Quota) (QuotaUsage, error) {
+	used, err := quotaUsed(h, &quota)
+	if err != nil {
+		return QuotaUsage{}, err
+	}
+
+	return QuotaUsage{
+		Quota:         quota,
+		Username:      quota.User.Username,
+		GroupName:     quota.Group.Name,
+		UsedBytes:     used,
+		OverSoftLimit: quota.SoftLimit > 0 && used > quota.SoftLimit,
+	}, nil
+}
+
+type UserStorageUsage struct {
+	ID        uint   `json:"id"`
+	Username  string `json:"username"`
+	UsedBytes int64  `json:"usedBytes"`
+}
+
+type GetQuotasResponse struct {
+	Quotas []QuotaUsage       `json:"quotas"`
+	Users  []UserStorageUsage `json:"users"`
+}
+
+// @Router /admin/quotas [get]
+// @Tags admin
+// @Summary Quotas
+// @Description List quotas with their usage, and how much every user is storing
+// @Produce json
+// @Success 200 {object} GetQuotasResponse "Quotas"
+func (h *Handler) GetQuotasHandler(w http.ResponseWriter, r *http.Request) {
+	isAdmin := CheckIsAdmin(h, r)
+	if !isAdmin {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var quotas []models.Quota
+	result := h.DB.Preload("User").Preload("Group").Find(&quotas)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := GetQuotasResponse{
+		Quotas: []QuotaUsage{},
+		Users:  []UserStorageUsage{},
+	}
+
+	for _, quota := range quotas {
+		usage, err := quotaUsage(h, quota)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response.Quotas = append(response.Quotas, usage)
+	}
+
+	result = h.DB.Table("users").
+		Select("users.id, users.username, COALESCE(SUM(stored_files.size), 0) AS used_bytes").
+		Joins("LEFT JOIN stored_files ON stored_files.user_id = users.id").
+		Where("users.deleted_at IS NULL").
+		Group("users.id, users.username").
+		Scan(&response.Users)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sort.Slice(response.Users, func(i, j int) bool {
+		return response.Users[i].UsedBytes > response.Users[j].UsedBytes
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Exactly one of UserID and GroupID. A limit of 0 means no limit.
+type QuotaRequest struct {
+	UserID    *uint `json:"userId"`
+	GroupID   *uint `json:"groupId"`
+	SoftLimit int64 `json:"softLimit"`
+	HardLimit int64 `json:"hardLimit"`
+}
+
+// @Router /admin/quotas [post]
+// @Tags admin
+// @Summary Set Quota
+// @Description Set the storage limits of a user or group, replacing any they already have
+// @Accept json
+// @Produce json
+// @Param body body QuotaRequest true "Body"
+// @Success 200 {object} QuotaUsage "Quota"
+func (h *Handler) SetQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	isAdmin := CheckIsAdmin(h, r)
+	if !isAdmin {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var quotaRequest QuotaRequest
+	err := json.NewDecoder(r.Body).Decode(&quotaRequest)
+	if err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	if (quotaRequest.UserID == nil) == (quotaRequest.GroupID == nil) {
+		http.Error(w, "Either a user or a group is required", http.StatusBadRequest)
+		return
+	}
+
+	if quotaRequest.SoftLimit < 0 || quotaRequest.HardLimit < 0 {
+		http.Error(w, "Limits can't be negative", http.StatusBadRequest)
+		return
+	}
+
+	if quotaRequest.HardLimit > 0 && quotaRequest.SoftLimit > quotaRequest.HardLimit {
+		http.Error(w, "Soft limit can't be above the hard limit", http.StatusBadRequest)
+		return
+	}
+
+	var quota models.Quota
+
+	if quotaRequest.UserID != nil {
+		var user models.User
+		result := h.DB.First(&user, *quotaRequest.UserID)
+		if result.Error != nil {
+			http.Error(w, "User not found", http.StatusBadRequest)
+			return
+		}
+		h.DB.Where("user_id = ?", user.ID).First(&quota)
+		quota.UserID = &user.ID
+	} else {
+		var group models.Group
+		result := h.DB.First(&group, *quotaRequest.GroupID)
+		if result.Error != nil {
+			http.Error(w, "Group not found", http.StatusBadRequest)
+			return
+		}
+		h.DB.Where("group_id = ?", group.ID).First(&quota)
+		quota.GroupID = &group.ID
+	}
+
+	quota.SoftLimit = quotaRequest.SoftLimit
+	quota.HardLimit = quotaRequest.HardLimit
+
+	result := h.DB.Save(&quota)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.DB.Preload("User").Preload("Group").First(&quota, quota.ID)
+
+	usage, err := quotaUsage(h, quota)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
+// @Router /admin/quotas/{quotaId} [delete]
+// @Tags admin
+// @Summary Delete Quota
+// @Description Remove a quota, lifting its limits
+// @Param quotaId path int true "Quota ID"
+// @Success 200
+func (h *Handler) DeleteQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	isAdmin := CheckIsAdmin(h, r)
+	if !isAdmin {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	quotaId := vars["quotaId"]
+
+	result := h.DB.Unscoped().Delete(&models.Quota{}, quotaId)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if result.RowsAffected == 0 {
+		http.Error(w, "Quota not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
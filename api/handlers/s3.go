@@ -0,0 +1,989 @@
+package handlers
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+)
+
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// Timestamps in S3 XML bodies
+const s3XMLTimeFormat = "2006-01-02T15:04:05.000Z"
+
+const s3MaxKeys = 1000
+
+var errS3BadDigest = errors.New("The Content-MD5 you specified did not match what we received")
+
+type s3Error struct {
+	status  int
+	code    string
+	message string
+}
+
+type S3ErrorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource"`
+	RequestID string   `xml:"RequestId"`
+}
+
+// The S3 error a failed share operation comes down to, notFound being the code for a missing path
+func s3ErrorFor(err error, notFound string) *s3Error {
+	switch {
+	case os.IsNotExist(err):
+		return &s3Error{http.StatusNotFound, notFound, "The specified key does not exist"}
+	case os.IsPermission(err):
+		return &s3Error{http.StatusForbidden, "AccessDenied", "Access denied"}
+	case errors.Is(err, errQuotaExceeded):
+		// A 5xx would only have the client retry
+		return &s3Error{http.StatusForbidden, "QuotaExceeded", err.Error()}
+	case errors.Is(err, errS3ContentHash):
+		return &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", err.Error()}
+	case errors.Is(err, errS3ChunkSignature):
+		return &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", err.Error()}
+	case errors.Is(err, errS3ChunkFormat):
+		return &s3Error{http.StatusBadRequest, "IncompleteBody", err.Error()}
+	case errors.Is(err, errS3BadDigest):
+		return &s3Error{http.StatusBadRequest, "BadDigest", err.Error()}
+	}
+
+	log.Printf("S3 error: %v", err)
+	return &s3Error{http.StatusInternalServerError, "InternalError", "We encountered an internal error, please try again"}
+}
+
+func writeS3XML(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(body)
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, s3Err *s3Error) {
+	// HEAD responses can't carry a body, the status has to do
+	if r.Method == http.MethodHead {
+		w.WriteHeader(s3Err.status)
+		return
+	}
+
+	writeS3XML(w, s3Err.status, S3ErrorResponse{
+		Code:      s3Err.code,
+		Message:   s3Err.message,
+		Resource:  r.URL.Path,
+		RequestID: w.Header().Get("X-Amz-Request-Id"),
+	})
+}
+
+// Stands in for an MD5 on files that weren't just uploaded, hashing every file
+// for a listing would take far too long. The -1 suffix marks it as a multipart
+// ETag, which clients don't compare against their own MD5.
+func s3FileETag(info os.FileInfo) string {
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(info.Size()))
+	binary.BigEndian.PutUint64(buf[8:], uint64(info.ModTime().UnixNano()))
+	sum := sha256.Sum256(buf[:])
+	return `"` + hex.EncodeToString(sum[:16]) + `-1"`
+}
+
+func s3MD5ETag(sum []byte) string {
+	return `"` + hex.EncodeToString(sum) + `"`
+}
+
+// A staged S3 upload or part, kept out of the homeshare until it's complete
+func s3StagingPath(name string) string {
+	return filepath.Join(os.Getenv("UPLOAD_DIR"), "s3", name)
+}
+
+// An authenticated S3 request against a bucket and key, either of which may be empty
+type s3Request struct {
+	h      *Handler
+	user   *models.User
+	auth   *s3Auth
+	fs     *shareFS
+	bucket string
+	key    string
+}
+
+func (s *s3Request) bucketName() string {
+	return "/" + s.bucket
+}
+
+func (s *s3Request) objectName() string {
+	return "/" + s.bucket + "/" + s.key
+}
+
+// The bucket's folder, failing with NoSuchBucket if there isn't one
+func (s *s3Request) bucketPath() (string, *s3Error) {
+	bucketPath, err := s.fs.resolve(s.bucketName(), "read")
+	if err != nil {
+		return "", s3ErrorFor(err, "NoSuchBucket")
+	}
+
+	info, err := os.Stat(bucketPath)
+	if err != nil || !info.IsDir() || bucketPath == filepath.Clean(homeShareRoot()) {
+		return "", &s3Error{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist"}
+	}
+
+	return bucketPath, nil
+}
+
+// Listens for S3 requests on address until the process exits. Buckets are the
+// homeshare's top level folders and keys are paths within them, path style only.
+func (h *Handler) ServeS3(address string) {
+	err := http.ListenAndServe(address, http.HandlerFunc(h.S3Handler))
+	log.Printf("Error serving S3: %v", err)
+}
+
+func (h *Handler) S3Handler(w http.ResponseWriter, r *http.Request) {
+	requestID, _ := GenerateToken(8)
+	w.Header().Set("X-Amz-Request-Id", strings.ToUpper(requestID))
+	w.Header().Set("Server", "HomeShareDrive")
+
+	auth, s3Err := authenticateS3(h, r)
+	if s3Err != nil {
+		writeS3Error(w, r, s3Err)
+		return
+	}
+
+	rules, err := loadAccessRules(h, auth.user)
+	if err != nil {
+		writeS3Error(w, r, s3ErrorFor(err, "NoSuchKey"))
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	s := &s3Request{
+		h:      h,
+		user:   auth.user,
+		auth:   auth,
+		fs:     &shareFS{h: h, user: auth.user, rules: rules},
+		bucket: bucket,
+		key:    key,
+	}
+
+	query := r.URL.Query()
+
+	switch {
+	case bucket == "":
+		if r.Method != http.MethodGet {
+			s3Err = &s3Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource"}
+			break
+		}
+		s3Err = s.listBuckets(w)
+	case key == "":
+		s3Err = s.serveBucket(w, r, query)
+	default:
+		s3Err = s.serveObject(w, r, query)
+	}
+
+	if s3Err != nil {
+		writeS3Error(w, r, s3Err)
+	}
+}
+
+// Sub-resources of buckets and objects that aren't supported
+var s3UnsupportedSubresources = []string{
+	"acl", "analytics", "cors", "encryption", "inventory", "lifecycle", "logging", "metrics",
+	"notification", "object-lock", "ownershipControls", "policy", "replication", "requestPayment",
+	"restore", "retention", "legal-hold", "select", "tagging", "torrent", "versioning", "versions",
+	"website", "accelerate", "attributes", "intelligent-tiering", "policyStatus", "publicAccessBlock",
+}
+
+func (s *s3Request) serveBucket(w http.ResponseWriter, r *http.Request, query url.Values) *s3Error {
+	for _, subresource := range s3UnsupportedSubresources {
+		if query.Has(subresource) {
+			return &s3Error{http.StatusNotImplemented, "NotImplemented", "A header or query you provided implies functionality that is not implemented"}
+		}
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		_, s3Err := s.bucketPath()
+		return s3Err
+	case http.MethodGet:
+		if query.Has("location") {
+			_, s3Err := s.bucketPath()
+			if s3Err != nil {
+				return s3Err
+			}
+			writeS3XML(w, http.StatusOK, S3LocationConstraint{Xmlns: s3Namespace})
+			return nil
+		}
+		if query.Has("uploads") {
+			return s.listMultipartUploads(w, query)
+		}
+		return s.listObjects(w, query)
+	case http.MethodPut:
+		return s.createBucket(w)
+	case http.MethodDelete:
+		return s.deleteBucket(w)
+	case http.MethodPost:
+		if query.Has("delete") {
+			return s.deleteObjects(w, r)
+		}
+	}
+
+	return &s3Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource"}
+}
+
+func (s *s3Request) serveObject(w http.ResponseWriter, r *http.Request, query url.Values) *s3Error {
+	for _, subresource := range s3UnsupportedSubresources {
+		if query.Has(subresource) {
+			return &s3Error{http.StatusNotImplemented, "NotImplemented", "A header or query you provided implies functionality that is not implemented"}
+		}
+	}
+
+	_, s3Err := s.bucketPath()
+	if s3Err != nil {
+		return s3Err
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if query.Has("uploadId") {
+			return s.listParts(w, query)
+		}
+		return s.getObject(w, r)
+	case http.MethodPut:
+		if query.Has("uploadId") {
+			return s.uploadPart(w, r, query)
+		}
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			return s.copyObject(w, r)
+		}
+		return s.putObject(w, r)
+	case http.MethodPost:
+		if query.Has("uploads") {
+			return s.createMultipartUpload(w)
+		}
+		if query.Has("uploadId") {
+			return s.completeMultipartUpload(w, r, query)
+		}
+	case http.MethodDelete:
+		if query.Has("uploadId") {
+			return s.abortMultipartUpload(w, query)
+		}
+		return s.deleteObject(w)
+	}
+
+	return &s3Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource"}
+}
+
+type S3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type S3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type S3ListBucketsResponse struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   S3Owner    `xml:"Owner"`
+	Buckets []S3Bucket `xml:"Buckets>Bucket"`
+}
+
+type S3LocationConstraint struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+}
+
+func (s *s3Request) owner() S3Owner {
+	return S3Owner{ID: strconv.FormatUint(uint64(s.user.ID), 10), DisplayName: s.user.Username}
+}
+
+// Every top level folder the user can read is a bucket
+func (s *s3Request) listBuckets(w http.ResponseWriter) *s3Error {
+	entries, err := os.ReadDir(homeShareRoot())
+	if err != nil {
+		return s3ErrorFor(err, "NoSuchBucket")
+	}
+
+	response := S3ListBucketsResponse{
+		Xmlns:   s3Namespace,
+		Owner:   s.owner(),
+		Buckets: []S3Bucket{},
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || shareHiddenNames[entry.Name()] {
+			continue
+		}
+
+		fullPath, err := s.fs.resolve("/"+entry.Name(), "read")
+		if err != nil {
+			continue
+		}
+
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			continue
+		}
+
+		response.Buckets = append(response.Buckets, S3Bucket{
+			Name:         entry.Name(),
+			CreationDate: info.ModTime().UTC().Format(s3XMLTimeFormat),
+		})
+	}
+
+	writeS3XML(w, http.StatusOK, response)
+	return nil
+}
+
+func (s *s3Request) createBucket(w http.ResponseWriter) *s3Error {
+	err := s.fs.Mkdir(context.Background(), s.bucketName(), 0755)
+	if os.IsExist(err) {
+		return &s3Error{http.StatusConflict, "BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded and you already own it"}
+	}
+	if err != nil {
+		return s3ErrorFor(err, "NoSuchBucket")
+	}
+
+	w.Header().Set("Location", s.bucketName())
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (s *s3Request) deleteBucket(w http.ResponseWriter) *s3Error {
+	bucketPath, s3Err := s.bucketPath()
+	if s3Err != nil {
+		return s3Err
+	}
+
+	entries, err := os.ReadDir(bucketPath)
+	if err != nil {
+		return s3ErrorFor(err, "NoSuchBucket")
+	}
+	if len(entries) > 0 {
+		return &s3Error{http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty"}
+	}
+
+	err = s.fs.RemoveAll(context.Background(), s.bucketName())
+	if err != nil {
+		return s3ErrorFor(err, "NoSuchBucket")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// A key or common prefix found while listing a bucket
+type s3ListEntry struct {
+	key      string
+	info     os.FileInfo
+	isPrefix bool
+}
+
+// Everything in the bucket under prefix, sorted by key. Keys after the prefix that
+// contain the delimiter are rolled up into common prefixes.
+func (s *s3Request) listEntries(prefix string, delimiter string) ([]s3ListEntry, error) {
+	// Only the folder the prefix points into needs looking at
+	folder := prefix[:strings.LastIndex(prefix, "/")+1]
+
+	startPath, err := s.fs.resolve(s.objectName()+folder, "read")
+	if err != nil {
+		return nil, nil
+	}
+
+	info, err := os.Stat(startPath)
+	if err != nil || !info.IsDir() {
+		return nil, nil
+	}
+
+	entries := []s3ListEntry{}
+	prefixes := map[string]bool{}
+
+	add := func(key string, info os.FileInfo) {
+		if !strings.HasPrefix(key, prefix) {
+			return
+		}
+
+		if delimiter != "" {
+			i := strings.Index(key[len(prefix):], delimiter)
+			if i >= 0 {
+				commonPrefix := key[:len(prefix)+i+len(delimiter)]
+				if !prefixes[commonPrefix] {
+					prefixes[commonPrefix] = true
+					entries = append(entries, s3ListEntry{key: commonPrefix, isPrefix: true})
+				}
+				return
+			}
+		}
+
+		entries = append(entries, s3ListEntry{key: key, info: info})
+	}
+
+	// Folders only ever turn into common prefixes, so the usual "/" only needs one level read
+	if delimiter == "/" {
+		dirEntries, err := os.ReadDir(startPath)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range dirEntries {
+			fullPath := filepath.Join(startPath, entry.Name())
+			if shareHiddenNames[entry.Name()] || !s.fs.rules.allows(fullPath, "read") {
+				continue
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+
+			if entry.IsDir() {
+				add(folder+entry.Name()+"/", info)
+			} else {
+				add(folder+entry.Name(), info)
+			}
+		}
+	} else {
+		err = filepath.WalkDir(startPath, func(fullPath string, entry fs.DirEntry, err error) error {
+			if err != nil || fullPath == startPath {
+				return nil
+			}
+
+			if shareHiddenNames[entry.Name()] || !s.fs.rules.allows(fullPath, "read") {
+				if entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if entry.IsDir() {
+				return nil
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				return nil
+			}
+
+			relative, err := filepath.Rel(startPath, fullPath)
+			if err != nil {
+				return nil
+			}
+
+			add(folder+filepath.ToSlash(relative), info)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+
+	return entries, nil
+}
+
+type S3Object struct {
+	Key          string   `xml:"Key"`
+	LastModified string   `xml:"LastModified"`
+	ETag         string   `xml:"ETag"`
+	Size         int64    `xml:"Size"`
+	StorageClass string   `xml:"StorageClass"`
+	Owner        *S3Owner `xml:"Owner,omitempty"`
+}
+
+type S3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type S3ListObjectsResponse struct {
+	XMLName        xml.Name         `xml:"ListBucketResult"`
+	Xmlns          string           `xml:"xmlns,attr"`
+	Name           string           `xml:"Name"`
+	Prefix         string           `xml:"Prefix"`
+	Marker         string           `xml:"Marker"`
+	NextMarker     string           `xml:"NextMarker,omitempty"`
+	Delimiter      string           `xml:"Delimiter,omitempty"`
+	MaxKeys        int              `xml:"MaxKeys"`
+	EncodingType   string           `xml:"EncodingType,omitempty"`
+	IsTruncated    bool             `xml:"IsTruncated"`
+	Contents       []S3Object       `xml:"Contents"`
+	CommonPrefixes []S3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+type S3ListObjectsV2Response struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	KeyCount              int              `xml:"KeyCount"`
+	EncodingType          string           `xml:"EncodingType,omitempty"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	Contents              []S3Object       `xml:"Contents"`
+	CommonPrefixes        []S3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+// Handles both ListObjects and ListObjectsV2, told apart by list-type=2
+func (s *s3Request) listObjects(w http.ResponseWriter, query url.Values) *s3Error {
+	_, s3Err := s.bucketPath()
+	if s3Err != nil {
+		return s3Err
+	}
+
+	isV2 := query.Get("list-type") == "2"
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+
+	maxKeys := s3MaxKeys
+	if query.Has("max-keys") {
+		var err error
+		maxKeys, err = strconv.Atoi(query.Get("max-keys"))
+		if err != nil || maxKeys < 0 {
+			return &s3Error{http.StatusBadRequest, "InvalidArgument", "max-keys must be a non-negative integer"}
+		}
+		maxKeys = min(maxKeys, s3MaxKeys)
+	}
+
+	encodingType := query.Get("encoding-type")
+	if encodingType != "" && encodingType != "url" {
+		return &s3Error{http.StatusBadRequest, "InvalidArgument", "Invalid Encoding Method specified in Request"}
+	}
+	encode := func(s string) string {
+		if encodingType == "url" {
+			return s3Escape(s, false)
+		}
+		return s
+	}
+
+	// Listing resumes after this key
+	after := query.Get("marker")
+	if isV2 {
+		after = query.Get("start-after")
+		if query.Has("continuation-token") {
+			token, err := base64.RawURLEncoding.DecodeString(query.Get("continuation-token"))
+			if err != nil {
+				return &s3Error{http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect"}
+			}
+			after = string(token)
+		}
+	}
+
+	entries, err := s.listEntries(prefix, delimiter)
+	if err != nil {
+		return s3ErrorFor(err, "NoSuchBucket")
+	}
+
+	start := sort.Search(len(entries), func(i int) bool {
+		return entries[i].key > after
+	})
+	entries = entries[start:]
+
+	isTruncated := len(entries) > maxKeys
+	if isTruncated {
+		entries = entries[:maxKeys]
+	}
+
+	contents := []S3Object{}
+	commonPrefixes := []S3CommonPrefix{}
+	for _, entry := range entries {
+		if entry.isPrefix {
+			commonPrefixes = append(commonPrefixes, S3CommonPrefix{Prefix: encode(entry.key)})
+			continue
+		}
+
+		object := S3Object{
+			Key:          encode(entry.key),
+			LastModified: entry.info.ModTime().UTC().Format(s3XMLTimeFormat),
+			ETag:         s3FileETag(entry.info),
+			Size:         entry.info.Size(),
+			StorageClass: "STANDARD",
+		}
+		if !isV2 || query.Get("fetch-owner") == "true" {
+			owner := s.owner()
+			object.Owner = &owner
+		}
+		contents = append(contents, object)
+	}
+
+	lastKey := ""
+	if isTruncated {
+		lastKey = entries[len(entries)-1].key
+	}
+
+	if isV2 {
+		response := S3ListObjectsV2Response{
+			Xmlns:             s3Namespace,
+			Name:              s.bucket,
+			Prefix:            encode(prefix),
+			Delimiter:         encode(delimiter),
+			MaxKeys:           maxKeys,
+			KeyCount:          len(entries),
+			EncodingType:      encodingType,
+			IsTruncated:       isTruncated,
+			ContinuationToken: query.Get("continuation-token"),
+			StartAfter:        encode(query.Get("start-after")),
+			Contents:          contents,
+			CommonPrefixes:    commonPrefixes,
+		}
+		if isTruncated {
+			response.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(lastKey))
+		}
+		writeS3XML(w, http.StatusOK, response)
+		return nil
+	}
+
+	writeS3XML(w, http.StatusOK, S3ListObjectsResponse{
+		Xmlns:          s3Namespace,
+		Name:           s.bucket,
+		Prefix:         encode(prefix),
+		Marker:         encode(query.Get("marker")),
+		NextMarker:     encode(lastKey),
+		Delimiter:      encode(delimiter),
+		MaxKeys:        maxKeys,
+		EncodingType:   encodingType,
+		IsTruncated:    isTruncated,
+		Contents:       contents,
+		CommonPrefixes: commonPrefixes,
+	})
+	return nil
+}
+
+// Serves GetObject and HeadObject, ranges and conditional requests included
+func (s *s3Request) getObject(w http.ResponseWriter, r *http.Request) *s3Error {
+	file, err := s.fs.OpenFile(context.Background(), s.objectName(), os.O_RDONLY, 0)
+	if err != nil {
+		return s3ErrorFor(err, "NoSuchKey")
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return s3ErrorFor(err, "NoSuchKey")
+	}
+	if info.IsDir() {
+		return &s3Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist"}
+	}
+
+	w.Header().Set("ETag", s3FileETag(info))
+	w.Header().Set("Accept-Ranges", "bytes")
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+	return nil
+}
+
+// Writes body to a new staging file, returning the file's path and MD5. Nothing is
+// left behind if the body is cut short, goes over quota, or doesn't match its checksums.
+func (s *s3Request) stageBody(body io.Reader, remaining int64, contentMD5 string) (string, []byte, error) {
+	stagingName, err := GenerateToken(16)
+	if err != nil {
+		return "", nil, err
+	}
+	stagingPath := s3StagingPath(stagingName)
+
+	err = os.MkdirAll(filepath.Dir(stagingPath), os.ModePerm)
+	if err != nil {
+		return "", nil, err
+	}
+
+	stagingFile, err := os.Create(stagingPath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	hash := md5.New()
+	_, err = io.Copy(io.MultiWriter(stagingFile, hash), limitToQuota(body, remaining))
+	stagingFile.Close()
+
+	sum := hash.Sum(nil)
+	if err == nil && contentMD5 != "" && contentMD5 != base64.StdEncoding.EncodeToString(sum) {
+		err = errS3BadDigest
+	}
+
+	if err != nil {
+		os.Remove(stagingPath)
+		return "", nil, err
+	}
+
+	return stagingPath, sum, nil
+}
+
+// Resolves the key being written and makes the folders above it, as S3 keys imply them
+func (s *s3Request) prepareObjectPath() (string, error) {
+	fullPath, err := s.fs.resolve(s.objectName(), "write")
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(fullPath)
+	if err == nil && info.IsDir() {
+		return "", os.ErrExist
+	}
+
+	return fullPath, os.MkdirAll(filepath.Dir(fullPath), 0755)
+}
+
+func (s *s3Request) putObject(w http.ResponseWriter, r *http.Request) *s3Error {
+	body := s.auth.body(r)
+
+	// Keys ending in a slash are how S3 clients make empty folders
+	if strings.HasSuffix(s.key, "/") {
+		fullPath, err := s.fs.resolve(s.objectName(), "write")
+		if err != nil {
+			return s3ErrorFor(err, "NoSuchKey")
+		}
+
+		n, err := io.Copy(io.Discard, body)
+		if err != nil {
+			return s3ErrorFor(err, "NoSuchKey")
+		}
+		if n > 0 {
+			return &s3Error{http.StatusBadRequest, "InvalidArgument", "Folder keys can't have content"}
+		}
+
+		err = os.MkdirAll(fullPath, 0755)
+		if err != nil {
+			return s3ErrorFor(err, "NoSuchKey")
+		}
+
+		w.Header().Set("ETag", s3MD5ETag(md5.New().Sum(nil)))
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	fullPath, err := s.prepareObjectPath()
+	if os.IsExist(err) {
+		return &s3Error{http.StatusConflict, "InvalidArgument", "A folder already exists at this key"}
+	}
+	if err != nil {
+		return s3ErrorFor(err, "NoSuchKey")
+	}
+
+	remaining, err := quotaRemaining(s.h, s.user.ID)
+	if err != nil {
+		return s3ErrorFor(err, "NoSuchKey")
+	}
+	if remaining >= 0 && r.ContentLength > remaining {
+		return s3ErrorFor(errQuotaExceeded, "NoSuchKey")
+	}
+
+	stagingPath, sum, err := s.stageBody(body, remaining, r.Header.Get("Content-MD5"))
+	if err != nil {
+		return s3ErrorFor(err, "NoSuchKey")
+	}
+
+	err = placeStagedFile(s.h, s.user.ID, stagingPath, fullPath)
+	if err != nil {
+		os.Remove(stagingPath)
+		return s3ErrorFor(err, "NoSuchKey")
+	}
+
+	setQuotaWarning(s.h, w, s.user.ID)
+	w.Header().Set("ETag", s3MD5ETag(sum))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+type S3CopyObjectResponse struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	Xmlns        string   `xml:"xmlns,attr"`
+	LastModified string   `xml:"LastModified"`
+	ETag         string   `xml:"ETag"`
+}
+
+// The bucket/key a copy reads from, given as a url encoded path
+func s3CopySource(r *http.Request) (string, *s3Error) {
+	source, _, _ := strings.Cut(r.Header.Get("X-Amz-Copy-Source"), "?")
+	source, err := url.PathUnescape(source)
+	if err != nil {
+		return "", &s3Error{http.StatusBadRequest, "InvalidArgument", "Copy Source must mention the source bucket and key"}
+	}
+
+	source = "/" + strings.TrimPrefix(source, "/")
+	bucket, key, _ := strings.Cut(source[1:], "/")
+	if bucket == "" || key == "" {
+		return "", &s3Error{http.StatusBadRequest, "InvalidArgument", "Copy Source must mention the source bucket and key"}
+	}
+
+	return source, nil
+}
+
+func (s *s3Request) copyObject(w http.ResponseWriter, r *http.Request) *s3Error {
+	source, s3Err := s3CopySource(r)
+	if s3Err != nil {
+		return s3Err
+	}
+
+	srcPath, err := s.fs.resolve(source, "read")
+	if err != nil {
+		return s3ErrorFor(err, "NoSuchKey")
+	}
+
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return s3ErrorFor(err, "NoSuchKey")
+	}
+	if info.IsDir() {
+		return &s3Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist"}
+	}
+
+	dstPath, err := s.prepareObjectPath()
+	if os.IsExist(err) {
+		return &s3Error{http.StatusConflict, "InvalidArgument", "A folder already exists at this key"}
+	}
+	if err != nil {
+		return s3ErrorFor(err, "NoSuchKey")
+	}
+
+	remaining, err := quotaRemaining(s.h, s.user.ID)
+	if err != nil {
+		return s3ErrorFor(err, "NoSuchKey")
+	}
+	if remaining >= 0 && info.Size() > remaining {
+		return s3ErrorFor(errQuotaExceeded, "NoSuchKey")
+	}
+
+	srcFile, err := os.Open(srcPath)
+	if err != nil {
+		return s3ErrorFor(err, "NoSuchKey")
+	}
+	defer srcFile.Close()
+
+	// Staged first since the source and destination can be the same key
+	stagingPath, sum, err := s.stageBody(srcFile, remaining, "")
+	if err != nil {
+		return s3ErrorFor(err, "NoSuchKey")
+	}
+
+	err = placeStagedFile(s.h, s.user.ID, stagingPath, dstPath)
+	if err != nil {
+		os.Remove(stagingPath)
+		return s3ErrorFor(err, "NoSuchKey")
+	}
+
+	copied, err := os.Stat(dstPath)
+	if err != nil {
+		return s3ErrorFor(err, "NoSuchKey")
+	}
+
+	setQuotaWarning(s.h, w, s.user.ID)
+	writeS3XML(w, http.StatusOK, S3CopyObjectResponse{
+		Xmlns:        s3Namespace,
+		LastModified: copied.ModTime().UTC().Format(s3XMLTimeFormat),
+		ETag:         s3MD5ETag(sum),
+	})
+	return nil
+}
+
+// Moves the object to the trash. Deleting a key that isn't there still succeeds, as in S3.
+func (s *s3Request) removeObject(key string) error {
+	name := "/" + s.bucket + "/" + key
+
+	fullPath, err := s.fs.resolve(name, "delete")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	info, err := os.Stat(fullPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Folders are only objects when asked for with a trailing slash
+	if info.IsDir() != strings.HasSuffix(key, "/") {
+		return nil
+	}
+
+	return s.fs.RemoveAll(context.Background(), name)
+}
+
+func (s *s3Request) deleteObject(w http.ResponseWriter) *s3Error {
+	err := s.removeObject(s.key)
+	if err != nil {
+		return s3ErrorFor(err, "NoSuchKey")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+type S3DeleteObjectsRequest struct {
+	Quiet   bool `xml:"Quiet"`
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+type S3DeletedObject struct {
+	Key string `xml:"Key"`
+}
+
+type S3DeleteError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type S3DeleteObjectsResponse struct {
+	XMLName xml.Name          `xml:"DeleteResult"`
+	Xmlns   string            `xml:"xmlns,attr"`
+	Deleted []S3DeletedObject `xml:"Deleted"`
+	Errors  []S3DeleteError   `xml:"Error"`
+}
+
+func (s *s3Request) deleteObjects(w http.ResponseWriter, r *http.Request) *s3Error {
+	_, s3Err := s.bucketPath()
+	if s3Err != nil {
+		return s3Err
+	}
+
+	var deleteRequest S3DeleteObjectsRequest
+	err := xml.NewDecoder(io.LimitReader(s.auth.body(r), 1<<20)).Decode(&deleteRequest)
+	if err != nil || len(deleteRequest.Objects) > s3MaxKeys {
+		return &s3Error{http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema"}
+	}
+
+	response := S3DeleteObjectsResponse{Xmlns: s3Namespace}
+	for _, object := range deleteRequest.Objects {
+		err := s.removeObject(object.Key)
+		if err != nil {
+			s3Err := s3ErrorFor(err, "NoSuchKey")
+			response.Errors = append(response.Errors, S3DeleteError{Key: object.Key, Code: s3Err.code, Message: s3Err.message})
+			continue
+		}
+
+		if !deleteRequest.Quiet {
+			response.Deleted = append(response.Deleted, S3DeletedObject{Key: object.Key})
+		}
+	}
+
+	writeS3XML(w, http.StatusOK, response)
+	return nil
+}
@@ -0,0 +1,418 @@
+package handlers
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+)
+
+const (
+	s3Algorithm          = "AWS4-HMAC-SHA256"
+	s3TimeFormat         = "20060102T150405Z"
+	s3UnsignedPayload    = "UNSIGNED-PAYLOAD"
+	s3StreamingPayload   = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	s3StreamingTrailer   = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	s3UnsignedTrailer    = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	s3MaxClockSkew       = 15 * time.Minute
+	s3MaxPresignedExpiry = 7 * 24 * time.Hour
+)
+
+// sha256 of an empty string, what a chunk signature hashes in place of headers
+var s3EmptyHash = hex.EncodeToString(sha256.New().Sum(nil))
+
+// Who signed a request and what's needed to check the payload that follows it
+type s3Auth struct {
+	user        *models.User
+	signingKey  []byte
+	amzDate     string
+	scope       string // date/region/service/aws4_request
+	signature   string
+	payloadHash string
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// URI encodes s the way SigV4 expects, leaving only unreserved characters as they are
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		isUnreserved := (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~'
+		if isUnreserved || (c == '/' && !escapeSlash) {
+			b.WriteByte(c)
+		} else {
+			b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+	return b.String()
+}
+
+// The query string sorted and encoded, leaving out the signature of a presigned url
+func s3CanonicalQuery(query url.Values) string {
+	keys := []string{}
+	for key := range query {
+		if key != "X-Amz-Signature" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func s3CanonicalHeaders(r *http.Request, signedHeaders []string) string {
+	var b strings.Builder
+	for _, name := range signedHeaders {
+		value := strings.Join(r.Header.Values(name), ",")
+		if name == "host" {
+			value = r.Host
+		}
+		b.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+	return b.String()
+}
+
+// The request as SigV4 signs it, signedHeaders being the semicolon separated names from the signature
+func s3CanonicalRequest(r *http.Request, signedHeaders string, payloadHash string) string {
+	return strings.Join([]string{
+		r.Method,
+		s3Escape(r.URL.Path, false),
+		s3CanonicalQuery(r.URL.Query()),
+		s3CanonicalHeaders(r, strings.Split(signedHeaders, ";")),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+}
+
+// The key a secret signs with for a scope, its date, region, service and aws4_request
+func s3SigningKey(secret string, scope []string) []byte {
+	signingKey := []byte("AWS4" + secret)
+	for _, part := range scope {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	return signingKey
+}
+
+// Reads the Credential, SignedHeaders and Signature from an Authorization header or a presigned url
+func s3SignatureFields(r *http.Request) (map[string]string, bool, *s3Error) {
+	fields := map[string]string{}
+
+	authorization := r.Header.Get("Authorization")
+	if strings.HasPrefix(authorization, s3Algorithm+" ") {
+		for _, part := range strings.Split(strings.TrimPrefix(authorization, s3Algorithm+" "), ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+			if ok {
+				fields[name] = value
+			}
+		}
+		return fields, false, nil
+	}
+
+	query := r.URL.Query()
+	if query.Get("X-Amz-Algorithm") == s3Algorithm {
+		fields["Credential"] = query.Get("X-Amz-Credential")
+		fields["SignedHeaders"] = query.Get("X-Amz-SignedHeaders")
+		fields["Signature"] = query.Get("X-Amz-Signature")
+		return fields, true, nil
+	}
+
+	if authorization != "" || query.Get("X-Amz-Algorithm") != "" {
+		return nil, false, &s3Error{http.StatusBadRequest, "InvalidArgument", "Only AWS4-HMAC-SHA256 signatures are supported"}
+	}
+	return nil, false, &s3Error{http.StatusForbidden, "AccessDenied", "Anonymous access is not allowed"}
+}
+
+// Checks a request's SigV4 signature against the secret of the access key it names
+func authenticateS3(h *Handler, r *http.Request) (*s3Auth, *s3Error) {
+	fields, isPresigned, s3Err := s3SignatureFields(r)
+	if s3Err != nil {
+		return nil, s3Err
+	}
+
+	credential := strings.Split(fields["Credential"], "/")
+	if len(credential) != 5 || credential[4] != "aws4_request" || fields["SignedHeaders"] == "" || fields["Signature"] == "" {
+		return nil, &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed"}
+	}
+
+	var key models.S3AccessKey
+	result := h.DB.Preload("User").Where("access_key_id = ?", credential[0]).First(&key)
+	if result.Error != nil {
+		return nil, &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "The access key does not exist"}
+	}
+
+	if !key.User.IsEmailVerified && !key.User.IsAdmin {
+		return nil, &s3Error{http.StatusForbidden, "AccessDenied", "Access denied"}
+	}
+
+	query := r.URL.Query()
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	if isPresigned {
+		amzDate = query.Get("X-Amz-Date")
+	}
+	signedAt, err := time.Parse(s3TimeFormat, amzDate)
+	if err != nil || !strings.HasPrefix(amzDate, credential[1]) {
+		return nil, &s3Error{http.StatusForbidden, "AccessDenied", "X-Amz-Date is missing or doesn't match the credential"}
+	}
+
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if isPresigned {
+		expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || expires < 0 || time.Duration(expires)*time.Second > s3MaxPresignedExpiry {
+			return nil, &s3Error{http.StatusBadRequest, "AuthorizationQueryParametersError", "X-Amz-Expires is invalid"}
+		}
+		if time.Now().After(signedAt.Add(time.Duration(expires) * time.Second)) {
+			return nil, &s3Error{http.StatusForbidden, "AccessDenied", "Request has expired"}
+		}
+		if payloadHash == "" {
+			payloadHash = s3UnsignedPayload
+		}
+	} else {
+		skew := time.Since(signedAt)
+		if skew > s3MaxClockSkew || skew < -s3MaxClockSkew {
+			return nil, &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large"}
+		}
+		if payloadHash == "" {
+			return nil, &s3Error{http.StatusBadRequest, "InvalidRequest", "Missing required header for this request: x-amz-content-sha256"}
+		}
+	}
+
+	canonicalRequest := s3CanonicalRequest(r, fields["SignedHeaders"], payloadHash)
+
+	scope := strings.Join(credential[1:], "/")
+	stringToSign := s3Algorithm + "\n" + amzDate + "\n" + scope + "\n" + sha256Hex(canonicalRequest)
+
+	signingKey := s3SigningKey(key.SecretKey, credential[1:])
+
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	if !hmac.Equal([]byte(signature), []byte(strings.ToLower(fields["Signature"]))) {
+		return nil, &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided"}
+	}
+
+	if isBanned(&key.User) {
+		return nil, &s3Error{http.StatusForbidden, "AccessDenied", "The account is banned"}
+	}
+
+	return &s3Auth{
+		user:        &key.User,
+		signingKey:  signingKey,
+		amzDate:     amzDate,
+		scope:       scope,
+		signature:   signature,
+		payloadHash: payloadHash,
+	}, nil
+}
+
+var (
+	errS3ContentHash    = errors.New("The payload doesn't match x-amz-content-sha256")
+	errS3ChunkSignature = errors.New("A chunk signature doesn't match")
+	errS3ChunkFormat    = errors.New("The aws-chunked body is malformed")
+)
+
+// The request body with any aws-chunked framing taken off, failing if it doesn't match what was signed
+func (auth *s3Auth) body(r *http.Request) io.Reader {
+	switch auth.payloadHash {
+	case s3UnsignedPayload:
+		return r.Body
+	case s3StreamingPayload, s3StreamingTrailer, s3UnsignedTrailer:
+		return &s3ChunkedReader{
+			reader:            bufio.NewReader(r.Body),
+			auth:              auth,
+			isSigned:          auth.payloadHash != s3UnsignedTrailer,
+			hasTrailer:        auth.payloadHash != s3StreamingPayload,
+			previousSignature: auth.signature,
+		}
+	}
+	return &s3HashReader{reader: r.Body, hash: sha256.New(), expected: strings.ToLower(auth.payloadHash)}
+}
+
+// Checks the body against its sha256 once it's all been read
+type s3HashReader struct {
+	reader   io.Reader
+	hash     hash.Hash
+	expected string
+}
+
+func (s *s3HashReader) Read(b []byte) (int, error) {
+	n, err := s.reader.Read(b)
+	s.hash.Write(b[:n])
+	if err == io.EOF && hex.EncodeToString(s.hash.Sum(nil)) != s.expected {
+		return n, errS3ContentHash
+	}
+	return n, err
+}
+
+// Decodes an aws-chunked body, where each chunk is prefixed by its size and usually
+// signed with the signature of the chunk before it
+type s3ChunkedReader struct {
+	reader            *bufio.Reader
+	auth              *s3Auth
+	isSigned          bool
+	hasTrailer        bool
+	previousSignature string
+	chunkSignature    string
+	chunkHash         hash.Hash
+	remaining         int64
+	isDone            bool
+}
+
+func (s *s3ChunkedReader) checkChunk() error {
+	if !s.isSigned {
+		return nil
+	}
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256-PAYLOAD",
+		s.auth.amzDate,
+		s.auth.scope,
+		s.previousSignature,
+		s3EmptyHash,
+		hex.EncodeToString(s.chunkHash.Sum(nil)),
+	}, "\n")
+
+	signature := hex.EncodeToString(hmacSHA256(s.auth.signingKey, stringToSign))
+	if !hmac.Equal([]byte(signature), []byte(s.chunkSignature)) {
+		return errS3ChunkSignature
+	}
+
+	s.previousSignature = signature
+	return nil
+}
+
+func (s *s3ChunkedReader) readLine() (string, error) {
+	line, err := s.reader.ReadString('\n')
+	if err != nil {
+		if err == io.EOF {
+			return "", errS3ChunkFormat
+		}
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Reads the header of the next chunk, finishing the body if it's the last
+func (s *s3ChunkedReader) nextChunk() error {
+	header, err := s.readLine()
+	if err != nil {
+		return err
+	}
+
+	size, extensions, _ := strings.Cut(header, ";")
+	s.remaining, err = strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+	if err != nil || s.remaining < 0 {
+		return errS3ChunkFormat
+	}
+
+	s.chunkSignature = strings.TrimPrefix(extensions, "chunk-signature=")
+	s.chunkHash = sha256.New()
+
+	if s.remaining > 0 {
+		return nil
+	}
+
+	// The last chunk is empty but still signed
+	err = s.checkChunk()
+	if err != nil {
+		return err
+	}
+
+	// Trailing checksums aren't checked, only read past
+	if s.hasTrailer {
+		for {
+			line, err := s.readLine()
+			if err != nil {
+				return err
+			}
+			if line == "" {
+				break
+			}
+		}
+	}
+
+	s.isDone = true
+	return nil
+}
+
+func (s *s3ChunkedReader) Read(b []byte) (int, error) {
+	if s.isDone {
+		return 0, io.EOF
+	}
+
+	if s.chunkHash == nil {
+		err := s.nextChunk()
+		if err != nil {
+			return 0, err
+		}
+		if s.isDone {
+			return 0, io.EOF
+		}
+	}
+
+	if int64(len(b)) > s.remaining {
+		b = b[:s.remaining]
+	}
+
+	n, err := s.reader.Read(b)
+	s.chunkHash.Write(b[:n])
+	s.remaining -= int64(n)
+
+	if err == io.EOF && s.remaining > 0 {
+		return n, errS3ChunkFormat
+	}
+	if err != nil && err != io.EOF {
+		return n, err
+	}
+
+	if s.remaining == 0 {
+		err = s.checkChunk()
+		if err != nil {
+			return n, err
+		}
+
+		// Each chunk's data ends with a line break
+		line, err := s.readLine()
+		if err != nil {
+			return n, err
+		}
+		if line != "" {
+			return n, errS3ChunkFormat
+		}
+
+		err = s.nextChunk()
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+	"github.com/gorilla/mux"
+)
+
+type GetS3KeysResponse struct {
+	Keys []models.S3AccessKey `json:"keys"`
+}
+
+// @Router /account/s3-keys [get]
+// @Tags auth
+// @Summary S3 Keys
+// @Description List the access keys that can sign S3 requests as the user
+// @Produce json
+// @Success 200 {object} GetS3KeysResponse "S3 Keys"
+func (h *Handler) GetS3KeysHandler(w http.ResponseWriter, r *http.Request) {
+	user := homeshareUser(h, r)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	response := GetS3KeysResponse{
+		Keys: []models.S3AccessKey{},
+	}
+
+	result := h.DB.Where("user_id = ?", user.ID).Order("created_at").Find(&response.Keys)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+type CreateS3KeyRequest struct {
+	Name string `json:"name"`
+}
+
+type CreateS3KeyResponse struct {
+	models.S3AccessKey
+	SecretAccessKey string `json:"secretAccessKey"` // Only ever shown here
+}
+
+// @Router /account/s3-keys [post]
+// @Tags auth
+// @Summary Create S3 Key
+// @Description Create an access key and secret for signing S3 requests as the user
+// @Accept json
+// @Produce json
+// @Param body body CreateS3KeyRequest true "Body"
+// @Success 201 {object} CreateS3KeyResponse "S3 Key"
+func (h *Handler) CreateS3KeyHandler(w http.ResponseWriter, r *http.Request) {
+	user := homeshareUser(h, r)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var createS3KeyRequest CreateS3KeyRequest
+	err := json.NewDecoder(r.Body).Decode(&createS3KeyRequest)
+	if err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	accessKeyID, err := GenerateToken(10)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	secretKey, err := GenerateToken(20)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	key := models.S3AccessKey{
+		UserID:      user.ID,
+		Name:        strings.TrimSpace(createS3KeyRequest.Name),
+		AccessKeyID: strings.ToUpper(accessKeyID),
+		SecretKey:   secretKey,
+	}
+
+	result := h.DB.Create(&key)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreateS3KeyResponse{
+		S3AccessKey:     key,
+		SecretAccessKey: key.SecretKey,
+	})
+}
+
+// @Router /account/s3-keys/{keyId} [delete]
+// @Tags auth
+// @Summary Delete S3 Key
+// @Description Stop an access key from signing S3 requests
+// @Param keyId path int true "S3 Key ID"
+// @Success 200
+func (h *Handler) DeleteS3KeyHandler(w http.ResponseWriter, r *http.Request) {
+	user := homeshareUser(h, r)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	keyId := vars["keyId"]
+
+	result := h.DB.Unscoped().Where("user_id = ?", user.ID).Delete(&models.S3AccessKey{}, keyId)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if result.RowsAffected == 0 {
+		http.Error(w, "S3 key not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,435 @@
+package handlers
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+)
+
+const s3MaxPartNumber = 10000
+
+// Multipart uploads left unfinished this long are thrown away
+const s3MultipartLifetime = 7 * 24 * time.Hour
+
+// Where an upload's parts are staged, one file per part number
+func s3UploadPath(uploadID string) string {
+	return s3StagingPath(filepath.Join("multipart", uploadID))
+}
+
+func s3PartPath(uploadID string, partNumber int) string {
+	return filepath.Join(s3UploadPath(uploadID), strconv.Itoa(partNumber))
+}
+
+// Deletes an upload along with its staged parts
+func removeMultipartUpload(h *Handler, upload *models.S3MultipartUpload) error {
+	err := os.RemoveAll(s3UploadPath(upload.UploadID))
+	if err != nil {
+		return err
+	}
+
+	result := h.DB.Unscoped().Where("upload_id = ?", upload.UploadID).Delete(&models.S3MultipartPart{})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	return h.DB.Unscoped().Delete(upload).Error
+}
+
+// Loads the upload named in the query, making sure it's the caller's and for this key
+func (s *s3Request) getMultipartUpload(query url.Values) (*models.S3MultipartUpload, *s3Error) {
+	var upload models.S3MultipartUpload
+	result := s.h.DB.Where("upload_id = ? AND user_id = ?", query.Get("uploadId"), s.user.ID).First(&upload)
+	if result.Error != nil || upload.Bucket != s.bucket || upload.Key != s.key {
+		return nil, &s3Error{http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist"}
+	}
+
+	return &upload, nil
+}
+
+type S3InitiateMultipartUploadResponse struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+func (s *s3Request) createMultipartUpload(w http.ResponseWriter) *s3Error {
+	if strings.HasSuffix(s.key, "/") {
+		return &s3Error{http.StatusBadRequest, "InvalidArgument", "Folder keys can't have content"}
+	}
+
+	_, err := s.fs.resolve(s.objectName(), "write")
+	if err != nil {
+		return s3ErrorFor(err, "NoSuchKey")
+	}
+
+	uploadID, err := GenerateToken(16)
+	if err != nil {
+		return s3ErrorFor(err, "NoSuchUpload")
+	}
+
+	err = os.MkdirAll(s3UploadPath(uploadID), os.ModePerm)
+	if err != nil {
+		return s3ErrorFor(err, "NoSuchUpload")
+	}
+
+	upload := models.S3MultipartUpload{
+		UploadID: uploadID,
+		UserID:   s.user.ID,
+		Bucket:   s.bucket,
+		Key:      s.key,
+	}
+
+	result := s.h.DB.Create(&upload)
+	if result.Error != nil {
+		os.RemoveAll(s3UploadPath(uploadID))
+		return s3ErrorFor(result.Error, "NoSuchUpload")
+	}
+
+	writeS3XML(w, http.StatusOK, S3InitiateMultipartUploadResponse{
+		Xmlns:    s3Namespace,
+		Bucket:   s.bucket,
+		Key:      s.key,
+		UploadID: uploadID,
+	})
+	return nil
+}
+
+// The bytes an upload's parts take up, leaving out one that's about to be replaced
+func multipartUploadSize(h *Handler, uploadID string, exceptPart int) (int64, error) {
+	var size int64
+	result := h.DB.Model(&models.S3MultipartPart{}).
+		Where("upload_id = ? AND part_number <> ?", uploadID, exceptPart).
+		Select("COALESCE(SUM(size), 0)").
+		Scan(&size)
+	return size, result.Error
+}
+
+func (s *s3Request) uploadPart(w http.ResponseWriter, r *http.Request, query url.Values) *s3Error {
+	upload, s3Err := s.getMultipartUpload(query)
+	if s3Err != nil {
+		return s3Err
+	}
+
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		return &s3Error{http.StatusNotImplemented, "NotImplemented", "UploadPartCopy is not implemented"}
+	}
+
+	partNumber, err := strconv.Atoi(query.Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > s3MaxPartNumber {
+		return &s3Error{http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and 10000, inclusive"}
+	}
+
+	// Parts count against the quota as they come in, not only once they're put together
+	remaining, err := quotaRemaining(s.h, s.user.ID)
+	if err != nil {
+		return s3ErrorFor(err, "NoSuchUpload")
+	}
+	if remaining >= 0 {
+		staged, err := multipartUploadSize(s.h, upload.UploadID, partNumber)
+		if err != nil {
+			return s3ErrorFor(err, "NoSuchUpload")
+		}
+		remaining = max(remaining-staged, 0)
+		if r.ContentLength > remaining {
+			return s3ErrorFor(errQuotaExceeded, "NoSuchUpload")
+		}
+	}
+
+	stagingPath, sum, err := s.stageBody(s.auth.body(r), remaining, r.Header.Get("Content-MD5"))
+	if err != nil {
+		return s3ErrorFor(err, "NoSuchUpload")
+	}
+
+	info, err := os.Stat(stagingPath)
+	if err == nil {
+		err = os.Rename(stagingPath, s3PartPath(upload.UploadID, partNumber))
+	}
+	if err != nil {
+		os.Remove(stagingPath)
+		return s3ErrorFor(err, "NoSuchUpload")
+	}
+
+	// Uploading a part number again replaces it
+	s.h.DB.Unscoped().Where("upload_id = ? AND part_number = ?", upload.UploadID, partNumber).Delete(&models.S3MultipartPart{})
+
+	result := s.h.DB.Create(&models.S3MultipartPart{
+		UploadID:   upload.UploadID,
+		PartNumber: partNumber,
+		ETag:       hex.EncodeToString(sum),
+		Size:       info.Size(),
+	})
+	if result.Error != nil {
+		return s3ErrorFor(result.Error, "NoSuchUpload")
+	}
+
+	w.Header().Set("ETag", s3MD5ETag(sum))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+type S3CompleteMultipartUploadRequest struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type S3CompleteMultipartUploadResponse struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+// Joins the listed parts into the object, in order
+func (s *s3Request) completeMultipartUpload(w http.ResponseWriter, r *http.Request, query url.Values) *s3Error {
+	upload, s3Err := s.getMultipartUpload(query)
+	if s3Err != nil {
+		return s3Err
+	}
+
+	var completeRequest S3CompleteMultipartUploadRequest
+	err := xml.NewDecoder(io.LimitReader(s.auth.body(r), 1<<20)).Decode(&completeRequest)
+	if err != nil || len(completeRequest.Parts) == 0 {
+		return &s3Error{http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema"}
+	}
+
+	var parts []models.S3MultipartPart
+	result := s.h.DB.Where("upload_id = ?", upload.UploadID).Find(&parts)
+	if result.Error != nil {
+		return s3ErrorFor(result.Error, "NoSuchUpload")
+	}
+
+	uploaded := map[int]models.S3MultipartPart{}
+	for _, part := range parts {
+		uploaded[part.PartNumber] = part
+	}
+
+	partSums := []byte{}
+	for i, requested := range completeRequest.Parts {
+		if i > 0 && requested.PartNumber <= completeRequest.Parts[i-1].PartNumber {
+			return &s3Error{http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order"}
+		}
+
+		part, ok := uploaded[requested.PartNumber]
+		if !ok || strings.Trim(requested.ETag, `"`) != part.ETag {
+			return &s3Error{http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found"}
+		}
+
+		sum, _ := hex.DecodeString(part.ETag)
+		partSums = append(partSums, sum...)
+	}
+
+	fullPath, err := s.prepareObjectPath()
+	if os.IsExist(err) {
+		return &s3Error{http.StatusConflict, "InvalidArgument", "A folder already exists at this key"}
+	}
+	if err != nil {
+		return s3ErrorFor(err, "NoSuchKey")
+	}
+
+	stagingPath := filepath.Join(s3UploadPath(upload.UploadID), "object")
+	stagingFile, err := os.Create(stagingPath)
+	if err != nil {
+		return s3ErrorFor(err, "NoSuchUpload")
+	}
+
+	for _, requested := range completeRequest.Parts {
+		var partFile *os.File
+		partFile, err = os.Open(s3PartPath(upload.UploadID, requested.PartNumber))
+		if err != nil {
+			break
+		}
+		_, err = io.Copy(stagingFile, partFile)
+		partFile.Close()
+		if err != nil {
+			break
+		}
+	}
+	stagingFile.Close()
+
+	if err != nil {
+		os.Remove(stagingPath)
+		return s3ErrorFor(err, "NoSuchUpload")
+	}
+
+	err = placeStagedFile(s.h, s.user.ID, stagingPath, fullPath)
+	if err != nil {
+		os.Remove(stagingPath)
+		return s3ErrorFor(err, "NoSuchUpload")
+	}
+
+	err = removeMultipartUpload(s.h, upload)
+	if err != nil {
+		log.Printf("Error removing completed multipart upload %s: %v", upload.UploadID, err)
+	}
+
+	// As S3 does, the ETag is the MD5 of the parts' MD5s followed by how many parts there were
+	etag := md5.Sum(partSums)
+
+	setQuotaWarning(s.h, w, s.user.ID)
+	writeS3XML(w, http.StatusOK, S3CompleteMultipartUploadResponse{
+		Xmlns:    s3Namespace,
+		Location: s.objectName(),
+		Bucket:   s.bucket,
+		Key:      s.key,
+		ETag:     `"` + hex.EncodeToString(etag[:]) + "-" + strconv.Itoa(len(completeRequest.Parts)) + `"`,
+	})
+	return nil
+}
+
+func (s *s3Request) abortMultipartUpload(w http.ResponseWriter, query url.Values) *s3Error {
+	upload, s3Err := s.getMultipartUpload(query)
+	if s3Err != nil {
+		return s3Err
+	}
+
+	err := removeMultipartUpload(s.h, upload)
+	if err != nil {
+		return s3ErrorFor(err, "NoSuchUpload")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+type S3Part struct {
+	PartNumber   int    `xml:"PartNumber"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+}
+
+type S3ListPartsResponse struct {
+	XMLName     xml.Name `xml:"ListPartsResult"`
+	Xmlns       string   `xml:"xmlns,attr"`
+	Bucket      string   `xml:"Bucket"`
+	Key         string   `xml:"Key"`
+	UploadID    string   `xml:"UploadId"`
+	MaxParts    int      `xml:"MaxParts"`
+	IsTruncated bool     `xml:"IsTruncated"`
+	Parts       []S3Part `xml:"Part"`
+}
+
+func (s *s3Request) listParts(w http.ResponseWriter, query url.Values) *s3Error {
+	upload, s3Err := s.getMultipartUpload(query)
+	if s3Err != nil {
+		return s3Err
+	}
+
+	marker, _ := strconv.Atoi(query.Get("part-number-marker"))
+
+	var parts []models.S3MultipartPart
+	result := s.h.DB.Where("upload_id = ? AND part_number > ?", upload.UploadID, marker).
+		Order("part_number").
+		Find(&parts)
+	if result.Error != nil {
+		return s3ErrorFor(result.Error, "NoSuchUpload")
+	}
+
+	response := S3ListPartsResponse{
+		Xmlns:    s3Namespace,
+		Bucket:   s.bucket,
+		Key:      s.key,
+		UploadID: upload.UploadID,
+		MaxParts: s3MaxPartNumber,
+		Parts:    []S3Part{},
+	}
+
+	for _, part := range parts {
+		response.Parts = append(response.Parts, S3Part{
+			PartNumber:   part.PartNumber,
+			LastModified: part.UpdatedAt.UTC().Format(s3XMLTimeFormat),
+			ETag:         `"` + part.ETag + `"`,
+			Size:         part.Size,
+		})
+	}
+
+	writeS3XML(w, http.StatusOK, response)
+	return nil
+}
+
+type S3Upload struct {
+	Key       string `xml:"Key"`
+	UploadID  string `xml:"UploadId"`
+	Initiated string `xml:"Initiated"`
+}
+
+type S3ListMultipartUploadsResponse struct {
+	XMLName     xml.Name   `xml:"ListMultipartUploadsResult"`
+	Xmlns       string     `xml:"xmlns,attr"`
+	Bucket      string     `xml:"Bucket"`
+	Prefix      string     `xml:"Prefix"`
+	MaxUploads  int        `xml:"MaxUploads"`
+	IsTruncated bool       `xml:"IsTruncated"`
+	Uploads     []S3Upload `xml:"Upload"`
+}
+
+// The caller's unfinished uploads to the bucket
+func (s *s3Request) listMultipartUploads(w http.ResponseWriter, query url.Values) *s3Error {
+	_, s3Err := s.bucketPath()
+	if s3Err != nil {
+		return s3Err
+	}
+
+	var uploads []models.S3MultipartUpload
+	result := s.h.DB.Where("user_id = ? AND bucket = ?", s.user.ID, s.bucket).Order("created_at").Find(&uploads)
+	if result.Error != nil {
+		return s3ErrorFor(result.Error, "NoSuchUpload")
+	}
+
+	prefix := query.Get("prefix")
+	response := S3ListMultipartUploadsResponse{
+		Xmlns:      s3Namespace,
+		Bucket:     s.bucket,
+		Prefix:     prefix,
+		MaxUploads: s3MaxKeys,
+		Uploads:    []S3Upload{},
+	}
+
+	for _, upload := range uploads {
+		if !strings.HasPrefix(upload.Key, prefix) {
+			continue
+		}
+		response.Uploads = append(response.Uploads, S3Upload{
+			Key:       upload.Key,
+			UploadID:  upload.UploadID,
+			Initiated: upload.CreatedAt.UTC().Format(s3XMLTimeFormat),
+		})
+	}
+
+	writeS3XML(w, http.StatusOK, response)
+	return nil
+}
+
+// Throws away multipart uploads that were started but never completed or aborted
+func (h *Handler) ExpireMultipartUploads(interval time.Duration) {
+	for {
+		var uploads []models.S3MultipartUpload
+		h.DB.Where("created_at < ?", time.Now().Add(-s3MultipartLifetime)).Find(&uploads)
+
+		for _, upload := range uploads {
+			err := removeMultipartUpload(h, &upload)
+			if err != nil {
+				log.Printf("Error removing expired multipart upload %s: %v", upload.UploadID, err)
+			}
+		}
+
+		time.Sleep(interval)
+	}
+}
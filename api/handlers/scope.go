@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Personal folders live in {share root}/.personal/{user id}, hidden from the shared scope
+const personalDirName = ".personal"
+
+// The share relative path of a user's personal folder
+func personalFolderPath(userID uint) string {
+	return fmt.Sprintf("/%s/%d", personalDirName, userID)
+}
+
+func createPersonalFolder(userID uint) error {
+	return os.MkdirAll(processPath(homeShareRoot()+personalFolderPath(userID)), 0755)
+}
+
+// For a share relative path inside a personal folder, the owner of the folder
+// and whether the path is the folder itself
+func personalFolderOwner(path string) (ownerID uint, isFolder bool, ok bool) {
+	segments := strings.SplitN(strings.TrimPrefix(pathpkg.Clean("/"+filepath.ToSlash(path)), "/"), "/", 3)
+	if len(segments) < 2 || segments[0] != personalDirName {
+		return 0, false, false
+	}
+
+	id, err := strconv.ParseUint(segments[1], 10, 64)
+	if err != nil {
+		return 0, false, false
+	}
+
+	return uint(id), len(segments) == 2, true
+}
+
+// The directory the paths of a request are relative to, picked by its scope parameter,
+// "shared" (the default) for the homeshare or "personal" for the user's own folder.
+// Writes an error response if the scope can't be used.
+func scopeRoot(h *Handler, w http.ResponseWriter, r *http.Request) (string, bool) {
+	switch r.URL.Query().Get("scope") {
+	case "", "shared":
+		return homeShareRoot(), true
+	case "personal":
+		user := homeshareUser(h, r)
+		if user == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return "", false
+		}
+
+		// Users registered before personal folders existed get theirs on first use
+		err := createPersonalFolder(user.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return "", false
+		}
+
+		return processPath(homeShareRoot() + personalFolderPath(user.ID)), true
+	}
+
+	http.Error(w, "Invalid scope", http.StatusBadRequest)
+	return "", false
+}
+
+// Converts an absolute path back into the path the client knows it by within the scope rooted at root
+func scopePath(root string, fullPath string) string {
+	return strings.TrimPrefix(fullPath, filepath.Clean(root))
+}
+
+// Whether fullPath is inside the scope rooted at root, personal folders are not part of the shared scope
+func inScope(root string, fullPath string) bool {
+	root = filepath.Clean(root)
+	if !strings.HasPrefix(fullPath, root+PathDelimiter) {
+		return false
+	}
+
+	if root == filepath.Clean(homeShareRoot()) {
+		_, _, isPersonal := personalFolderOwner(sharePath(fullPath))
+		return !isPersonal
+	}
+
+	return true
+}
+
+// The path a stored share relative path is known by within its own scope
+func unscopedPath(path string) string {
+	ownerID, _, ok := personalFolderOwner(path)
+	if !ok {
+		return path
+	}
+
+	path = strings.TrimPrefix(path, processPath(personalFolderPath(ownerID)))
+	if path == "" {
+		return PathDelimiter
+	}
+	return path
+}
@@ -0,0 +1,373 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"gorm.io/gorm"
+)
+
+// A sessions.Store that keeps sessions in the database, the cookie only carries a signed token for the row.
+// Unlike cookies they can be listed and revoked.
+type DBSessionStore struct {
+	DB      *gorm.DB
+	Codecs  []securecookie.Codec
+	Options *sessions.Options // Default options for new sessions
+}
+
+func NewDBSessionStore(db *gorm.DB, keyPairs ...[]byte) *DBSessionStore {
+	return &DBSessionStore{
+		DB:     db,
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+	}
+}
+
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Get returns the session for the request, loading it only once per request
+func (s *DBSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session named by the request's cookie.
+// A cookie that's been tampered with, or whose session expired or was revoked, gets a new empty session.
+func (s *DBSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	var token string
+	err = securecookie.DecodeMulti(name, cookie.Value, &token, s.Codecs...)
+	if err != nil {
+		return session, nil
+	}
+
+	now := time.Now()
+
+	var row models.Session
+	result := s.DB.Where("token_hash = ? AND expires_at > ?", hashSessionToken(token), now).First(&row)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return session, nil
+	}
+	if result.Error != nil {
+		return session, result.Error
+	}
+
+	err = securecookie.GobEncoder{}.Deserialize(row.Data, &session.Values)
+	if err != nil {
+		return session, nil
+	}
+
+	session.ID = token
+	session.IsNew = false
+
+	// Once a minute is close enough, rather than a write on every request
+	if now.Sub(row.LastSeenAt) > time.Minute {
+		s.DB.Model(&row).Updates(map[string]any{
+			"last_seen_at": now,
+			"ip":           clientIP(r),
+		})
+	}
+
+	return session, nil
+}
+
+// Save writes the session's values to its row and sets the cookie, or deletes it when MaxAge is negative.
+// The token changes whenever a different user logs in on the session, so one planted before login is no use after.
+func (s *DBSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			result := s.DB.Where("token_hash = ?", hashSessionToken(session.ID)).Delete(&models.Session{})
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	now := time.Now()
+
+	var row models.Session
+	if session.ID != "" {
+		result := s.DB.Where("token_hash = ?", hashSessionToken(session.ID)).First(&row)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			// Revoked while the request was running, it mustn't come back
+			expired := *session.Options
+			expired.MaxAge = -1
+			http.SetCookie(w, sessions.NewCookie(session.Name(), "", &expired))
+			return nil
+		}
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+
+	var userID *uint
+	if id, ok := session.Values["id"].(uint); ok && id != 0 {
+		userID = &id
+	}
+
+	if row.ID != 0 && !sameSessionUser(row.UserID, userID) {
+		result := s.DB.Delete(&row)
+		if result.Error != nil {
+			return result.Error
+		}
+		row = models.Session{}
+	}
+
+	if row.ID == 0 {
+		// Nothing worth keeping a row for
+		if len(session.Values) == 0 {
+			return nil
+		}
+
+		token, err := GenerateToken(32)
+		if err != nil {
+			return err
+		}
+
+		session.ID = token
+		row.TokenHash = hashSessionToken(token)
+		row.UserAgent = r.UserAgent()
+		row.IP = clientIP(r)
+	}
+
+	data, err := securecookie.GobEncoder{}.Serialize(session.Values)
+	if err != nil {
+		return err
+	}
+
+	lifetime := time.Duration(session.Options.MaxAge) * time.Second
+	if lifetime == 0 {
+		// Gone when the browser closes, but the row still needs to run out
+		lifetime = 24 * time.Hour
+	}
+
+	row.UserID = userID
+	row.Data = data
+	row.LastSeenAt = now
+	row.ExpiresAt = now.Add(lifetime)
+
+	result := s.DB.Save(&row)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+func sameSessionUser(a *uint, b *uint) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+// Periodically deletes sessions that have expired
+func (h *Handler) ExpireSessions(interval time.Duration) {
+	for {
+		result := h.DB.Where("expires_at < ?", time.Now()).Delete(&models.Session{})
+		if result.Error != nil {
+			log.Printf("Error expiring sessions: %v", result.Error)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// The token of the session the request was made with, empty if it doesn't have one
+func currentSessionToken(h *Handler, r *http.Request) string {
+	session, err := h.Store.Get(r, "session")
+	if err != nil {
+		return ""
+	}
+	return session.ID
+}
+
+// Logs the user out everywhere, except on the session with keepToken if it's set
+func revokeUserSessions(h *Handler, userID uint, keepToken string) error {
+	query := h.DB.Where("user_id = ?", userID)
+	if keepToken != "" {
+		query = query.Where("token_hash <> ?", hashSessionToken(keepToken))
+	}
+
+	result := query.Delete(&models.Session{})
+	return result.Error
+}
+
+// A short name for the browser and OS in a user agent, such as Firefox on Windows
+func describeDevice(userAgent string) string {
+	browser := ""
+	switch {
+	case strings.Contains(userAgent, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(userAgent, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(userAgent, "Firefox/"), strings.Contains(userAgent, "FxiOS/"):
+		browser = "Firefox"
+	case strings.Contains(userAgent, "Chrome/"), strings.Contains(userAgent, "CriOS/"):
+		browser = "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		browser = "Safari"
+	}
+
+	platform := ""
+	switch {
+	case strings.Contains(userAgent, "Windows"):
+		platform = "Windows"
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"):
+		platform = "iOS"
+	case strings.Contains(userAgent, "Mac OS X"):
+		platform = "macOS"
+	case strings.Contains(userAgent, "Android"):
+		platform = "Android"
+	case strings.Contains(userAgent, "CrOS"):
+		platform = "ChromeOS"
+	case strings.Contains(userAgent, "Linux"):
+		platform = "Linux"
+	}
+
+	switch {
+	case browser != "" && platform != "":
+		return browser + " on " + platform
+	case browser != "":
+		return browser
+	case platform != "":
+		return platform
+	default:
+		return "Unknown device"
+	}
+}
+
+type AccountSession struct {
+	ID         uint      `json:"id"`
+	Device     string    `json:"device"` // Browser and OS, such as Firefox on Windows
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	Current    bool      `json:"current"` // The session making this request
+}
+
+type GetSessionsResponse struct {
+	Sessions []AccountSession `json:"sessions"`
+}
+
+// @Router /account/sessions [get]
+// @Tags auth
+// @Summary Sessions
+// @Description List the places the user is logged in, most recently used first
+// @Produce json
+// @Success 200 {object} GetSessionsResponse "Sessions"
+func (h *Handler) GetSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := accountUser(h, w, r)
+	if user == nil {
+		return
+	}
+
+	var rows []models.Session
+	result := h.DB.Where("user_id = ? AND expires_at > ?", user.ID, time.Now()).Order("last_seen_at DESC").Find(&rows)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	currentHash := hashSessionToken(currentSessionToken(h, r))
+
+	response := GetSessionsResponse{
+		Sessions: []AccountSession{},
+	}
+	for _, row := range rows {
+		response.Sessions = append(response.Sessions, AccountSession{
+			ID:         row.ID,
+			Device:     describeDevice(row.UserAgent),
+			UserAgent:  row.UserAgent,
+			IP:         row.IP,
+			CreatedAt:  row.CreatedAt,
+			LastSeenAt: row.LastSeenAt,
+			Current:    row.TokenHash == currentHash,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// @Router /account/sessions/{sessionId} [delete]
+// @Tags auth
+// @Summary Revoke Session
+// @Description Log out of one session, which can be the current one
+// @Param sessionId path int true "Session ID"
+// @Success 200
+func (h *Handler) DeleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	user := accountUser(h, w, r)
+	if user == nil {
+		return
+	}
+
+	vars := mux.Vars(r)
+	sessionId := vars["sessionId"]
+
+	result := h.DB.Where("user_id = ?", user.ID).Delete(&models.Session{}, sessionId)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if result.RowsAffected == 0 {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// @Router /account/sessions [delete]
+// @Tags auth
+// @Summary Revoke All Sessions
+// @Description Log out everywhere, this session included
+// @Success 200
+func (h *Handler) DeleteSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := accountUser(h, w, r)
+	if user == nil {
+		return
+	}
+
+	err := revokeUserSessions(h, user.ID, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,358 @@
+package handlers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// The server's host key, created on first start so clients see the same key from then on
+func loadSFTPHostKey() (ssh.Signer, error) {
+	keyPath := os.Getenv("SFTP_HOST_KEY")
+	if keyPath == "" {
+		keyPath = "sftp_host_key"
+	}
+
+	keyBytes, err := os.ReadFile(keyPath)
+	if os.IsNotExist(err) {
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		block, err := ssh.MarshalPrivateKey(privateKey, "HomeShareDrive")
+		if err != nil {
+			return nil, err
+		}
+
+		keyBytes = pem.EncodeToMemory(block)
+		err = os.WriteFile(keyPath, keyBytes, 0600)
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return ssh.ParsePrivateKey(keyBytes)
+}
+
+// The user id a login is carried through the connection under
+const sftpUserIDExtension = "user-id"
+
+func sftpPermissions(user *models.User) (*ssh.Permissions, error) {
+	if (!user.IsEmailVerified && !user.IsAdmin) || isBanned(user) {
+		return nil, errSFTPLoginFailed
+	}
+
+	return &ssh.Permissions{
+		Extensions: map[string]string{sftpUserIDExtension: strconv.FormatUint(uint64(user.ID), 10)},
+	}, nil
+}
+
+var errSFTPLoginFailed = errors.New("Invalid username or password")
+
+func (h *Handler) sftpServerConfig() (*ssh.ServerConfig, error) {
+	hostKey, err := loadSFTPHostKey()
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			user, _ := throttledCheckCredentials(h, conn.User(), string(password), ip, "sftp")
+
+			// A password alone isn't enough for an account with a second factor, keys still are
+			if user == nil || hasTwoFactor(h, user) {
+				return nil, errSFTPLoginFailed
+			}
+
+			recordLoginSuccess(h, user)
+			return sftpPermissions(user)
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, publicKey ssh.PublicKey) (*ssh.Permissions, error) {
+			var key models.SSHKey
+			result := h.DB.Preload("User").Where("fingerprint = ?", ssh.FingerprintSHA256(publicKey)).First(&key)
+			if result.Error != nil {
+				return nil, errSFTPLoginFailed
+			}
+
+			// The key has to belong to the account being logged in to
+			if conn.User() != key.User.Username && conn.User() != key.User.OriginalUsername && conn.User() != key.User.Email {
+				return nil, errSFTPLoginFailed
+			}
+			return sftpPermissions(&key.User)
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	return config, nil
+}
+
+// Listens for SFTP connections on address until the process exits
+func (h *Handler) ServeSFTP(address string) {
+	config, err := h.sftpServerConfig()
+	if err != nil {
+		log.Printf("Error starting SFTP: %v", err)
+		return
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Printf("Error starting SFTP: %v", err)
+		return
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Error accepting SFTP connection: %v", err)
+			continue
+		}
+
+		go h.serveSSHConnection(conn, config)
+	}
+}
+
+// Open SFTP connections by user, so they can be cut off when the user is banned
+var sftpConnections = struct {
+	sync.Mutex
+	users map[uint]map[*ssh.ServerConn]bool
+}{users: map[uint]map[*ssh.ServerConn]bool{}}
+
+// Disconnects all of a user's SFTP connections
+func closeSFTPConnections(userID uint) {
+	sftpConnections.Lock()
+	defer sftpConnections.Unlock()
+
+	for sshConn := range sftpConnections.users[userID] {
+		sshConn.Close()
+	}
+}
+
+func (h *Handler) serveSSHConnection(conn net.Conn, config *ssh.ServerConfig) {
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sshConn.Close()
+
+	go ssh.DiscardRequests(requests)
+
+	userID, _ := strconv.ParseUint(sshConn.Permissions.Extensions[sftpUserIDExtension], 10, 64)
+
+	sftpConnections.Lock()
+	if sftpConnections.users[uint(userID)] == nil {
+		sftpConnections.users[uint(userID)] = map[*ssh.ServerConn]bool{}
+	}
+	sftpConnections.users[uint(userID)][sshConn] = true
+	sftpConnections.Unlock()
+
+	defer func() {
+		sftpConnections.Lock()
+		delete(sftpConnections.users[uint(userID)], sshConn)
+		if len(sftpConnections.users[uint(userID)]) == 0 {
+			delete(sftpConnections.users, uint(userID))
+		}
+		sftpConnections.Unlock()
+	}()
+
+	for newChannel := range channels {
+		// Only sftp is offered, there's no shell or command execution
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		go func(in <-chan *ssh.Request) {
+			for request := range in {
+				isSFTP := request.Type == "subsystem" && len(request.Payload) > 4 && string(request.Payload[4:]) == "sftp"
+				request.Reply(isSFTP, nil)
+			}
+		}(channelRequests)
+
+		go h.serveSFTPSession(channel, uint(userID))
+	}
+}
+
+func (h *Handler) serveSFTPSession(channel ssh.Channel, userID uint) {
+	defer channel.Close()
+
+	var user models.User
+	result := h.DB.First(&user, userID)
+	if result.Error != nil {
+		return
+	}
+
+	rules, err := loadAccessRules(h, &user)
+	if err != nil {
+		log.Printf("Error starting SFTP session: %v", err)
+		return
+	}
+
+	server := sftp.NewRequestServer(channel, sftpHandlers(&shareFS{h: h, user: &user, rules: rules}))
+	err = server.Serve()
+	if err != nil && err != io.EOF {
+		log.Printf("SFTP session for %s ended: %v", user.Username, err)
+	}
+	server.Close()
+}
+
+// Serves SFTP requests from the same view of the share WebDAV uses
+type sftpShare struct {
+	fs *shareFS
+}
+
+func sftpHandlers(fs *shareFS) sftp.Handlers {
+	share := &sftpShare{fs: fs}
+	return sftp.Handlers{FileGet: share, FilePut: share, FileCmd: share, FileList: share}
+}
+
+func (s *sftpShare) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	file, err := s.fs.OpenFile(context.Background(), r.Filepath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return file.(*shareFile), nil
+}
+
+func (s *sftpShare) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	flags := r.Pflags()
+
+	flag := os.O_WRONLY
+	if flags.Creat {
+		flag |= os.O_CREATE
+	}
+	if flags.Trunc {
+		flag |= os.O_TRUNC
+	}
+	if flags.Excl {
+		flag |= os.O_EXCL
+	}
+
+	file, err := s.fs.OpenFile(context.Background(), r.Filepath, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return file.(*shareFile), nil
+}
+
+var errDirectoryNotEmpty = errors.New("directory not empty")
+
+// Removes a directory only if there's nothing in it, rmdir never takes anything else with it
+func (s *sftpShare) rmdir(ctx context.Context, name string) error {
+	fullPath, err := s.fs.resolve(name, "delete")
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(fullPath)
+	if err != nil {
+		return err
+	}
+
+	// Thumbnails are the site's, they go with the directory
+	for _, entry := range entries {
+		if entry.Name() != ".thumbnails" {
+			return errDirectoryNotEmpty
+		}
+	}
+
+	return s.fs.RemoveAll(ctx, name)
+}
+
+func (s *sftpShare) Filecmd(r *sftp.Request) error {
+	ctx := context.Background()
+
+	switch r.Method {
+	case "Setstat":
+		// Only sizes and modification times are kept, permissions and owners are the server's
+		attributes := r.Attributes()
+		if r.AttrFlags().Size {
+			err := s.fs.Truncate(r.Filepath, int64(attributes.Size))
+			if err != nil {
+				return err
+			}
+		}
+		if !r.AttrFlags().Acmodtime {
+			return nil
+		}
+		fullPath, err := s.fs.resolve(r.Filepath, "write")
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(fullPath, attributes.AccessTime(), attributes.ModTime())
+	case "Rename", "PosixRename":
+		return s.fs.Rename(ctx, r.Filepath, r.Target)
+	case "Rmdir":
+		return s.rmdir(ctx, r.Filepath)
+	case "Remove":
+		return s.fs.RemoveAll(ctx, r.Filepath)
+	case "Mkdir":
+		return s.fs.Mkdir(ctx, r.Filepath, 0755)
+	}
+
+	// Links could point outside the share
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// A directory listing or single stat result handed back a page at a time
+type sftpListing []os.FileInfo
+
+func (l sftpListing) ListAt(page []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+
+	n := copy(page, l[offset:])
+	if n < len(page) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *sftpShare) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	ctx := context.Background()
+
+	switch r.Method {
+	case "List":
+		file, err := s.fs.OpenFile(ctx, r.Filepath, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		infos, err := file.Readdir(0)
+		if err != nil {
+			return nil, err
+		}
+		return sftpListing(infos), nil
+	case "Stat", "Lstat":
+		info, err := s.fs.Stat(ctx, r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return sftpListing{info}, nil
+	}
+
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
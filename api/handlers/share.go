@@ -0,0 +1,665 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+type CreateShareLinkRequest struct {
+	Path         string     `json:"path"`
+	ExpiresAt    *time.Time `json:"expiresAt"`
+	Password     string     `json:"password"`
+	MaxDownloads int        `json:"maxDownloads"`
+}
+
+// @Router /share-links [post]
+// @Tags share
+// @Summary Create Share Link
+// @Description Create a public link to a file or directory
+// @Accept json
+// @Produce json
+// @Param body body CreateShareLinkRequest true "Body"
+// @Param scope query string false "shared (default) or personal"
+// @Success 201 {object} models.ShareLink "Share Link"
+func (h *Handler) CreateShareLinkHandler(w http.ResponseWriter, r *http.Request) {
+	isAuthorized := CheckCanHomeshare(h, r)
+	if !isAuthorized {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	userID := requestUserID(h, r)
+
+	var createShareLinkRequest CreateShareLinkRequest
+	err := json.NewDecoder(r.Body).Decode(&createShareLinkRequest)
+	if err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	path := createShareLinkRequest.Path
+
+	root, ok := scopeRoot(h, w, r)
+	if !ok {
+		return
+	}
+
+	itemPath := processPath(root + path)
+
+	if !checkPathInRoot(itemPath) {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	if !CheckPermission(h, r, itemPath, "manage") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	info, err := os.Stat(itemPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if createShareLinkRequest.ExpiresAt != nil && createShareLinkRequest.ExpiresAt.Before(time.Now()) {
+		http.Error(w, "Expiry date is in the past", http.StatusBadRequest)
+		return
+	}
+
+	if createShareLinkRequest.MaxDownloads < 0 {
+		http.Error(w, "Invalid max downloads", http.StatusBadRequest)
+		return
+	}
+
+	token, err := GenerateToken(32)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	shareLink := models.ShareLink{
+		Token:         token,
+		CreatedUserID: userID,
+		Path:          sharePath(filepath.Clean(root)) + path,
+		IsDir:         info.IsDir(),
+		ExpiresAt:     createShareLinkRequest.ExpiresAt,
+		MaxDownloads:  createShareLinkRequest.MaxDownloads,
+	}
+
+	if createShareLinkRequest.Password != "" {
+		salt, err := GenerateSalt()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		passwordHash, err := HashPassword(createShareLinkRequest.Password, salt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		shareLink.PasswordHash = passwordHash
+		shareLink.PasswordSalt = salt
+	}
+
+	result := h.DB.Create(&shareLink)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(shareLink)
+}
+
+type ShareLinkResponse struct {
+	models.ShareLink
+	HasPassword bool   `json:"hasPassword"`
+	CreatedBy   string `json:"createdBy"`
+}
+
+type GetShareLinksResponse struct {
+	ShareLinks []ShareLinkResponse `json:"shareLinks"`
+}
+
+// @Router /share-links [get]
+// @Tags share
+// @Summary Share Links
+// @Description List your share links, or every share link for admins
+// @Produce json
+// @Success 200 {object} GetShareLinksResponse "Share Links"
+func (h *Handler) GetShareLinksHandler(w http.ResponseWriter, r *http.Request) {
+	isAuthorized := CheckCanHomeshare(h, r)
+	if !isAuthorized {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	userID := requestUserID(h, r)
+
+	query := h.DB.Preload("User").Order("created_at desc")
+	if !CheckIsAdmin(h, r) {
+		query = query.Where("created_user_id = ?", userID)
+	}
+
+	var shareLinks []models.ShareLink
+	result := query.Find(&shareLinks)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := GetShareLinksResponse{
+		ShareLinks: []ShareLinkResponse{},
+	}
+
+	for _, shareLink := range shareLinks {
+		response.ShareLinks = append(response.ShareLinks, ShareLinkResponse{
+			ShareLink:   shareLink,
+			HasPassword: shareLink.PasswordHash != "",
+			CreatedBy:   shareLink.User.Username,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// @Router /share-links/{linkId} [delete]
+// @Tags share
+// @Summary Revoke Share Link
+// @Description Revoke a share link, only its creator or an admin can
+// @Param linkId path int true "Share Link ID"
+// @Success 200
+func (h *Handler) RevokeShareLinkHandler(w http.ResponseWriter, r *http.Request) {
+	isAuthorized := CheckCanHomeshare(h, r)
+	if !isAuthorized {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	userID := requestUserID(h, r)
+
+	vars := mux.Vars(r)
+	linkId := vars["linkId"]
+
+	var shareLink models.ShareLink
+	result := h.DB.First(&shareLink, linkId)
+	if result.Error != nil {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+
+	if shareLink.CreatedUserID != userID && !CheckIsAdmin(h, r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	result = h.DB.Unscoped().Delete(&shareLink)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Share link visitors unlock a password protected link once per session
+func shareLinkSessionKey(shareLink *models.ShareLink) string {
+	return "shareLink:" + shareLink.Token
+}
+
+// Loads the share link named in the url, making sure it's still usable and,
+// if requireUnlocked, that the visitor has entered its password
+func getShareLink(h *Handler, w http.ResponseWriter, r *http.Request, requireUnlocked bool) (*models.ShareLink, bool) {
+	vars := mux.Vars(r)
+	token := vars["token"]
+
+	var shareLink models.ShareLink
+	result := h.DB.Where("token = ?", token).First(&shareLink)
+	if result.Error != nil {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	if shareLink.ExpiresAt != nil && shareLink.ExpiresAt.Before(time.Now()) {
+		http.Error(w, "Share link has expired", http.StatusGone)
+		return nil, false
+	}
+
+	isAllowed, err := linkCreatorAllows(h, shareLink.CreatedUserID, processPath(homeShareRoot()+shareLink.Path), "read")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if !isAllowed {
+		http.Error(w, "Share link is no longer available", http.StatusGone)
+		return nil, false
+	}
+
+	if requireUnlocked && shareLink.PasswordHash != "" {
+		session, err := h.Store.Get(r, "session")
+		if err != nil || session.Values[shareLinkSessionKey(&shareLink)] != true {
+			http.Error(w, "Password required", http.StatusUnauthorized)
+			return nil, false
+		}
+	}
+
+	return &shareLink, true
+}
+
+// Resolves a path relative to the item a share link points at, refusing anything outside it
+func shareLinkItemPath(shareLink *models.ShareLink, path string) (string, bool) {
+	linkRoot := filepath.Clean(processPath(homeShareRoot() + shareLink.Path))
+
+	if !shareLink.IsDir {
+		if path != "" && path != "/" {
+			return "", false
+		}
+		return linkRoot, true
+	}
+
+	itemPath := processPath(homeShareRoot() + shareLink.Path + path)
+
+	if !checkPathInRoot(itemPath) {
+		return "", false
+	}
+
+	itemPath = filepath.Clean(itemPath)
+	if itemPath != linkRoot && !strings.HasPrefix(itemPath, linkRoot+PathDelimiter) {
+		return "", false
+	}
+
+	// Hidden files, thumbnails included, aren't part of what's shared
+	for _, segment := range strings.Split(strings.TrimPrefix(itemPath, linkRoot), PathDelimiter) {
+		if strings.HasPrefix(segment, ".") {
+			return "", false
+		}
+	}
+
+	return itemPath, true
+}
+
+// Uses up one of the link's downloads, reporting false once there are none left
+func countShareLinkDownload(h *Handler, shareLink *models.ShareLink) bool {
+	result := h.DB.Model(&models.ShareLink{}).
+		Where("id = ? AND (max_downloads = 0 OR download_count < max_downloads)", shareLink.ID).
+		UpdateColumn("download_count", gorm.Expr("download_count + 1"))
+
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+// Whether serving the file sends its first byte, which is what uses up a download. The Range header is read the
+// same way http.ServeFile reads it, so one that it would ignore can't be used to get the whole file uncounted.
+func sendsFileStart(r *http.Request, info os.FileInfo) bool {
+	header := r.Header.Get("Range")
+	size := info.Size()
+	if header == "" || size == 0 {
+		return true
+	}
+
+	// A Range with an If-Range that doesn't match gets the whole file
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" {
+		modTime, err := http.ParseTime(ifRange)
+		if err != nil || modTime.Unix() != info.ModTime().Unix() {
+			return true
+		}
+	}
+
+	// Anything that doesn't parse is turned away with a 416, nothing is sent
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return false
+	}
+
+	ranges := 0
+	noOverlap := false
+	startsAtZero := false
+	var total int64
+
+	for _, part := range strings.Split(spec, ",") {
+		part = textproto.TrimString(part)
+		if part == "" {
+			continue
+		}
+
+		first, last, ok := strings.Cut(part, "-")
+		if !ok {
+			return false
+		}
+		first, last = textproto.TrimString(first), textproto.TrimString(last)
+
+		var start, length int64
+		if first == "" {
+			// The last n bytes
+			if last == "" || last[0] == '-' {
+				return false
+			}
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return false
+			}
+			n = min(n, size)
+			start, length = size-n, n
+		} else {
+			n, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || n < 0 {
+				return false
+			}
+			if n >= size {
+				noOverlap = true
+				continue
+			}
+			start, length = n, size-n
+
+			if last != "" {
+				end, err := strconv.ParseInt(last, 10, 64)
+				if err != nil || start > end {
+					return false
+				}
+				length = min(end, size-1) - start + 1
+			}
+		}
+
+		ranges++
+		total += length
+		if start == 0 {
+			startsAtZero = true
+		}
+	}
+
+	if ranges == 0 {
+		// No ranges at all is the whole file, none that overlap it is a 416
+		return !noOverlap
+	}
+
+	// Ranges adding up to more than the file are ignored and the whole of it sent
+	return startsAtZero || total > size
+}
+
+type PublicShareLinkResponse struct {
+	Name               string     `json:"name"`
+	IsDir              bool       `json:"isDir"`
+	Size               int64      `json:"size"`
+	ExpiresAt          *time.Time `json:"expiresAt"`
+	RequiresPassword   bool       `json:"requiresPassword"`
+	IsUnlocked         bool       `json:"isUnlocked"`
+	DownloadsRemaining *int       `json:"downloadsRemaining"`
+}
+
+// @Router /s/{token} [get]
+// @Tags share
+// @Summary Share Link
+// @Description Describe what a share link points at, no account needed
+// @Produce json
+// @Param token path string true "Share Link Token"
+// @Success 200 {object} PublicShareLinkResponse "Share Link"
+func (h *Handler) PublicShareLinkHandler(w http.ResponseWriter, r *http.Request) {
+	shareLink, ok := getShareLink(h, w, r, false)
+	if !ok {
+		return
+	}
+
+	itemPath, _ := shareLinkItemPath(shareLink, "")
+	info, err := os.Stat(itemPath)
+	if err != nil {
+		http.Error(w, "Shared item no longer exists", http.StatusGone)
+		return
+	}
+
+	isUnlocked := shareLink.PasswordHash == ""
+	if !isUnlocked {
+		session, err := h.Store.Get(r, "session")
+		isUnlocked = err == nil && session.Values[shareLinkSessionKey(shareLink)] == true
+	}
+
+	var downloadsRemaining *int
+	if shareLink.MaxDownloads > 0 {
+		remaining := shareLink.MaxDownloads - shareLink.DownloadCount
+		downloadsRemaining = &remaining
+	}
+
+	response := PublicShareLinkResponse{
+		Name:               info.Name(),
+		IsDir:              info.IsDir(),
+		Size:               info.Size(),
+		ExpiresAt:          shareLink.ExpiresAt,
+		RequiresPassword:   shareLink.PasswordHash != "",
+		IsUnlocked:         isUnlocked,
+		DownloadsRemaining: downloadsRemaining,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+type UnlockShareLinkRequest struct {
+	Password string `json:"password"`
+}
+
+// @Router /s/{token}/unlock [post]
+// @Tags share
+// @Summary Unlock Share Link
+// @Description Enter the password of a share link
+// @Accept json
+// @Param token path string true "Share Link Token"
+// @Param body body UnlockShareLinkRequest true "Body"
+// @Success 200
+func (h *Handler) UnlockShareLinkHandler(w http.ResponseWriter, r *http.Request) {
+	shareLink, ok := getShareLink(h, w, r, false)
+	if !ok {
+		return
+	}
+
+	var unlockRequest UnlockShareLinkRequest
+	err := json.NewDecoder(r.Body).Decode(&unlockRequest)
+	if err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	if shareLink.PasswordHash != "" {
+		err = bcrypt.CompareHashAndPassword([]byte(shareLink.PasswordHash), []byte(shareLink.PasswordSalt+unlockRequest.Password))
+		if err != nil {
+			http.Error(w, "Invalid password", http.StatusBadRequest)
+			return
+		}
+	}
+
+	session, err := h.Store.Get(r, "session")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	session.Values[shareLinkSessionKey(shareLink)] = true
+
+	err = session.Save(r, w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// @Router /s/{token}/contents [get]
+// @Tags share
+// @Summary Share Link Contents
+// @Description Get the contents of a directory inside a shared directory
+// @Produce json
+// @Param token path string true "Share Link Token"
+// @Param path query string false "Path inside the shared directory"
+// @Success 200 {object} GetDirectoryContentsResponse "Directory Contents"
+func (h *Handler) ShareLinkContentsHandler(w http.ResponseWriter, r *http.Request) {
+	shareLink, ok := getShareLink(h, w, r, true)
+	if !ok {
+		return
+	}
+
+	if !shareLink.IsDir {
+		http.Error(w, "Share link is not a directory", http.StatusBadRequest)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		path = PathDelimiter
+	}
+
+	if _, ok := shareLinkItemPath(shareLink, path); !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	linkRoot := processPath(homeShareRoot() + shareLink.Path)
+
+	fileInfos, err := listDirectory(linkRoot, processPath(path), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := GetDirectoryContentsResponse{
+		Path:  path,
+		Items: fileInfos,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// @Router /s/{token}/download [get]
+// @Tags share
+// @Summary Share Link Download
+// @Description Download the shared file, or a file inside a shared directory
+// @Param token path string true "Share Link Token"
+// @Param path query string false "Path inside the shared directory"
+func (h *Handler) ShareLinkDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	shareLink, ok := getShareLink(h, w, r, true)
+	if !ok {
+		return
+	}
+
+	filePath, ok := shareLinkItemPath(shareLink, r.URL.Query().Get("path"))
+	if !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil || info.IsDir() {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	// Resuming or seeking through a video shouldn't use up another download
+	if sendsFileStart(r, info) {
+		if !countShareLinkDownload(h, shareLink) {
+			http.Error(w, "Share link has no downloads left", http.StatusGone)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": info.Name()}))
+	http.ServeFile(w, r, filePath)
+}
+
+// @Router /s/{token}/thumbnail [get]
+// @Tags share
+// @Summary Share Link Thumbnail
+// @Description Get the thumbnail of an image inside a shared directory
+// @Param token path string true "Share Link Token"
+// @Param path query string false "Path of the image inside the shared directory"
+func (h *Handler) ShareLinkThumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	shareLink, ok := getShareLink(h, w, r, true)
+	if !ok {
+		return
+	}
+
+	filePath, ok := shareLinkItemPath(shareLink, r.URL.Query().Get("path"))
+	if !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	thumbnail := thumbnailPath(filePath)
+	if _, err := os.Stat(thumbnail); err != nil {
+		http.Error(w, "Thumbnail not found", http.StatusNotFound)
+		return
+	}
+
+	http.ServeFile(w, r, thumbnail)
+}
+
+// @Router /s/{token}/archive [get]
+// @Tags share
+// @Summary Share Link Archive
+// @Description Download a shared directory, or a directory inside it, as a zip or tar.gz archive
+// @Param token path string true "Share Link Token"
+// @Param path query string false "Path inside the shared directory"
+// @Param format query string false "zip (default) or tar.gz"
+func (h *Handler) ShareLinkArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	shareLink, ok := getShareLink(h, w, r, true)
+	if !ok {
+		return
+	}
+
+	itemPath, ok := shareLinkItemPath(shareLink, r.URL.Query().Get("path"))
+	if !ok {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := os.Stat(itemPath); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "zip"
+	}
+
+	if format != "zip" && format != "tar.gz" {
+		http.Error(w, "Invalid format", http.StatusBadRequest)
+		return
+	}
+
+	if !countShareLinkDownload(h, shareLink) {
+		http.Error(w, "Share link has no downloads left", http.StatusGone)
+		return
+	}
+
+	archive := newArchiveWriter(w, format)
+
+	fileName := archiveFileName(homeShareRoot(), []string{itemPath}, "."+format)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+
+	err := addToArchive(archive, strings.TrimSuffix(fileName, "."+format), itemPath, nil)
+	if err != nil {
+		log.Printf("Error streaming archive %s: %v", fileName, err)
+		return
+	}
+
+	err = archive.Close()
+	if err != nil {
+		log.Printf("Error streaming archive %s: %v", fileName, err)
+	}
+}
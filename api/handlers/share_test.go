@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+)
+
+func TestShareLinkItemPath(t *testing.T) {
+	t.Setenv("HOME_SHARE_ROOT", "/share")
+
+	directory := &models.ShareLink{Path: "/photos", IsDir: true}
+	file := &models.ShareLink{Path: "/docs/report.pdf"}
+
+	tests := []struct {
+		shareLink *models.ShareLink
+		path      string
+		want      string
+		wantOK    bool
+	}{
+		{directory, "", "/share/photos", true},
+		{directory, "/", "/share/photos", true},
+		{directory, "/a.jpg", "/share/photos/a.jpg", true},
+		{directory, "/2024/b.jpg", "/share/photos/2024/b.jpg", true},
+		{directory, "/2024/../b.jpg", "", false},
+		{directory, "/../secret.txt", "", false},
+
+		// A sibling that starts with the same name isn't inside it
+		{directory, "2024/b.jpg", "", false},
+
+		// Hidden files and what the site keeps for itself aren't shared
+		{directory, "/.hidden", "", false},
+		{directory, "/2024/.hidden/b.jpg", "", false},
+		{directory, "/.thumbnails/a.jpg", "", false},
+		{directory, "/.trash", "", false},
+
+		// A file's link only ever leads to the file
+		{file, "", "/share/docs/report.pdf", true},
+		{file, "/", "/share/docs/report.pdf", true},
+		{file, "/other.pdf", "", false},
+		{file, "/../other.pdf", "", false},
+	}
+
+	for _, test := range tests {
+		got, ok := shareLinkItemPath(test.shareLink, processPath(test.path))
+		if ok != test.wantOK || got != processPath(test.want) {
+			t.Errorf("%s + %q: got %q %v, want %q %v", test.shareLink.Path, test.path, got, ok, test.want, test.wantOK)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"strings"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+	"golang.org/x/net/webdav"
+)
+
+// Directories the site keeps for itself inside the share, never shown over WebDAV or SFTP
+var shareHiddenNames = map[string]bool{
+	".thumbnails":   true,
+	trashDirName:    true,
+	versionsDirName: true,
+	personalDirName: true,
+}
+
+// A view of the share as one user sees it for WebDAV and SFTP, holding every
+// operation to the same path and permission checks as the JSON handlers
+type shareFS struct {
+	h     *Handler
+	user  *models.User
+	rules *accessRules
+}
+
+// Maps a slash separated name from a client onto the share, failing if it's off limits or the user lacks permission
+func (s *shareFS) resolve(name string, permission string) (string, error) {
+	name = pathpkg.Clean("/" + name)
+
+	for _, segment := range strings.Split(name, "/") {
+		if shareHiddenNames[segment] {
+			return "", os.ErrNotExist
+		}
+	}
+
+	fullPath := filepath.Clean(processPath(homeShareRoot() + name))
+	if !checkPathInRoot(fullPath) {
+		return "", os.ErrNotExist
+	}
+
+	if !s.rules.allows(fullPath, permission) {
+		return "", os.ErrPermission
+	}
+
+	return fullPath, nil
+}
+
+func (s *shareFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	fullPath, err := s.resolve(name, "write")
+	if err != nil {
+		return err
+	}
+
+	return os.Mkdir(fullPath, 0755)
+}
+
+func (s *shareFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	isWrite := flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0
+
+	permission := "read"
+	if isWrite {
+		permission = "write"
+	}
+
+	fullPath, err := s.resolve(name, permission)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isWrite {
+		file, err := os.Open(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		return &shareFile{File: file, fs: s, fullPath: fullPath}, nil
+	}
+
+	// How much will be written isn't known up front, so whatever's left is set aside until the file is closed
+	reserved, release, err := reserveQuota(s.h, s.user.ID, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	_, statErr := os.Stat(fullPath)
+	existed := statErr == nil
+
+	// Opened without truncating first, so if the open fails the file is left as it was
+	file, err := os.OpenFile(fullPath, flag&^os.O_TRUNC, 0644)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	// Keep whatever this overwrites
+	if flag&os.O_TRUNC != 0 && existed {
+		err = preserveVersionCopy(s.h, s.user.ID, sharePath(fullPath), fullPath)
+		if err == nil {
+			err = file.Truncate(0)
+		}
+		if err != nil {
+			file.Close()
+			release()
+			return nil, err
+		}
+	}
+
+	return &shareFile{File: file, fs: s, fullPath: fullPath, isWrite: true, remaining: reserved, release: release}, nil
+}
+
+func (s *shareFS) RemoveAll(ctx context.Context, name string) error {
+	fullPath, err := s.resolve(name, "delete")
+	if err != nil {
+		return err
+	}
+
+	if fullPath == filepath.Clean(homeShareRoot()) {
+		return os.ErrPermission
+	}
+
+	// Deleted through a mount goes to the trash the same as anything else
+	_, err = moveToTrash(s.h, s.user.ID, sharePath(fullPath), fullPath)
+	return err
+}
+
+func (s *shareFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldPath, err := s.resolve(oldName, "delete")
+	if err != nil {
+		return err
+	}
+
+	newPath, err := s.resolve(newName, "write")
+	if err != nil {
+		return err
+	}
+
+	if oldPath == filepath.Clean(homeShareRoot()) {
+		return os.ErrPermission
+	}
+
+	info, err := os.Stat(oldPath)
+	if err != nil {
+		return err
+	}
+
+	// Renaming onto something replaces it, which needs the same permission as deleting it and sends it to the trash
+	if _, err := os.Stat(newPath); err == nil {
+		_, err = s.resolve(newName, "delete")
+		if err != nil {
+			return err
+		}
+
+		err = moveOver(s.h, s.user.ID, oldPath, newPath)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = moveItem(oldPath, newPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !info.IsDir() {
+		err = moveThumbnail(oldPath, newPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = moveRecordedFiles(s.h, oldPath, newPath)
+	if err != nil {
+		return err
+	}
+
+	return moveVersions(s.h, oldPath, newPath)
+}
+
+// Changes the size of a file, keeping what it had as a version and holding any growth to the quota
+func (s *shareFS) Truncate(name string, size int64) error {
+	fullPath, err := s.resolve(name, "write")
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return os.ErrInvalid
+	}
+	if size == info.Size() {
+		return nil
+	}
+
+	if size > info.Size() {
+		reserved, release, err := reserveQuota(s.h, s.user.ID, size-info.Size())
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		if reserved >= 0 && size-info.Size() > reserved {
+			return errQuotaExceeded
+		}
+	}
+
+	if info.Size() > 0 {
+		err = preserveVersionCopy(s.h, s.user.ID, sharePath(fullPath), fullPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Truncate(fullPath, size)
+	if err != nil {
+		return err
+	}
+
+	return recordFile(s.h, s.user.ID, fullPath)
+}
+
+func (s *shareFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fullPath, err := s.resolve(name, "read")
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Stat(fullPath)
+}
+
+// A file opened over WebDAV or SFTP. Listings leave out what the user can't see, writes
+// are held to their quota, and a written file is finished like any other upload.
+type shareFile struct {
+	*os.File
+	fs        *shareFS
+	fullPath  string
+	isWrite   bool
+	remaining int64  // Left of the quota set aside for writing, -1 with no hard limit
+	release   func() // Gives back the quota set aside
+}
+
+func (f *shareFile) Readdir(count int) ([]fs.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+
+	visible := []fs.FileInfo{}
+	for _, info := range infos {
+		if shareHiddenNames[info.Name()] || !f.fs.rules.allows(filepath.Join(f.fullPath, info.Name()), "read") {
+			continue
+		}
+		visible = append(visible, info)
+	}
+
+	return visible, err
+}
+
+// Takes n bytes off what's left of the quota, failing if there isn't enough
+func (f *shareFile) claim(n int) error {
+	if f.remaining >= 0 {
+		if int64(n) > f.remaining {
+			return errQuotaExceeded
+		}
+		f.remaining -= int64(n)
+	}
+	return nil
+}
+
+func (f *shareFile) Write(b []byte) (int, error) {
+	err := f.claim(len(b))
+	if err != nil {
+		return 0, err
+	}
+
+	return f.File.Write(b)
+}
+
+func (f *shareFile) WriteAt(b []byte, offset int64) (int, error) {
+	err := f.claim(len(b))
+	if err != nil {
+		return 0, err
+	}
+
+	return f.File.WriteAt(b, offset)
+}
+
+func (f *shareFile) Close() error {
+	err := f.File.Close()
+	if !f.isWrite {
+		return err
+	}
+
+	// Once what was written has been recorded it counts against the quota on its own
+	defer f.release()
+
+	if err != nil {
+		return err
+	}
+
+	err = finishUpload(f.fullPath)
+	if err != nil {
+		return err
+	}
+
+	return recordFile(f.fs.h, f.fs.user.ID, f.fullPath)
+}
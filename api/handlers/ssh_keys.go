@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/ssh"
+)
+
+type GetSSHKeysResponse struct {
+	Keys []models.SSHKey `json:"keys"`
+}
+
+// @Router /account/ssh-keys [get]
+// @Tags auth
+// @Summary SSH Keys
+// @Description List the public keys that can log in to SFTP as the user
+// @Produce json
+// @Success 200 {object} GetSSHKeysResponse "SSH Keys"
+func (h *Handler) GetSSHKeysHandler(w http.ResponseWriter, r *http.Request) {
+	user := homeshareUser(h, r)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	response := GetSSHKeysResponse{
+		Keys: []models.SSHKey{},
+	}
+
+	result := h.DB.Where("user_id = ?", user.ID).Order("created_at").Find(&response.Keys)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+type AddSSHKeyRequest struct {
+	Name      string `json:"name"`
+	PublicKey string `json:"publicKey"` // A line from authorized_keys or an id_*.pub file
+}
+
+// @Router /account/ssh-keys [post]
+// @Tags auth
+// @Summary Add SSH Key
+// @Description Let a public key log in to SFTP as the user
+// @Accept json
+// @Produce json
+// @Param body body AddSSHKeyRequest true "Body"
+// @Success 201 {object} models.SSHKey "SSH Key"
+func (h *Handler) AddSSHKeyHandler(w http.ResponseWriter, r *http.Request) {
+	user := homeshareUser(h, r)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var addSSHKeyRequest AddSSHKeyRequest
+	err := json.NewDecoder(r.Body).Decode(&addSSHKeyRequest)
+	if err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	publicKey, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(addSSHKeyRequest.PublicKey))
+	if err != nil {
+		http.Error(w, "Invalid public key", http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(addSSHKeyRequest.Name)
+	if name == "" {
+		name = comment
+	}
+
+	fingerprint := ssh.FingerprintSHA256(publicKey)
+
+	var count int64
+	h.DB.Model(&models.SSHKey{}).Where("fingerprint = ?", fingerprint).Count(&count)
+	if count > 0 {
+		http.Error(w, "Key already added", http.StatusConflict)
+		return
+	}
+
+	key := models.SSHKey{
+		UserID:      user.ID,
+		Name:        name,
+		PublicKey:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))),
+		Fingerprint: fingerprint,
+	}
+
+	result := h.DB.Create(&key)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(key)
+}
+
+// @Router /account/ssh-keys/{keyId} [delete]
+// @Tags auth
+// @Summary Delete SSH Key
+// @Description Stop a public key from logging in to SFTP
+// @Param keyId path int true "SSH Key ID"
+// @Success 200
+func (h *Handler) DeleteSSHKeyHandler(w http.ResponseWriter, r *http.Request) {
+	user := homeshareUser(h, r)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	keyId := vars["keyId"]
+
+	// Hard delete so the key can be added again
+	result := h.DB.Unscoped().Where("user_id = ?", user.ID).Delete(&models.SSHKey{}, keyId)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if result.RowsAffected == 0 {
+		http.Error(w, "SSH key not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
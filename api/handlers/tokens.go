@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+	"github.com/gorilla/mux"
+)
+
+const apiTokenPrefix = "hsd_"
+
+// How much each token scope allows, a scope allows everything the ones below it do
+var tokenScopeLevels = map[string]int{
+	"read-only":  1,
+	"read-write": 2,
+	"admin":      3,
+}
+
+// Methods a read-only token can use, WebDAV's PROPFIND included
+var readOnlyMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	"PROPFIND":         true,
+}
+
+// Anything that changes how an account logs in needs the session, so a token can't mint more credentials
+var sessionOnlyPaths = []string{
+	"/account/tokens",
+	"/account/password",
+	"/account/ssh-keys",
+	"/account/s3-keys",
+	"/account/2fa",
+	"/account/passkeys",
+	"/account/sessions",
+}
+
+type contextKey string
+
+const apiTokenContextKey contextKey = "apiToken"
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// The token a request was authenticated with, nil if it's using the session
+func requestAPIToken(r *http.Request) *models.APIToken {
+	token, _ := r.Context().Value(apiTokenContextKey).(*models.APIToken)
+	return token
+}
+
+// The id of the user making a request, from its bearer token or else its session, 0 if there's neither
+func requestUserID(h *Handler, r *http.Request) uint {
+	token := requestAPIToken(r)
+	if token != nil {
+		return token.UserID
+	}
+
+	session, err := h.Store.Get(r, "session")
+	if err != nil {
+		return 0
+	}
+
+	userID, _ := session.Values["id"].(uint)
+	return userID
+}
+
+// The token a raw token belongs to, nil if there isn't one or it has expired
+func findAPIToken(h *Handler, raw string) *models.APIToken {
+	var token models.APIToken
+	result := h.DB.Where("token_hash = ?", hashAPIToken(raw)).First(&token)
+	if result.Error != nil || (token.ExpiresAt != nil && token.ExpiresAt.Before(time.Now())) {
+		return nil
+	}
+	return &token
+}
+
+// Whether a token's scope lets it make a request
+func tokenAllows(token *models.APIToken, r *http.Request) bool {
+	level := tokenScopeLevels[token.Scope]
+	isAllowed := level >= tokenScopeLevels["read-write"] || readOnlyMethods[r.Method]
+	if strings.HasPrefix(r.URL.Path, "/admin/") {
+		isAllowed = level >= tokenScopeLevels["admin"]
+	}
+	for _, path := range sessionOnlyPaths {
+		if strings.HasPrefix(r.URL.Path, path) {
+			isAllowed = false
+		}
+	}
+	return isAllowed
+}
+
+// Records when a token was last used, once a minute is close enough rather than a write on every request
+func touchAPIToken(h *Handler, token *models.APIToken) {
+	now := time.Now()
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) > time.Minute {
+		h.DB.Model(token).Update("last_used_at", now)
+	}
+}
+
+// Authenticates requests carrying an Authorization: Bearer token, holding them to the token's scope.
+// Requests without one carry on to use the session cookie.
+func (h *Handler) BearerTokenMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		if !strings.HasPrefix(authorization, "Bearer ") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := findAPIToken(h, strings.TrimPrefix(authorization, "Bearer "))
+		if token == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if !tokenAllows(token, r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		touchAPIToken(h, token)
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiTokenContextKey, token)))
+	})
+}
+
+type GetAPITokensResponse struct {
+	Tokens []models.APIToken `json:"tokens"`
+}
+
+// @Router /account/tokens [get]
+// @Tags auth
+// @Summary API Tokens
+// @Description List the user's personal access tokens
+// @Produce json
+// @Success 200 {object} GetAPITokensResponse "API Tokens"
+func (h *Handler) GetAPITokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := homeshareUser(h, r)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	response := GetAPITokensResponse{
+		Tokens: []models.APIToken{},
+	}
+
+	result := h.DB.Where("user_id = ?", user.ID).Order("created_at").Find(&response.Tokens)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+type CreateAPITokenRequest struct {
+	Name      string     `json:"name"`
+	Scope     string     `json:"scope"` // read-only, read-write or admin
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+type CreateAPITokenResponse struct {
+	models.APIToken
+	Token string `json:"token"` // Only ever shown here
+}
+
+// @Router /account/tokens [post]
+// @Tags auth
+// @Summary Create API Token
+// @Description Create a personal access token to send as an Authorization: Bearer header
+// @Accept json
+// @Produce json
+// @Param body body CreateAPITokenRequest true "Body"
+// @Success 201 {object} CreateAPITokenResponse "API Token"
+func (h *Handler) CreateAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	user := homeshareUser(h, r)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var createAPITokenRequest CreateAPITokenRequest
+	err := json.NewDecoder(r.Body).Decode(&createAPITokenRequest)
+	if err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(createAPITokenRequest.Name)
+	if name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := tokenScopeLevels[createAPITokenRequest.Scope]; !ok {
+		http.Error(w, "Invalid scope", http.StatusBadRequest)
+		return
+	}
+
+	if createAPITokenRequest.Scope == "admin" && !user.IsAdmin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if createAPITokenRequest.ExpiresAt != nil && createAPITokenRequest.ExpiresAt.Before(time.Now()) {
+		http.Error(w, "Expiry must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	secret, err := GenerateToken(32)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	token := apiTokenPrefix + secret
+
+	apiToken := models.APIToken{
+		UserID:    user.ID,
+		Name:      name,
+		TokenHash: hashAPIToken(token),
+		Prefix:    token[:len(apiTokenPrefix)+8],
+		Scope:     createAPITokenRequest.Scope,
+		ExpiresAt: createAPITokenRequest.ExpiresAt,
+	}
+
+	result := h.DB.Create(&apiToken)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreateAPITokenResponse{
+		APIToken: apiToken,
+		Token:    token,
+	})
+}
+
+// @Router /account/tokens/{tokenId} [delete]
+// @Tags auth
+// @Summary Revoke API Token
+// @Description Revoke a personal access token
+// @Param tokenId path int true "API Token ID"
+// @Success 200
+func (h *Handler) DeleteAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	user := homeshareUser(h, r)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	tokenId := vars["tokenId"]
+
+	result := h.DB.Unscoped().Where("user_id = ?", user.ID).Delete(&models.APIToken{}, tokenId)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if result.RowsAffected == 0 {
+		http.Error(w, "API token not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+)
+
+func TestTokenAllows(t *testing.T) {
+	tests := []struct {
+		scope  string
+		method string
+		path   string
+		want   bool
+	}{
+		{"read-only", http.MethodGet, "/directory-contents", true},
+		{"read-only", http.MethodHead, "/download", true},
+		{"read-only", "PROPFIND", "/dav/", true},
+		{"read-only", http.MethodPost, "/upload", false},
+		{"read-only", http.MethodDelete, "/delete-item", false},
+		{"read-only", "PUT", "/dav/a.txt", false},
+		{"read-write", http.MethodPost, "/upload", true},
+		{"read-write", "MOVE", "/dav/a.txt", true},
+		{"admin", http.MethodDelete, "/delete-item", true},
+
+		// Admin endpoints need an admin token, whatever the method
+		{"read-only", http.MethodGet, "/admin/users", false},
+		{"read-write", http.MethodGet, "/admin/users", false},
+		{"admin", http.MethodGet, "/admin/users", true},
+		{"admin", http.MethodPost, "/admin/settings", true},
+
+		// Nothing that changes how the account logs in, even for admin tokens
+		{"admin", http.MethodPost, "/account/tokens", false},
+		{"admin", http.MethodGet, "/account/tokens", false},
+		{"read-write", http.MethodPost, "/account/password", false},
+		{"admin", http.MethodDelete, "/account/passkeys/1", false},
+		{"admin", http.MethodDelete, "/account/sessions", false},
+
+		{"unknown", http.MethodPost, "/upload", false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		got := tokenAllows(&models.APIToken{Scope: test.scope}, r)
+		if got != test.want {
+			t.Errorf("%s %s %s: got %v, want %v", test.scope, test.method, test.path, got, test.want)
+		}
+	}
+}
+
+func TestFindAPIToken(t *testing.T) {
+	h := newTestHandler(t)
+	user := createTestUser(t, h, "alice", false)
+
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+
+	h.DB.Create(&models.APIToken{UserID: user.ID, Name: "current", TokenHash: hashAPIToken(apiTokenPrefix + "current"), Scope: "read-only"})
+	h.DB.Create(&models.APIToken{UserID: user.ID, Name: "later", TokenHash: hashAPIToken(apiTokenPrefix + "later"), Scope: "read-only", ExpiresAt: &future})
+	h.DB.Create(&models.APIToken{UserID: user.ID, Name: "expired", TokenHash: hashAPIToken(apiTokenPrefix + "expired"), Scope: "read-only", ExpiresAt: &past})
+
+	tests := []struct {
+		raw  string
+		want bool
+	}{
+		{apiTokenPrefix + "current", true},
+		{apiTokenPrefix + "later", true},
+		{apiTokenPrefix + "expired", false},
+		{apiTokenPrefix + "unknown", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		got := findAPIToken(h, test.raw) != nil
+		if got != test.want {
+			t.Errorf("%q: got %v, want %v", test.raw, got, test.want)
+		}
+	}
+}
+
+// Admin rights only carry over to file access through an admin token
+func TestRequestAccessRulesTokenScope(t *testing.T) {
+	h := newTestHandler(t)
+	admin := createTestUser(t, h, "admin", true)
+
+	tests := []struct {
+		scope string
+		want  bool
+	}{
+		{"read-only", false},
+		{"read-write", false},
+		{"admin", true},
+	}
+
+	for _, test := range tests {
+		r := asTestUser(httptest.NewRequest(http.MethodGet, "/directory-contents", nil), admin, test.scope)
+
+		rules, err := requestAccessRules(h, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rules.isAdmin != test.want {
+			t.Errorf("%s: got isAdmin %v, want %v", test.scope, rules.isAdmin, test.want)
+		}
+	}
+}
@@ -0,0 +1,495 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+	"github.com/gorilla/mux"
+)
+
+const trashDirName = ".trash"
+
+// Trashed items live in {share root}/.trash/{token}/{name}, with the thumbnail of a
+// file kept next to it in {share root}/.trash/{token}/.thumbnails/{name}
+func trashItemPath(item *models.TrashItem) string {
+	return filepath.Join(homeShareRoot(), trashDirName, item.Token, item.Name)
+}
+
+func itemSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// Moves an item and its thumbnail into the trash instead of deleting it
+func moveToTrash(h *Handler, userID uint, path string, itemPath string) (*models.TrashItem, error) {
+	info, err := os.Stat(itemPath)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := GenerateToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	item := models.TrashItem{
+		Token:           token,
+		OriginalPath:    path,
+		Name:            info.Name(),
+		IsDir:           info.IsDir(),
+		Size:            itemSize(itemPath),
+		DeletedByUserID: userID,
+		TrashedAt:       time.Now(),
+	}
+
+	// The row goes in first, so an item is never in the trash without one to restore it by
+	result := h.DB.Create(&item)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	trashPath := trashItemPath(&item)
+	err = os.MkdirAll(filepath.Dir(trashPath), 0755)
+	if err == nil {
+		err = moveItem(itemPath, trashPath)
+	}
+	if err != nil {
+		os.Remove(filepath.Dir(trashPath))
+		h.DB.Unscoped().Delete(&item)
+		return nil, err
+	}
+
+	// Versions go with it, to come back if it's restored
+	err = moveRecordedFiles(h, itemPath, trashPath)
+	if err == nil {
+		err = moveVersions(h, itemPath, trashPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		err = moveThumbnail(itemPath, trashPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &item, nil
+}
+
+// Puts the item at stagedPath in place of the one at itemPath, which goes to the trash so it can be got back.
+// Both are in the same directory, so once the old one is out of the way taking its place is a single rename.
+func replaceItem(h *Handler, userID uint, stagedPath string, itemPath string) error {
+	if _, err := os.Stat(itemPath); err == nil {
+		_, err = moveToTrash(h, userID, sharePath(filepath.Clean(itemPath)), itemPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(stagedPath, itemPath)
+}
+
+// Moves the item at src to dst, sending whatever is at dst to the trash only once the move has worked
+func moveOver(h *Handler, userID uint, src string, dst string) error {
+	stagedPath, err := stagingPath(dst)
+	if err != nil {
+		return err
+	}
+
+	err = moveItem(src, stagedPath)
+	if err != nil {
+		return err
+	}
+
+	err = replaceItem(h, userID, stagedPath, dst)
+	if err != nil {
+		moveItem(stagedPath, src)
+		return err
+	}
+
+	return nil
+}
+
+// Permanently deletes a trashed item from disk and the database
+func purgeTrashItem(h *Handler, item *models.TrashItem) error {
+	err := os.RemoveAll(filepath.Dir(trashItemPath(item)))
+	if err != nil {
+		return err
+	}
+
+	err = forgetFiles(h, trashItemPath(item))
+	if err != nil {
+		return err
+	}
+
+	err = deleteVersions(h, trashItemPath(item))
+	if err != nil {
+		return err
+	}
+
+	return h.DB.Unscoped().Delete(item).Error
+}
+
+// Claims a name for a new item by creating it empty, path itself if it's free, otherwise the first free one of
+// "name (1).ext", "name (2).ext" and so on. Two items can't end up with the same name, whichever is created first has it.
+func reserveAvailablePath(path string, isDir bool) (string, error) {
+	extension := filepath.Ext(path)
+	base := strings.TrimSuffix(path, extension)
+
+	candidate := path
+	for i := 1; ; i++ {
+		var err error
+		if isDir {
+			err = os.Mkdir(candidate, 0755)
+		} else {
+			var file *os.File
+			file, err = os.OpenFile(candidate, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+			if err == nil {
+				err = file.Close()
+			}
+		}
+		if err == nil {
+			return candidate, nil
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+
+		candidate = fmt.Sprintf("%s (%d)%s", base, i, extension)
+	}
+}
+
+type TrashItemResponse struct {
+	models.TrashItem
+	DeletedBy string `json:"deletedBy"`
+}
+
+type GetTrashResponse struct {
+	Items []TrashItemResponse `json:"items"`
+}
+
+// @Router /trash [get]
+// @Tags trash
+// @Summary Trash
+// @Description List deleted items that can still be restored
+// @Produce json
+// @Param scope query string false "shared (default) or personal"
+// @Success 200 {object} GetTrashResponse "Trash"
+func (h *Handler) GetTrashHandler(w http.ResponseWriter, r *http.Request) {
+	isAuthorized := CheckCanHomeshare(h, r)
+	if !isAuthorized {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	root, ok := scopeRoot(h, w, r)
+	if !ok {
+		return
+	}
+
+	var items []models.TrashItem
+	result := h.DB.Preload("DeletedBy").Order("trashed_at desc").Find(&items)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := GetTrashResponse{
+		Items: []TrashItemResponse{},
+	}
+
+	canRead := readableFilter(h, r)
+
+	for _, item := range items {
+		itemPath := processPath(homeShareRoot() + item.OriginalPath)
+		if !inScope(root, itemPath) || !canRead(itemPath) {
+			continue
+		}
+
+		item.OriginalPath = scopePath(root, itemPath)
+		response.Items = append(response.Items, TrashItemResponse{
+			TrashItem: item,
+			DeletedBy: item.DeletedBy.Username,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+type RestoreTrashItemRequest struct {
+	// What to do if something already exists at the original path: fail (default), rename or overwrite
+	Conflict string `json:"conflict"`
+}
+
+type RestoreTrashItemResponse struct {
+	Path string `json:"path"`
+}
+
+// @Router /trash/{itemId}/restore [post]
+// @Tags trash
+// @Summary Restore Trash Item
+// @Description Move a deleted item back to where it was deleted from
+// @Accept json
+// @Produce json
+// @Param itemId path int true "Trash Item ID"
+// @Param body body RestoreTrashItemRequest false "Body"
+// @Success 200 {object} RestoreTrashItemResponse "Restored Item"
+func (h *Handler) RestoreTrashItemHandler(w http.ResponseWriter, r *http.Request) {
+	isAuthorized := CheckCanHomeshare(h, r)
+	if !isAuthorized {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	itemId := vars["itemId"]
+
+	var restoreRequest RestoreTrashItemRequest
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&restoreRequest)
+		if err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var item models.TrashItem
+	result := h.DB.First(&item, itemId)
+	if result.Error != nil {
+		http.Error(w, "Trash item not found", http.StatusNotFound)
+		return
+	}
+
+	restorePath := processPath(homeShareRoot() + item.OriginalPath)
+
+	if !checkPathInRoot(restorePath) {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	if !CheckPermission(h, r, restorePath, "write") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	isOverwrite := false
+	if _, err := os.Stat(restorePath); err == nil {
+		switch restoreRequest.Conflict {
+		case "rename":
+			// A free name next to it is claimed below
+		case "overwrite":
+			// What it replaces goes to the trash, the same as with move and copy
+			if !CheckPermission(h, r, restorePath, "delete") {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			isOverwrite = true
+		default:
+			http.Error(w, "An item already exists at "+unscopedPath(item.OriginalPath), http.StatusConflict)
+			return
+		}
+	}
+
+	// The directory it was deleted from may have been deleted since
+	err := os.MkdirAll(filepath.Dir(restorePath), 0755)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	trashPath := trashItemPath(&item)
+
+	if isOverwrite {
+		err = moveOver(h, requestUserID(h, r), trashPath, restorePath)
+	} else {
+		// Claims the name first, so another restore can't take it in the meantime
+		var reservedPath string
+		reservedPath, err = reserveAvailablePath(restorePath, item.IsDir)
+		if err == nil && reservedPath != restorePath && restoreRequest.Conflict != "rename" {
+			os.Remove(reservedPath)
+			http.Error(w, "An item already exists at "+unscopedPath(item.OriginalPath), http.StatusConflict)
+			return
+		}
+		if err == nil {
+			restorePath = reservedPath
+
+			// A directory can't be renamed onto another, so the empty one holding the name makes way. If anything
+			// takes the name in between, the move fails rather than replacing it.
+			if item.IsDir {
+				os.Remove(restorePath)
+			}
+
+			err = moveItem(trashPath, restorePath)
+			if err != nil && !item.IsDir {
+				os.Remove(restorePath)
+			}
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = moveRecordedFiles(h, trashPath, restorePath)
+	if err == nil {
+		err = moveVersions(h, trashPath, restorePath)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !item.IsDir {
+		err = moveThumbnail(trashPath, restorePath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = purgeTrashItem(h, &item)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := RestoreTrashItemResponse{
+		Path: unscopedPath(sharePath(restorePath)),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// @Router /trash/{itemId} [delete]
+// @Tags trash
+// @Summary Purge Trash Item
+// @Description Permanently delete an item in the trash
+// @Param itemId path int true "Trash Item ID"
+// @Success 200
+func (h *Handler) PurgeTrashItemHandler(w http.ResponseWriter, r *http.Request) {
+	isAuthorized := CheckCanHomeshare(h, r)
+	if !isAuthorized {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	itemId := vars["itemId"]
+
+	var item models.TrashItem
+	result := h.DB.First(&item, itemId)
+	if result.Error != nil {
+		http.Error(w, "Trash item not found", http.StatusNotFound)
+		return
+	}
+
+	if !CheckPermission(h, r, processPath(homeShareRoot()+item.OriginalPath), "delete") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	err := purgeTrashItem(h, &item)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// @Router /trash [delete]
+// @Tags trash
+// @Summary Empty Trash
+// @Description Permanently delete everything in the trash of a scope the user is allowed to delete
+// @Param scope query string false "shared (default) or personal"
+// @Success 200
+func (h *Handler) EmptyTrashHandler(w http.ResponseWriter, r *http.Request) {
+	isAuthorized := CheckCanHomeshare(h, r)
+	if !isAuthorized {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	root, ok := scopeRoot(h, w, r)
+	if !ok {
+		return
+	}
+
+	var items []models.TrashItem
+	result := h.DB.Find(&items)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rules, err := requestAccessRules(h, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rules == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	for _, item := range items {
+		itemPath := processPath(homeShareRoot() + item.OriginalPath)
+
+		// Only what the user could have deleted themselves
+		if !inScope(root, itemPath) || !rules.allows(itemPath, "delete") {
+			continue
+		}
+
+		err := purgeTrashItem(h, &item)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Periodically purges items that have been in the trash longer than the retention period
+func (h *Handler) SweepTrash(interval time.Duration) {
+	for {
+		settings, err := models.GetSettings(h.DB)
+		if err != nil {
+			log.Printf("Error loading settings: %v", err)
+		}
+
+		// A retention of 0 days keeps trash until it's emptied by hand
+		if err == nil && settings.TrashRetentionDays > 0 {
+			cutoff := time.Now().AddDate(0, 0, -settings.TrashRetentionDays)
+
+			var items []models.TrashItem
+			h.DB.Where("trashed_at < ?", cutoff).Find(&items)
+
+			for _, item := range items {
+				err = purgeTrashItem(h, &item)
+				if err != nil {
+					log.Printf("Error purging trash item %d: %v", item.ID, err)
+				}
+			}
+		}
+
+		time.Sleep(interval)
+	}
+}
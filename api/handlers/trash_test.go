@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+	"github.com/gorilla/mux"
+)
+
+func TestReserveAvailablePath(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "taken.txt"), nil, 0644)
+	os.WriteFile(filepath.Join(dir, "full.txt"), nil, 0644)
+	os.WriteFile(filepath.Join(dir, "full (1).txt"), nil, 0644)
+	os.Mkdir(filepath.Join(dir, "folder"), 0755)
+
+	tests := []struct {
+		name  string
+		isDir bool
+		want  string
+	}{
+		{"free.txt", false, "free.txt"},
+		{"taken.txt", false, "taken (1).txt"},
+		{"full.txt", false, "full (2).txt"},
+		{"folder", true, "folder (1)"},
+	}
+
+	for _, test := range tests {
+		got, err := reserveAvailablePath(filepath.Join(dir, test.name), test.isDir)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got != filepath.Join(dir, test.want) {
+			t.Errorf("%s: got %s, want %s", test.name, filepath.Base(got), test.want)
+		}
+
+		info, err := os.Stat(got)
+		if err != nil || info.IsDir() != test.isDir {
+			t.Errorf("%s: %s wasn't claimed", test.name, test.want)
+		}
+	}
+}
+
+func TestMoveToTrashKeepsOriginalPath(t *testing.T) {
+	h := newTestHandler(t)
+	user := createTestUser(t, h, "alice", false)
+
+	fullPath := writeTestFile(t, "/docs/a.txt", "contents")
+	err := recordFile(h, user.ID, fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := moveToTrash(h, user.ID, "/docs/a.txt", fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(fullPath); !os.IsNotExist(err) {
+		t.Error("the file is still where it was")
+	}
+	if readTestFile(t, trashItemPath(item)) != "contents" {
+		t.Error("the file isn't in the trash")
+	}
+	if item.OriginalPath != "/docs/a.txt" || item.Name != "a.txt" {
+		t.Errorf("got %s and %s, want /docs/a.txt and a.txt", item.OriginalPath, item.Name)
+	}
+
+	// Usage follows it into the trash
+	var stored models.StoredFile
+	result := h.DB.Where("path = ?", storedFilePath(trashItemPath(item))).First(&stored)
+	if result.Error != nil {
+		t.Error("the recorded file wasn't moved with it")
+	}
+}
+
+func restoreTestItem(h *Handler, user *models.User, item *models.TrashItem, conflict string) *httptest.ResponseRecorder {
+	body := strings.NewReader(`{"conflict":"` + conflict + `"}`)
+	r := httptest.NewRequest(http.MethodPost, "/trash/"+strconv.Itoa(int(item.ID))+"/restore", body)
+	r = mux.SetURLVars(asTestUser(r, user, "read-write"), map[string]string{"itemId": strconv.Itoa(int(item.ID))})
+
+	w := httptest.NewRecorder()
+	h.RestoreTrashItemHandler(w, r)
+	return w
+}
+
+func TestRestoreTrashItemConflicts(t *testing.T) {
+	tests := []struct {
+		conflict   string
+		wantStatus int
+		wantPath   string
+	}{
+		{"", http.StatusConflict, ""},
+		{"rename", http.StatusOK, "/a (1).txt"},
+		{"overwrite", http.StatusOK, "/a.txt"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.conflict, func(t *testing.T) {
+			h := newTestHandler(t)
+			user := createTestUser(t, h, "alice", false)
+
+			fullPath := writeTestFile(t, "/a.txt", "trashed")
+			item, err := moveToTrash(h, user.ID, "/a.txt", fullPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, "/a.txt", "replacement")
+
+			w := restoreTestItem(h, user, item, test.conflict)
+			if w.Code != test.wantStatus {
+				t.Fatalf("got %d, want %d: %s", w.Code, test.wantStatus, w.Body.String())
+			}
+			if test.wantStatus != http.StatusOK {
+				return
+			}
+
+			var response RestoreTrashItemResponse
+			json.NewDecoder(w.Body).Decode(&response)
+			if response.Path != test.wantPath {
+				t.Errorf("restored to %s, want %s", response.Path, test.wantPath)
+			}
+			if readTestFile(t, processPath(homeShareRoot()+test.wantPath)) != "trashed" {
+				t.Error("the restored file doesn't have its contents")
+			}
+
+			// Overwriting sends what was there to the trash rather than deleting it
+			var trashed []models.TrashItem
+			h.DB.Find(&trashed)
+			if test.conflict == "overwrite" {
+				if len(trashed) != 1 || readTestFile(t, trashItemPath(&trashed[0])) != "replacement" {
+					t.Error("what the restore replaced isn't in the trash")
+				}
+			} else if len(trashed) != 0 {
+				t.Error("the restored item is still in the trash")
+			}
+		})
+	}
+}
@@ -0,0 +1,503 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+	"github.com/gorilla/mux"
+)
+
+// Resumable uploads implement the tus protocol, https://tus.io/protocols/resumable-upload
+const tusVersion = "1.0.0"
+const tusExtensions = "creation,creation-with-upload,expiration,termination"
+
+// Uploads that haven't received a chunk in this long are abandoned
+var tusUploadLifetime = 24 * time.Hour
+
+func tusStagingPath(token string) string {
+	return filepath.Join(os.Getenv("UPLOAD_DIR"), "tus", token)
+}
+
+// Only one PATCH may write to an upload at a time
+var tusLocks = struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}{locks: map[string]*sync.Mutex{}}
+
+func lockTusUpload(token string) func() {
+	tusLocks.Lock()
+	lock, ok := tusLocks.locks[token]
+	if !ok {
+		lock = &sync.Mutex{}
+		tusLocks.locks[token] = lock
+	}
+	tusLocks.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+func forgetTusLock(token string) {
+	tusLocks.Lock()
+	delete(tusLocks.locks, token)
+	tusLocks.Unlock()
+}
+
+// Upload-Metadata is a comma separated list of "key base64(value)" pairs
+func parseTusMetadata(header string) map[string]string {
+	metadata := map[string]string{}
+
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		if len(parts) == 0 {
+			continue
+		}
+
+		value := ""
+		if len(parts) > 1 {
+			decoded, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				continue
+			}
+			value = string(decoded)
+		}
+
+		metadata[parts[0]] = value
+	}
+
+	return metadata
+}
+
+// Every tus response carries Tus-Resumable and every request but OPTIONS must too
+func checkTusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return false
+	}
+
+	return true
+}
+
+func tusOffset(upload *models.ResumableUpload) (int64, error) {
+	info, err := os.Stat(tusStagingPath(upload.Token))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Moves a staged file into the homeshare at filePath on behalf of userID
+func placeStagedFile(h *Handler, userID uint, stagingPath string, filePath string) error {
+	// Keep whatever this overwrites
+	err := preserveVersion(h, userID, sharePath(filepath.Clean(filePath)), filePath)
+	if err != nil {
+		return err
+	}
+
+	err = moveItem(stagingPath, filePath)
+	if err != nil {
+		return err
+	}
+
+	err = finishUpload(filePath)
+	if err != nil {
+		return err
+	}
+
+	return recordFile(h, userID, filePath)
+}
+
+// Moves a finished upload out of staging and into the homeshare
+func finishResumableUpload(h *Handler, upload *models.ResumableUpload) error {
+	filePath := processPath(homeShareRoot() + upload.Path + PathDelimiter + upload.FileName)
+
+	err := placeStagedFile(h, upload.CreatedUserID, tusStagingPath(upload.Token), filePath)
+	if err != nil {
+		return err
+	}
+
+	forgetTusLock(upload.Token)
+	return h.DB.Unscoped().Delete(upload).Error
+}
+
+// Appends the request body to the staged upload, never writing past its length
+func writeTusChunk(upload *models.ResumableUpload, offset int64, body io.Reader) (int64, error) {
+	file, err := os.OpenFile(tusStagingPath(upload.Token), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return offset, err
+	}
+	defer file.Close()
+
+	written, err := io.Copy(file, io.LimitReader(body, upload.Length-offset))
+	return offset + written, err
+}
+
+// Loads the upload named in the url, making sure it belongs to the caller
+func getResumableUpload(h *Handler, w http.ResponseWriter, r *http.Request) (*models.ResumableUpload, bool) {
+	userID := requestUserID(h, r)
+
+	vars := mux.Vars(r)
+	token := vars["uploadId"]
+
+	var upload models.ResumableUpload
+	result := h.DB.Where("token = ? AND created_user_id = ?", token, userID).First(&upload)
+	if result.Error != nil || upload.ExpiresAt.Before(time.Now()) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	return &upload, true
+}
+
+// @Router /tus/ [options]
+// @Tags homeshare
+// @Summary Resumable Upload Capabilities
+// @Description Report the tus versions and extensions supported
+func (h *Handler) TusOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// @Router /tus/ [post]
+// @Tags homeshare
+// @Summary Create Resumable Upload
+// @Description Create a tus upload. Upload-Metadata must contain filename and the destination path
+// @Param Upload-Length header int true "Total size in bytes"
+// @Param Upload-Metadata header string true "filename and path, base64 encoded"
+// @Param scope query string false "shared (default) or personal"
+// @Success 201
+func (h *Handler) TusCreateHandler(w http.ResponseWriter, r *http.Request) {
+	isAuthorized := CheckCanHomeshare(h, r)
+	if !isAuthorized {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	userID := requestUserID(h, r)
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+
+	metadata := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	path := metadata["path"]
+	fileName := metadata["filename"]
+
+	if fileName == "" || strings.ContainsAny(fileName, "/\\") {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+
+	root, ok := scopeRoot(h, w, r)
+	if !ok {
+		return
+	}
+
+	filePath := processPath(root + path + PathDelimiter + fileName)
+
+	if !checkPathInRoot(filePath) {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	if !CheckPermission(h, r, filePath, "write") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if _, err := os.Stat(filepath.Dir(filePath)); err != nil {
+		http.Error(w, "Destination directory does not exist", http.StatusBadRequest)
+		return
+	}
+
+	// Held while the first chunk is written, the same as for the chunks sent after it
+	reserved, release, err := reserveQuota(h, userID, length)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer release()
+
+	if reserved >= 0 && length > reserved {
+		http.Error(w, errQuotaExceeded.Error(), http.StatusInsufficientStorage)
+		return
+	}
+
+	token, err := GenerateToken(16)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	unlock := lockTusUpload(token)
+	defer unlock()
+
+	stagingPath := tusStagingPath(token)
+	err = os.MkdirAll(filepath.Dir(stagingPath), os.ModePerm)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	stagingFile, err := os.Create(stagingPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	stagingFile.Close()
+
+	upload := models.ResumableUpload{
+		Token:         token,
+		CreatedUserID: userID,
+		Path:          sharePath(filepath.Dir(filepath.Clean(filePath))),
+		FileName:      fileName,
+		Length:        length,
+		ExpiresAt:     time.Now().Add(tusUploadLifetime),
+	}
+
+	result := h.DB.Create(&upload)
+	if result.Error != nil {
+		os.Remove(stagingPath)
+		forgetTusLock(token)
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// creation-with-upload, the first chunk may come along with the request
+	offset := int64(0)
+	if r.Header.Get("Content-Type") == "application/offset+octet-stream" {
+		offset, err = writeTusChunk(&upload, offset, r.Body)
+		if err != nil {
+			log.Printf("Error writing first chunk of upload %s: %v", token, err)
+		}
+	}
+
+	if offset == upload.Length {
+		err = finishResumableUpload(h, &upload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+token)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// @Router /tus/{uploadId} [head]
+// @Tags homeshare
+// @Summary Resumable Upload Offset
+// @Description Get how much of a tus upload the server has, to resume from
+// @Param uploadId path string true "Upload ID"
+// @Success 200
+func (h *Handler) TusHeadHandler(w http.ResponseWriter, r *http.Request) {
+	isAuthorized := CheckCanHomeshare(h, r)
+	if !isAuthorized {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	upload, ok := getResumableUpload(h, w, r)
+	if !ok {
+		return
+	}
+
+	offset, err := tusOffset(upload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// @Router /tus/{uploadId} [patch]
+// @Tags homeshare
+// @Summary Resume Upload
+// @Description Append a chunk to a tus upload at Upload-Offset
+// @Accept application/offset+octet-stream
+// @Param uploadId path string true "Upload ID"
+// @Param Upload-Offset header int true "Offset the chunk starts at"
+// @Success 204
+func (h *Handler) TusPatchHandler(w http.ResponseWriter, r *http.Request) {
+	isAuthorized := CheckCanHomeshare(h, r)
+	if !isAuthorized {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Invalid Content-Type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	upload, ok := getResumableUpload(h, w, r)
+	if !ok {
+		return
+	}
+
+	unlock := lockTusUpload(upload.Token)
+	defer unlock()
+
+	offset, err := tusOffset(upload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	requestOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || requestOffset != offset {
+		http.Error(w, "Upload-Offset does not match", http.StatusConflict)
+		return
+	}
+
+	// Limits may have changed, or other uploads used the space, since the upload was created
+	reserved, release, err := reserveQuota(h, upload.CreatedUserID, upload.Length)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer release()
+
+	if reserved >= 0 && upload.Length > reserved {
+		http.Error(w, errQuotaExceeded.Error(), http.StatusInsufficientStorage)
+		return
+	}
+
+	offset, err = writeTusChunk(upload, offset, r.Body)
+	if err != nil {
+		// Whatever made it to disk is kept, the client resumes from there
+		log.Printf("Error writing chunk of upload %s: %v", upload.Token, err)
+	}
+
+	upload.ExpiresAt = time.Now().Add(tusUploadLifetime)
+	result := h.DB.Save(upload)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if offset == upload.Length {
+		err = finishResumableUpload(h, upload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		setQuotaWarning(h, w, upload.CreatedUserID)
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// @Router /tus/{uploadId} [delete]
+// @Tags homeshare
+// @Summary Cancel Resumable Upload
+// @Description Discard a tus upload and everything received so far
+// @Param uploadId path string true "Upload ID"
+// @Success 204
+func (h *Handler) TusDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	isAuthorized := CheckCanHomeshare(h, r)
+	if !isAuthorized {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	upload, ok := getResumableUpload(h, w, r)
+	if !ok {
+		return
+	}
+
+	unlock := lockTusUpload(upload.Token)
+	defer unlock()
+
+	err := os.Remove(tusStagingPath(upload.Token))
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := h.DB.Unscoped().Delete(upload)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	forgetTusLock(upload.Token)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Discards an expired upload, unless a chunk arrived for it while waiting for the lock
+func expireResumableUpload(h *Handler, upload *models.ResumableUpload) {
+	unlock := lockTusUpload(upload.Token)
+	defer unlock()
+
+	result := h.DB.Where("id = ? AND expires_at < ?", upload.ID, time.Now()).First(upload)
+	if result.Error != nil {
+		return
+	}
+
+	err := os.Remove(tusStagingPath(upload.Token))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing expired upload %s: %v", upload.Token, err)
+		return
+	}
+
+	h.DB.Unscoped().Delete(upload)
+	forgetTusLock(upload.Token)
+}
+
+// Periodically discards uploads that were abandoned part way through
+func (h *Handler) ExpireResumableUploads(interval time.Duration) {
+	for {
+		var uploads []models.ResumableUpload
+		h.DB.Where("expires_at < ?", time.Now()).Find(&uploads)
+
+		for _, upload := range uploads {
+			expireResumableUpload(h, &upload)
+		}
+
+		time.Sleep(interval)
+	}
+}
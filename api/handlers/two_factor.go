@@ -0,0 +1,549 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	totpIssuer = "HomeShareDrive"
+	totpPeriod = 30
+	totpDigits = 6
+
+	recoveryCodeCount = 10
+
+	// How long after the password is checked the second factor has to be given
+	pendingLoginLifetime = 5 * time.Minute
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// The code for a time step, as RFC 6238 with SHA-1 and six digits, which is what authenticator apps expect
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		return "", err
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%06d", value%1000000), nil
+}
+
+// The otpauth:// URI an authenticator app reads, usually from a QR code
+func totpURI(user *models.User, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+
+	label := url.PathEscape(totpIssuer + ":" + user.Username)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// Whether code is the user's current TOTP code, allowing a step either side for clock drift.
+// A code is only good once, so the step it was for is remembered.
+func checkTOTP(h *Handler, user *models.User, secret string, code string) bool {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return false
+	}
+
+	now := time.Now().Unix() / totpPeriod
+	for step := now - 1; step <= now+1; step++ {
+		if step <= user.TOTPLastStep {
+			continue
+		}
+
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return false
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			user.TOTPLastStep = step
+			h.DB.Model(user).Update("totp_last_step", step)
+			return true
+		}
+	}
+
+	return false
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// Replaces a user's recovery codes with new ones, returning them as they're only shown once
+func generateRecoveryCodes(h *Handler, userID uint) ([]string, error) {
+	result := h.DB.Unscoped().Where("user_id = ?", userID).Delete(&models.RecoveryCode{})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	codes := []string{}
+	for i := 0; i < recoveryCodeCount; i++ {
+		token, err := GenerateToken(5)
+		if err != nil {
+			return nil, err
+		}
+		code := token[:5] + "-" + token[5:]
+
+		result = h.DB.Create(&models.RecoveryCode{UserID: userID, CodeHash: hashRecoveryCode(code)})
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		codes = append(codes, code)
+	}
+
+	return codes, nil
+}
+
+// Uses up one of the user's recovery codes if code matches it
+func useRecoveryCode(h *Handler, userID uint, code string) bool {
+	result := h.DB.Unscoped().Where("user_id = ? AND code_hash = ?", userID, hashRecoveryCode(code)).Delete(&models.RecoveryCode{})
+	return result.Error == nil && result.RowsAffected > 0
+}
+
+// Whether code is the user's TOTP code or one of their recovery codes
+func checkSecondFactor(h *Handler, user *models.User, code string) bool {
+	if user.TOTPEnabled && checkTOTP(h, user, user.TOTPSecret, code) {
+		return true
+	}
+	return useRecoveryCode(h, user.ID, code)
+}
+
+func countPasskeys(h *Handler, userID uint) int64 {
+	var count int64
+	h.DB.Model(&models.Passkey{}).Where("user_id = ?", userID).Count(&count)
+	return count
+}
+
+func hasTwoFactor(h *Handler, user *models.User) bool {
+	return user.TOTPEnabled || countPasskeys(h, user.ID) > 0
+}
+
+// The second factors a user can finish logging in with
+func twoFactorMethods(h *Handler, user *models.User) []string {
+	methods := []string{}
+	if countPasskeys(h, user.ID) > 0 {
+		methods = append(methods, "passkey")
+	}
+	if user.TOTPEnabled {
+		methods = append(methods, "totp")
+	}
+	return append(methods, "recovery-code")
+}
+
+// Whether an admin is held back from admin features until they set up two factor authentication
+func adminNeedsTwoFactor(h *Handler, user *models.User) bool {
+	if !user.IsAdmin || hasTwoFactor(h, user) {
+		return false
+	}
+
+	settings, err := models.GetSettings(h.DB)
+	return err == nil && settings.RequireAdminTwoFactor
+}
+
+// Remembers who got their password right without logging them in yet
+func startPendingLogin(session *sessions.Session, user *models.User) {
+	delete(session.Values, "id")
+	session.Values["pendingId"] = user.ID
+	session.Values["pendingAt"] = time.Now().Unix()
+}
+
+// The user partway through logging in, nil if there isn't one or they took too long
+func pendingLoginUser(h *Handler, session *sessions.Session) *models.User {
+	userID, _ := session.Values["pendingId"].(uint)
+	pendingAt, _ := session.Values["pendingAt"].(int64)
+	if userID == 0 || time.Since(time.Unix(pendingAt, 0)) > pendingLoginLifetime {
+		return nil
+	}
+
+	var user models.User
+	result := h.DB.First(&user, userID)
+	if result.Error != nil {
+		return nil
+	}
+	return &user
+}
+
+// Logs the user in on the session
+func finishLogin(w http.ResponseWriter, r *http.Request, session *sessions.Session, user *models.User) error {
+	delete(session.Values, "pendingId")
+	delete(session.Values, "pendingAt")
+	session.Values["id"] = user.ID
+	return session.Save(r, w)
+}
+
+type LoginResponse struct {
+	TwoFactorRequired      bool     `json:"twoFactorRequired"`      // Finish logging in at /login/2fa or /login/passkey
+	TwoFactorMethods       []string `json:"twoFactorMethods"`       // The second factors that can be used
+	TwoFactorSetupRequired bool     `json:"twoFactorSetupRequired"` // An admin who has to set up 2FA before using admin features
+}
+
+type LoginTwoFactorRequest struct {
+	Code string `json:"code"` // A TOTP code or a recovery code
+}
+
+// @Router /login/2fa [post]
+// @Tags auth
+// @Summary Login Second Factor
+// @Description Finish logging in with a TOTP code or a recovery code after the password was accepted
+// @Accept json
+// @Produce json
+// @Param body body LoginTwoFactorRequest true "Body"
+// @Success 200 {object} LoginResponse
+func (h *Handler) LoginTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var loginTwoFactorRequest LoginTwoFactorRequest
+	err := json.NewDecoder(r.Body).Decode(&loginTwoFactorRequest)
+	if err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	session, err := h.Store.Get(r, "session")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	user := pendingLoginUser(h, session)
+	if user == nil {
+		http.Error(w, "Login again", http.StatusUnauthorized)
+		return
+	}
+
+	// Codes are short enough to guess at, so they count towards the same lockout as passwords
+	throttle := checkLoginThrottle(h, "", user, clientIP(r))
+	if throttle != nil {
+		throttle.write(w)
+		return
+	}
+
+	if !checkSecondFactor(h, user, loginTwoFactorRequest.Code) {
+		recordLoginFailure(h, user.Username, user, clientIP(r), "2fa")
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	if isBanned(user) {
+		writeBanned(w, user)
+		return
+	}
+
+	recordLoginSuccess(h, user)
+
+	err = finishLogin(w, r, session, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LoginResponse{TwoFactorMethods: []string{}})
+}
+
+// The logged in user for account endpoints that unverified users can use too
+func accountUser(h *Handler, w http.ResponseWriter, r *http.Request) *models.User {
+	userID := requestUserID(h, r)
+	if userID == 0 {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return nil
+	}
+
+	var user models.User
+	result := h.DB.First(&user, userID)
+	if result.Error != nil {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return nil
+	}
+
+	return &user
+}
+
+type EnrollTOTPResponse struct {
+	Secret string `json:"secret"` // For typing into an authenticator app
+	URI    string `json:"uri"`    // For showing as a QR code
+}
+
+// @Router /account/2fa/totp [post]
+// @Tags auth
+// @Summary Enroll TOTP
+// @Description Start setting up an authenticator app, it isn't turned on until a code from it is verified
+// @Produce json
+// @Success 200 {object} EnrollTOTPResponse
+func (h *Handler) EnrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := accountUser(h, w, r)
+	if user == nil {
+		return
+	}
+
+	if user.TOTPEnabled {
+		http.Error(w, "An authenticator app is already set up", http.StatusConflict)
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := h.DB.Model(user).Update("totp_secret", secret)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(EnrollTOTPResponse{
+		Secret: secret,
+		URI:    totpURI(user, secret),
+	})
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"` // Only ever shown here
+}
+
+// @Router /account/2fa/totp/verify [post]
+// @Tags auth
+// @Summary Verify TOTP
+// @Description Turn on two factor authentication with a code from the authenticator app being set up
+// @Accept json
+// @Produce json
+// @Param body body TwoFactorCodeRequest true "Body"
+// @Success 200 {object} RecoveryCodesResponse
+func (h *Handler) VerifyTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := accountUser(h, w, r)
+	if user == nil {
+		return
+	}
+
+	var codeRequest TwoFactorCodeRequest
+	err := json.NewDecoder(r.Body).Decode(&codeRequest)
+	if err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	if user.TOTPEnabled {
+		http.Error(w, "An authenticator app is already set up", http.StatusConflict)
+		return
+	}
+
+	if user.TOTPSecret == "" {
+		http.Error(w, "Start setting up an authenticator app first", http.StatusBadRequest)
+		return
+	}
+
+	if !checkTOTP(h, user, user.TOTPSecret, codeRequest.Code) {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	result := h.DB.Model(user).Update("totp_enabled", true)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	codes, err := generateRecoveryCodes(h, user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// @Router /account/2fa/totp/disable [post]
+// @Tags auth
+// @Summary Disable TOTP
+// @Description Turn off two factor authentication with a TOTP code or a recovery code
+// @Accept json
+// @Param body body TwoFactorCodeRequest true "Body"
+// @Success 200
+func (h *Handler) DisableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := accountUser(h, w, r)
+	if user == nil {
+		return
+	}
+
+	var codeRequest TwoFactorCodeRequest
+	err := json.NewDecoder(r.Body).Decode(&codeRequest)
+	if err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	if !user.TOTPEnabled {
+		http.Error(w, "Two factor authentication isn't turned on", http.StatusBadRequest)
+		return
+	}
+
+	if !checkSecondFactor(h, user, codeRequest.Code) {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	err = resetTOTP(h, user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// @Router /account/2fa/recovery-codes [post]
+// @Tags auth
+// @Summary Regenerate Recovery Codes
+// @Description Replace the recovery codes with new ones, given a TOTP code or a recovery code
+// @Accept json
+// @Produce json
+// @Param body body TwoFactorCodeRequest true "Body"
+// @Success 200 {object} RecoveryCodesResponse
+func (h *Handler) RegenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	user := accountUser(h, w, r)
+	if user == nil {
+		return
+	}
+
+	var codeRequest TwoFactorCodeRequest
+	err := json.NewDecoder(r.Body).Decode(&codeRequest)
+	if err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	if !hasTwoFactor(h, user) {
+		http.Error(w, "Two factor authentication isn't turned on", http.StatusBadRequest)
+		return
+	}
+
+	if !checkSecondFactor(h, user, codeRequest.Code) {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	codes, err := generateRecoveryCodes(h, user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// Turns off a user's authenticator app, and throws away their recovery codes if it was their last second factor
+func resetTOTP(h *Handler, userID uint) error {
+	result := h.DB.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]any{
+		"totp_secret":    "",
+		"totp_enabled":   false,
+		"totp_last_step": 0,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	return dropUnusedRecoveryCodes(h, userID)
+}
+
+// Throws away a user's recovery codes once they've no second factor left for them to stand in for
+func dropUnusedRecoveryCodes(h *Handler, userID uint) error {
+	var user models.User
+	result := h.DB.First(&user, userID)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if hasTwoFactor(h, &user) {
+		return nil
+	}
+
+	return h.DB.Unscoped().Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error
+}
+
+// @Router /admin/user/{userId}/reset-2fa [post]
+// @Tags admin
+// @Summary Reset Two Factor
+// @Description Turn off a user's two factor authentication and remove their passkeys, for when they've lost their device and recovery codes
+// @Param userId path int true "User ID"
+// @Success 200
+func (h *Handler) ResetTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	isAdmin := CheckIsAdmin(h, r)
+	if !isAdmin {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	userId := vars["userId"]
+
+	var targetUser models.User
+	result := h.DB.First(&targetUser, userId)
+	if result.Error != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	// Passkeys go too, as they're just as likely to have been on the lost device
+	result = h.DB.Unscoped().Where("user_id = ?", targetUser.ID).Delete(&models.Passkey{})
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err := resetTOTP(h, targetUser.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
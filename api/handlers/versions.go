@@ -0,0 +1,422 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+const versionsDirName = ".versions"
+
+func fileVersionPath(version *models.FileVersion) string {
+	return filepath.Join(homeShareRoot(), versionsDirName, version.Token)
+}
+
+// Keeps the current contents of a file as a new version before it's overwritten.
+// Does nothing if there's no file there yet.
+func preserveVersion(h *Handler, userID uint, path string, filePath string) error {
+	return keepVersion(h, userID, path, filePath, moveItem)
+}
+
+// Puts the contents of the file at filePath into a new version of path with keep, which either moves or copies it
+func keepVersion(h *Handler, userID uint, path string, filePath string, keep func(src string, dst string) error) error {
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		return nil
+	}
+
+	token, err := GenerateToken(16)
+	if err != nil {
+		return err
+	}
+
+	var latest models.FileVersion
+	h.DB.Where("path = ?", path).Order("number desc").First(&latest)
+
+	version := models.FileVersion{
+		Token:         token,
+		Path:          path,
+		Number:        latest.Number + 1,
+		Size:          info.Size(),
+		ModTime:       info.ModTime(),
+		CreatedUserID: userID,
+	}
+
+	versionPath := fileVersionPath(&version)
+	err = os.MkdirAll(filepath.Dir(versionPath), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = keep(filePath, versionPath)
+	if err != nil {
+		return err
+	}
+
+	err = moveRecordedFiles(h, filePath, versionPath)
+	if err != nil {
+		return err
+	}
+
+	// The new contents get a new thumbnail
+	thumbnail := thumbnailPath(filePath)
+	if _, err := os.Stat(thumbnail); err == nil {
+		os.Remove(thumbnail)
+	}
+
+	result := h.DB.Create(&version)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	return pruneVersions(h, path)
+}
+
+// Like preserveVersion, but copies the contents so the file itself stays put, for when it's about to be truncated in place
+func preserveVersionCopy(h *Handler, userID uint, path string, filePath string) error {
+	return keepVersion(h, userID, path, filePath, func(src string, dst string) error {
+		_, err := copyFile(src, dst, nil)
+		return err
+	})
+}
+
+// Matches the versions of a path and of everything under it
+func versionsUnder(h *Handler, path string) *gorm.DB {
+	escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(path + PathDelimiter)
+	return h.DB.Model(&models.FileVersion{}).Where("path = ? OR path LIKE ?", path, escaped+"%")
+}
+
+// Keeps the versions of a file, or of the files in a directory, with it when it's moved from src to dst
+func moveVersions(h *Handler, src string, dst string) error {
+	srcPath := sharePath(filepath.Clean(src))
+	dstPath := sharePath(filepath.Clean(dst))
+
+	var versions []models.FileVersion
+	result := versionsUnder(h, srcPath).Find(&versions)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	for _, version := range versions {
+		version.Path = dstPath + strings.TrimPrefix(version.Path, srcPath)
+
+		result = h.DB.Save(&version)
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+
+	return nil
+}
+
+// Deletes the versions of whatever was at or under fullPath once it's gone for good
+func deleteVersions(h *Handler, fullPath string) error {
+	var versions []models.FileVersion
+	result := versionsUnder(h, sharePath(filepath.Clean(fullPath))).Find(&versions)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	for _, version := range versions {
+		err := deleteFileVersion(h, &version)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func deleteFileVersion(h *Handler, version *models.FileVersion) error {
+	err := os.Remove(fileVersionPath(version))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	err = forgetFiles(h, fileVersionPath(version))
+	if err != nil {
+		return err
+	}
+
+	return h.DB.Unscoped().Delete(version).Error
+}
+
+// Applies the retention settings to the versions of a path, or of every path if path is empty
+func pruneVersions(h *Handler, path string) error {
+	settings, err := models.GetSettings(h.DB)
+	if err != nil {
+		return err
+	}
+
+	var expired []models.FileVersion
+
+	if settings.VersionKeepDays > 0 {
+		query := h.DB.Where("created_at < ?", time.Now().AddDate(0, 0, -settings.VersionKeepDays))
+		if path != "" {
+			query = query.Where("path = ?", path)
+		}
+		query.Find(&expired)
+	}
+
+	if settings.VersionKeepCount > 0 {
+		paths := []string{path}
+		if path == "" {
+			paths = []string{}
+			h.DB.Model(&models.FileVersion{}).Distinct().Pluck("path", &paths)
+		}
+
+		for _, versionedPath := range paths {
+			var excess []models.FileVersion
+			h.DB.Where("path = ?", versionedPath).Order("number desc").Offset(settings.VersionKeepCount).Find(&excess)
+			expired = append(expired, excess...)
+		}
+	}
+
+	for _, version := range expired {
+		err = deleteFileVersion(h, &version)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type GetVersionsResponse struct {
+	Path     string               `json:"path"`
+	Versions []models.FileVersion `json:"versions"`
+}
+
+// @Router /versions [get]
+// @Tags versions
+// @Summary File Versions
+// @Description List the previous versions of a file, newest first
+// @Produce json
+// @Param path query string true "Path"
+// @Param scope query string false "shared (default) or personal"
+// @Success 200 {object} GetVersionsResponse "Versions"
+func (h *Handler) GetVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	isAuthorized := CheckCanHomeshare(h, r)
+	if !isAuthorized {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+
+	root, ok := scopeRoot(h, w, r)
+	if !ok {
+		return
+	}
+
+	filePath := processPath(root + path)
+
+	if !checkPathInRoot(filePath) {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	if !CheckPermission(h, r, filePath, "read") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// Versions are recorded under the cleaned path
+	filePath = filepath.Clean(filePath)
+	path = scopePath(root, filePath)
+
+	versions := []models.FileVersion{}
+	result := h.DB.Where("path = ?", sharePath(filePath)).Order("number desc").Find(&versions)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for i := range versions {
+		versions[i].Path = path
+	}
+
+	response := GetVersionsResponse{
+		Path:     path,
+		Versions: versions,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// @Router /versions/{versionId}/download [get]
+// @Tags versions
+// @Summary Download Version
+// @Description Download a previous version of a file
+// @Param versionId path int true "Version ID"
+func (h *Handler) DownloadVersionHandler(w http.ResponseWriter, r *http.Request) {
+	isAuthorized := CheckCanHomeshare(h, r)
+	if !isAuthorized {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	versionId := vars["versionId"]
+
+	var version models.FileVersion
+	result := h.DB.First(&version, versionId)
+	if result.Error != nil {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+
+	filePath := processPath(homeShareRoot() + version.Path)
+
+	// Turns away versions of trashed files too, no access rules cover where they're kept
+	if !checkPathInRoot(filePath) {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	if !CheckPermission(h, r, filePath, "read") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	file, err := os.Open(fileVersionPath(&version))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(version.Path)}))
+	http.ServeContent(w, r, filepath.Base(version.Path), version.ModTime, file)
+}
+
+type RestoreVersionResponse struct {
+	Path string `json:"path"`
+}
+
+// @Router /versions/{versionId}/restore [post]
+// @Tags versions
+// @Summary Restore Version
+// @Description Replace a file with one of its previous versions, the current contents become a new version
+// @Produce json
+// @Param versionId path int true "Version ID"
+// @Success 200 {object} RestoreVersionResponse "Restored File"
+func (h *Handler) RestoreVersionHandler(w http.ResponseWriter, r *http.Request) {
+	isAuthorized := CheckCanHomeshare(h, r)
+	if !isAuthorized {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	userID := requestUserID(h, r)
+
+	vars := mux.Vars(r)
+	versionId := vars["versionId"]
+
+	var version models.FileVersion
+	result := h.DB.First(&version, versionId)
+	if result.Error != nil {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+
+	filePath := processPath(homeShareRoot() + version.Path)
+
+	if !checkPathInRoot(filePath) {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	if !CheckPermission(h, r, filePath, "write") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	reserved, release, err := reserveQuota(h, userID, version.Size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer release()
+
+	if reserved >= 0 && version.Size > reserved {
+		http.Error(w, errQuotaExceeded.Error(), http.StatusInsufficientStorage)
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Copy rather than move, the version being restored stays in the history. It's
+	// copied aside first since keeping the current contents may prune the old version.
+	restoringPath := fileVersionPath(&version) + ".restoring"
+	_, err = copyFile(fileVersionPath(&version), restoringPath, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(restoringPath)
+
+	err = preserveVersion(h, userID, version.Path, filePath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = moveItem(restoringPath, filePath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = finishUpload(filePath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = recordFile(h, userID, filePath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := RestoreVersionResponse{
+		Path: unscopedPath(version.Path),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Periodically applies the version retention settings
+func (h *Handler) PruneVersions(interval time.Duration) {
+	for {
+		err := pruneVersions(h, "")
+		if err != nil {
+			log.Printf("Error pruning versions: %v", err)
+		}
+
+		time.Sleep(interval)
+	}
+}
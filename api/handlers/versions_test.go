@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+	"github.com/gorilla/mux"
+)
+
+func createTestVersion(t *testing.T, h *Handler, user *models.User, path string) *models.FileVersion {
+	t.Helper()
+
+	token, err := GenerateToken(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version := models.FileVersion{
+		Token:         token,
+		Path:          processPath(path),
+		Number:        1,
+		CreatedUserID: user.ID,
+	}
+
+	result := h.DB.Create(&version)
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	return &version
+}
+
+func TestMoveVersions(t *testing.T) {
+	tests := []struct {
+		src  string
+		dst  string
+		path string
+		want string
+	}{
+		{"/a.txt", "/b.txt", "/a.txt", "/b.txt"},
+		{"/dir", "/moved", "/dir/a.txt", "/moved/a.txt"},
+		{"/dir", "/moved", "/dir/sub/a.txt", "/moved/sub/a.txt"},
+
+		// Only what's under src, not everything starting with the same letters
+		{"/dir", "/moved", "/dir2/a.txt", "/dir2/a.txt"},
+		{"/a.txt", "/b.txt", "/a.txt.bak", "/a.txt.bak"},
+
+		// LIKE wildcards in the path match only themselves
+		{"/d_r", "/moved", "/dir/a.txt", "/dir/a.txt"},
+		{"/d%", "/moved", "/dir/a.txt", "/dir/a.txt"},
+	}
+
+	for _, test := range tests {
+		h := newTestHandler(t)
+		user := createTestUser(t, h, "alice", false)
+		version := createTestVersion(t, h, user, test.path)
+
+		err := moveVersions(h, processPath(homeShareRoot()+test.src), processPath(homeShareRoot()+test.dst))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h.DB.First(version, version.ID)
+		if version.Path != processPath(test.want) {
+			t.Errorf("moving %s to %s: %s became %s, want %s", test.src, test.dst, test.path, version.Path, test.want)
+		}
+	}
+}
+
+func TestTrashedVersionsFollowTheFile(t *testing.T) {
+	h := newTestHandler(t)
+	user := createTestUser(t, h, "alice", false)
+
+	fullPath := writeTestFile(t, "/dir/a.txt", "contents")
+	version := createTestVersion(t, h, user, "/dir/a.txt")
+
+	item, err := moveToTrash(h, user.ID, "/dir", processPath(homeShareRoot()+"/dir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.DB.First(version, version.ID)
+	if version.Path != sharePath(trashItemPath(item))+processPath("/a.txt") {
+		t.Fatalf("got %s, want it under the trashed directory", version.Path)
+	}
+
+	w := restoreTestItem(h, user, item, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("restoring: %d %s", w.Code, w.Body.String())
+	}
+
+	h.DB.First(version, version.ID)
+	if version.Path != sharePath(fullPath) {
+		t.Errorf("got %s after restoring, want %s", version.Path, sharePath(fullPath))
+	}
+}
+
+func downloadTestVersion(h *Handler, user *models.User, version *models.FileVersion) int {
+	r := httptest.NewRequest(http.MethodGet, "/versions/"+strconv.Itoa(int(version.ID))+"/download", nil)
+	r = mux.SetURLVars(asTestUser(r, user, "read-only"), map[string]string{"versionId": strconv.Itoa(int(version.ID))})
+
+	w := httptest.NewRecorder()
+	h.DownloadVersionHandler(w, r)
+	return w.Code
+}
+
+func TestDownloadVersionChecksAccess(t *testing.T) {
+	h := newTestHandler(t)
+	owner := createTestUser(t, h, "alice", false)
+	other := createTestUser(t, h, "bob", false)
+
+	// Only the owner can read /private
+	h.DB.Create(&models.AccessRule{Path: "/private", UserID: &owner.ID, Permission: "manage"})
+
+	writeTestFile(t, "/private/a.txt", "new")
+	err := preserveVersion(h, owner.ID, sharePath(processPath(homeShareRoot()+"/private/a.txt")), processPath(homeShareRoot()+"/private/a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var version models.FileVersion
+	h.DB.First(&version)
+
+	if code := downloadTestVersion(h, owner, &version); code != http.StatusOK {
+		t.Errorf("the owner got %d, want 200", code)
+	}
+	if code := downloadTestVersion(h, other, &version); code != http.StatusForbidden {
+		t.Errorf("someone without access got %d, want 403", code)
+	}
+
+	// Trashed, the version's path is somewhere no access rule covers
+	writeTestFile(t, "/private/a.txt", "new")
+	_, err = moveToTrash(h, owner.ID, "/private/a.txt", processPath(homeShareRoot()+"/private/a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.DB.First(&version, version.ID)
+	if code := downloadTestVersion(h, other, &version); code == http.StatusOK {
+		t.Error("someone without access could download a version of a trashed file")
+	}
+}
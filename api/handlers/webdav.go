@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PoppedBit/HomeShareDrive/models"
+	"golang.org/x/net/webdav"
+)
+
+// Locks are shared by every user, so one client's lock holds off the others
+var davLockSystem = webdav.NewMemLS()
+
+// Checking a bcrypt hash on every request makes browsing a mount crawl, so
+// successful Basic logins are remembered for a short while
+const davAuthLifetime = time.Minute
+
+var davAuthCache = struct {
+	sync.Mutex
+	users map[string]davAuth
+}{users: map[string]davAuth{}}
+
+type davAuth struct {
+	userID    uint
+	expiresAt time.Time
+}
+
+// The user of the API token a request's Basic credentials carry as the password, along with the token
+func basicAuthTokenUser(h *Handler, raw string) (*models.User, *models.APIToken) {
+	token := findAPIToken(h, raw)
+	if token == nil {
+		return nil, nil
+	}
+
+	var user models.User
+	result := h.DB.First(&user, token.UserID)
+	if result.Error != nil || (!user.IsEmailVerified && !user.IsAdmin) || isBanned(&user) {
+		return nil, nil
+	}
+
+	touchAPIToken(h, token)
+	return &user, token
+}
+
+// The user a request's Basic credentials belong to, if they're allowed to homeshare. The password can be an API
+// token instead, which is how accounts with two factor authentication log in, and then the token is returned too.
+func basicAuthUser(h *Handler, r *http.Request) (*models.User, *models.APIToken) {
+	identifier, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(password, apiTokenPrefix) {
+		return basicAuthTokenUser(h, password)
+	}
+
+	sum := sha256.Sum256([]byte(identifier + "\x00" + password))
+	key := hex.EncodeToString(sum[:])
+
+	davAuthCache.Lock()
+	cached, isCached := davAuthCache.users[key]
+	davAuthCache.Unlock()
+
+	isCached = isCached && time.Now().Before(cached.expiresAt)
+
+	var user *models.User
+	if isCached {
+		var found models.User
+		result := h.DB.First(&found, cached.userID)
+		if result.Error == nil {
+			user = &found
+		}
+	} else {
+		user, _ = throttledCheckCredentials(h, identifier, password, clientIP(r), "webdav")
+
+		// A password alone isn't enough for an account with a second factor
+		if user != nil && hasTwoFactor(h, user) {
+			user = nil
+		}
+
+		if user != nil {
+			recordLoginSuccess(h, user)
+		}
+	}
+
+	if user == nil || (!user.IsEmailVerified && !user.IsAdmin) || isBanned(user) {
+		return nil, nil
+	}
+
+	davAuthCache.Lock()
+	for k, auth := range davAuthCache.users {
+		if time.Now().After(auth.expiresAt) {
+			delete(davAuthCache.users, k)
+		}
+	}
+	if !isCached {
+		davAuthCache.users[key] = davAuth{userID: user.ID, expiresAt: time.Now().Add(davAuthLifetime)}
+	}
+	davAuthCache.Unlock()
+
+	return user, nil
+}
+
+// Serves the share over WebDAV at /dav/ for mounting in a file manager. Logs in with the site's session cookie,
+// a bearer token, or Basic auth using a username or email and either the password or an API token.
+func (h *Handler) WebDAVHandler(w http.ResponseWriter, r *http.Request) {
+	var rules *accessRules
+	var err error
+
+	user := homeshareUser(h, r)
+	if user != nil {
+		rules, err = requestAccessRules(h, r)
+	} else {
+		var token *models.APIToken
+		user, token = basicAuthUser(h, r)
+
+		if user == nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="HomeShareDrive", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		// Held to the token's scope, the same as a bearer token
+		if token != nil && !tokenAllows(token, r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		rules, err = loadAccessRules(h, user)
+		if err == nil && token != nil && token.Scope != "admin" {
+			rules.isAdmin = false
+		}
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	server := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: &shareFS{h: h, user: user, rules: rules},
+		LockSystem: davLockSystem,
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("WebDAV %s %s: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+
+	server.ServeHTTP(w, r)
+}
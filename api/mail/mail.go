@@ -0,0 +1,225 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+//go:embed templates/*.tmpl
+var defaultTemplates embed.FS
+
+const dialTimeout = 30 * time.Second
+
+// Sends the site's emails over SMTP
+type Mailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+	Security string // starttls, tls for a connection that starts encrypted, or none for a local test server
+
+	// Where templates are looked for before the built in ones, so they can be changed without rebuilding
+	TemplatesDir string
+}
+
+// A Mailer set up from the SMTP_ settings, nil if SMTP_HOST isn't set
+func NewMailer() (*Mailer, error) {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return nil, nil
+	}
+
+	mailer := &Mailer{
+		Host:         host,
+		Port:         os.Getenv("SMTP_PORT"),
+		Username:     os.Getenv("SMTP_USERNAME"),
+		Password:     os.Getenv("SMTP_PASSWORD"),
+		From:         os.Getenv("SMTP_FROM"),
+		Security:     os.Getenv("SMTP_SECURITY"),
+		TemplatesDir: os.Getenv("MAIL_TEMPLATES_DIR"),
+	}
+
+	if mailer.Port == "" {
+		mailer.Port = "587"
+	}
+	if mailer.Security == "" {
+		mailer.Security = "starttls"
+	}
+	if mailer.Security != "starttls" && mailer.Security != "tls" && mailer.Security != "none" {
+		return nil, fmt.Errorf("unknown SMTP_SECURITY %q, use starttls, tls or none", mailer.Security)
+	}
+
+	_, err := mail.ParseAddress(mailer.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP_FROM: %w", err)
+	}
+
+	return mailer, nil
+}
+
+// Loads a template, which defines a "subject" and a "body"
+func (m *Mailer) template(name string) (*template.Template, error) {
+	file := name + ".tmpl"
+
+	if m.TemplatesDir != "" {
+		path := filepath.Join(m.TemplatesDir, file)
+		if _, err := os.Stat(path); err == nil {
+			return template.ParseFiles(path)
+		}
+	}
+
+	return template.ParseFS(defaultTemplates, "templates/"+file)
+}
+
+// Fills in a template and sends it to a single address
+func (m *Mailer) Send(to string, templateName string, data any) error {
+	recipient, err := mail.ParseAddress(to)
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := m.template(templateName)
+	if err != nil {
+		return err
+	}
+
+	var subject, body bytes.Buffer
+	err = tmpl.ExecuteTemplate(&subject, "subject", data)
+	if err != nil {
+		return err
+	}
+	err = tmpl.ExecuteTemplate(&body, "body", data)
+	if err != nil {
+		return err
+	}
+
+	message, err := m.message(recipient, strings.TrimSpace(subject.String()), body.Bytes())
+	if err != nil {
+		return err
+	}
+
+	return m.send(recipient.Address, message)
+}
+
+func (m *Mailer) message(to *mail.Address, subject string, body []byte) ([]byte, error) {
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.ContainsAny(subject, "\r\n") {
+		return nil, errors.New("subject can't span lines")
+	}
+
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", from.String())
+	fmt.Fprintf(&message, "To: %s\r\n", to.String())
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), m.Host)
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	message.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	writer := quotedprintable.NewWriter(&message)
+	_, err = writer.Write(bytes.ReplaceAll(bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n")))
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return message.Bytes(), nil
+}
+
+func (m *Mailer) send(to string, message []byte) error {
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return err
+	}
+
+	address := net.JoinHostPort(m.Host, m.Port)
+	tlsConfig := &tls.Config{ServerName: m.Host}
+
+	var conn net.Conn
+	if m.Security == "tls" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, "tcp", address, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", address, dialTimeout)
+	}
+	if err != nil {
+		return err
+	}
+
+	client, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if m.Security == "starttls" {
+		err = client.StartTLS(tlsConfig)
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.Username != "" {
+		err = client.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = client.Mail(from.Address)
+	if err != nil {
+		return err
+	}
+
+	err = client.Rcpt(to)
+	if err != nil {
+		return err
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Write(message)
+	if err != nil {
+		return err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
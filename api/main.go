@@ -6,10 +6,12 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"time"
 
 	_ "github.com/PoppedBit/HomeShareDrive/docs" // This imports the generated swagger docs
 
 	"github.com/PoppedBit/HomeShareDrive/handlers"
+	"github.com/PoppedBit/HomeShareDrive/mail"
 	"github.com/PoppedBit/HomeShareDrive/models"
 	"github.com/PoppedBit/HomeShareDrive/routes"
 	"github.com/gorilla/mux"
@@ -26,24 +28,71 @@ func main() {
 		log.Fatalf("Error loading .env file")
 	}
 
+	// Database
+	db := models.InitializeDB()
+	models.Migrate(db)
+
 	// Session
 	cookieSecret := os.Getenv("COOKIE_SECRET")
-	cookieStore := sessions.NewCookieStore([]byte(cookieSecret))
-	cookieStore.Options = &sessions.Options{
+	sessionStore := handlers.NewDBSessionStore(db, []byte(cookieSecret))
+	sessionStore.Options = &sessions.Options{
 		Path:     "/",
 		MaxAge:   7 * 24 * 60 * 60, // 7 days
 		HttpOnly: true,
 		SameSite: http.SameSiteLaxMode, // Adjust as needed
 	}
 
-	// Database
-	db := models.InitializeDB()
-	models.Migrate(db)
-
 	// Handler
 	handler := &handlers.Handler{
 		DB:    db,
-		Store: cookieStore,
+		Store: sessionStore,
+	}
+
+	// Passkeys, only if the address the site is reached at is set for them
+	webAuthnOrigin := os.Getenv("WEBAUTHN_ORIGIN")
+	if webAuthnOrigin != "" {
+		handler.WebAuthn, err = handlers.NewWebAuthn(webAuthnOrigin)
+		if err != nil {
+			log.Fatalf("Error setting up passkeys: %v", err)
+		}
+	}
+
+	// Email, only if an SMTP server is set
+	handler.Mailer, err = mail.NewMailer()
+	if err != nil {
+		log.Fatalf("Error setting up email: %v", err)
+	}
+
+	// Breached passwords, only if a list of them is set
+	breachedPasswordsFile := os.Getenv("BREACHED_PASSWORDS_FILE")
+	if breachedPasswordsFile != "" {
+		handler.BreachedPasswords, err = handlers.LoadBreachedPasswords(breachedPasswordsFile)
+		if err != nil {
+			log.Fatalf("Error loading breached passwords: %v", err)
+		}
+		log.Printf("Checking new passwords against the breached password hashes in %s", breachedPasswordsFile)
+	}
+
+	// Background jobs
+	go handler.BackfillStoredFiles()
+	go handler.ExpireResumableUploads(time.Hour)
+	go handler.SweepTrash(time.Hour)
+	go handler.PruneVersions(time.Hour)
+	go handler.ExpireMultipartUploads(time.Hour)
+	go handler.LiftExpiredBans(time.Minute)
+	go handler.PruneLoginAttempts(time.Hour)
+	go handler.ExpireSessions(time.Hour)
+
+	// SFTP, only if a port is set for it
+	sftpPort := os.Getenv("SFTP_PORT")
+	if sftpPort != "" {
+		go handler.ServeSFTP(":" + sftpPort)
+	}
+
+	// S3, only if a port is set for it
+	s3Port := os.Getenv("S3_PORT")
+	if s3Port != "" {
+		go handler.ServeS3(":" + s3Port)
 	}
 
 	// Router
@@ -0,0 +1,19 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// Grants a user or a group a permission on a directory subtree of the homeshare, only one
+// of UserID and GroupID is set. Path uses forward slashes and is relative to HOME_SHARE_ROOT,
+// "/" being the whole share.
+type AccessRule struct {
+	gorm.Model
+	ID         uint   `gorm:"primaryKey;autoIncrement" json:"id"`
+	Path       string `gorm:"index" json:"path"`
+	UserID     *uint  `gorm:"constraint:OnDelete:CASCADE" json:"userId"`
+	User       User   `gorm:"foreignKey:UserID" json:"-"`
+	GroupID    *uint  `gorm:"constraint:OnDelete:CASCADE" json:"groupId"`
+	Group      Group  `gorm:"foreignKey:GroupID" json:"-"`
+	Permission string `gorm:"type:varchar(16)" json:"permission"` // read, write, delete or manage
+}
@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// A personal access token for scripts, sent as a bearer token in place of the session cookie.
+// Only a hash of the token is kept, it's shown once when created.
+type APIToken struct {
+	gorm.Model
+	ID         uint       `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID     uint       `gorm:"index;not null;constraint:OnDelete:CASCADE" json:"-"`
+	User       User       `gorm:"foreignKey:UserID" json:"-"`
+	Name       string     `json:"name"`
+	TokenHash  string     `gorm:"type:varchar(64);uniqueIndex;not null" json:"-"`
+	Prefix     string     `json:"prefix"`                // The start of the token, to tell them apart
+	Scope      string     `gorm:"not null" json:"scope"` // read-only, read-write or admin
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
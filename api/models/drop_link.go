@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// A public link guests can upload into a directory through, without seeing what's in it
+type DropLink struct {
+	gorm.Model
+	ID                uint       `gorm:"primaryKey;autoIncrement" json:"id"`
+	Token             string     `gorm:"type:varchar(64);uniqueIndex;not null" json:"token"`
+	CreatedUserID     uint       `gorm:"not null;constraint:OnDelete:CASCADE" json:"createdUserId"`
+	User              User       `gorm:"foreignKey:CreatedUserID" json:"-"`
+	Name              string     `json:"name"`
+	Path              string     `json:"path"`
+	ExpiresAt         *time.Time `json:"expiresAt"`
+	MaxFileSize       int64      `json:"maxFileSize"`       // 0 means unlimited
+	MaxTotalBytes     int64      `json:"maxTotalBytes"`     // 0 means unlimited
+	AllowedExtensions string     `json:"allowedExtensions"` // comma separated, empty allows anything
+	BytesUploaded     int64      `json:"bytesUploaded"`
+}
+
+// A file a guest uploaded through a drop link
+type DropUpload struct {
+	gorm.Model
+	ID           uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	DropLinkID   uint      `gorm:"not null;constraint:OnDelete:CASCADE" json:"dropLinkId"`
+	DropLink     DropLink  `gorm:"foreignKey:DropLinkID" json:"-"`
+	FileName     string    `json:"fileName"`
+	Path         string    `json:"path"`
+	Size         int64     `json:"size"`
+	UploaderName string    `json:"uploaderName"`
+	UploaderIP   string    `json:"uploaderIp"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
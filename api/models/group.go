@@ -0,0 +1,13 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// A named set of users that permissions can be granted to all at once
+type Group struct {
+	gorm.Model
+	ID    uint   `gorm:"primaryKey;autoIncrement" json:"id"`
+	Name  string `gorm:"type:varchar(255);uniqueIndex;not null" json:"name"`
+	Users []User `gorm:"many2many:group_members;constraint:OnDelete:CASCADE" json:"-"`
+}
@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// A code an admin hands out to let someone register, needed when registration is invite only.
+// Only a hash of the code is kept, it's shown once when created.
+type Invite struct {
+	gorm.Model
+	ID          uint         `gorm:"primaryKey;autoIncrement" json:"id"`
+	Name        string       `json:"name"` // Who or what it's for
+	CodeHash    string       `gorm:"type:varchar(64);uniqueIndex;not null" json:"-"`
+	Prefix      string       `json:"prefix"`  // The start of the code, to tell them apart
+	MaxUses     int          `json:"maxUses"` // 0 means no limit
+	Uses        int          `json:"uses"`
+	ExpiresAt   *time.Time   `json:"expiresAt"`
+	CreatedByID uint         `json:"createdById"`
+	Groups      []Group      `gorm:"many2many:invite_groups;constraint:OnDelete:CASCADE" json:"groups"` // Joined on registering
+	Rules       []InviteRule `gorm:"constraint:OnDelete:CASCADE" json:"rules"`                          // Granted on registering
+}
+
+// An access rule given to everyone who registers with an invite
+type InviteRule struct {
+	ID         uint   `gorm:"primaryKey;autoIncrement" json:"id"`
+	InviteID   uint   `gorm:"index;not null" json:"-"`
+	Path       string `json:"path"`
+	Permission string `gorm:"type:varchar(16)" json:"permission"` // read, write, delete or manage
+}
@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+)
+
+// A failed login, kept for a while to slow down guessing and for admins to look over
+type LoginAttempt struct {
+	ID         uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	Identifier string    `gorm:"type:varchar(255)" json:"identifier"` // The username or email that was tried
+	UserID     *uint     `gorm:"index" json:"userId"`                 // nil when no account matched
+	IP         string    `gorm:"type:varchar(64);index" json:"ip"`
+	Method     string    `json:"method"` // password, 2fa, passkey, webdav or sftp
+	CreatedAt  time.Time `gorm:"index" json:"createdAt"`
+}
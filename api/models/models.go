@@ -35,4 +35,27 @@ func InitializeDB() *gorm.DB {
 func Migrate(db *gorm.DB) {
 	db.AutoMigrate(&User{})
 	db.AutoMigrate(&Upload{})
+	db.AutoMigrate(&ResumableUpload{})
+	db.AutoMigrate(&Settings{})
+	db.AutoMigrate(&TrashItem{})
+	db.AutoMigrate(&FileVersion{})
+	db.AutoMigrate(&ShareLink{})
+	db.AutoMigrate(&DropLink{})
+	db.AutoMigrate(&DropUpload{})
+	db.AutoMigrate(&Group{})
+	db.AutoMigrate(&AccessRule{})
+	db.AutoMigrate(&StoredFile{})
+	db.AutoMigrate(&Quota{})
+	db.AutoMigrate(&SSHKey{})
+	db.AutoMigrate(&S3AccessKey{})
+	db.AutoMigrate(&S3MultipartUpload{})
+	db.AutoMigrate(&S3MultipartPart{})
+	db.AutoMigrate(&APIToken{})
+	db.AutoMigrate(&RecoveryCode{})
+	db.AutoMigrate(&Passkey{})
+	db.AutoMigrate(&LoginAttempt{})
+	db.AutoMigrate(&Session{})
+	db.AutoMigrate(&PasswordHistory{})
+	db.AutoMigrate(&Invite{})
+	db.AutoMigrate(&InviteRule{})
 }
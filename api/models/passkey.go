@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// A WebAuthn credential, a passkey or hardware key, a user can log in with
+type Passkey struct {
+	gorm.Model
+	ID              uint       `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID          uint       `gorm:"index;not null;constraint:OnDelete:CASCADE" json:"-"`
+	User            User       `gorm:"foreignKey:UserID" json:"-"`
+	Name            string     `json:"name"`
+	CredentialID    []byte     `gorm:"type:varbinary(1023);uniqueIndex;not null" json:"-"`
+	PublicKey       []byte     `gorm:"type:blob;not null" json:"-"` // COSE encoded
+	AttestationType string     `json:"-"`
+	Transports      string     `json:"transports"` // Comma separated, as the browser reported them
+	AAGUID          []byte     `gorm:"type:varbinary(16)" json:"-"`
+	SignCount       uint32     `json:"-"`
+	BackupEligible  bool       `json:"backupEligible"` // Synced passkeys rather than a key tied to one device
+	BackupState     bool       `json:"backupState"`
+	LastUsedAt      *time.Time `json:"lastUsedAt"`
+}
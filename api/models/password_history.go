@@ -0,0 +1,15 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// A password a user had before, kept so the password policy can stop it being used again
+type PasswordHistory struct {
+	gorm.Model
+	ID           uint   `gorm:"primaryKey;autoIncrement"`
+	UserID       uint   `gorm:"index;not null;constraint:OnDelete:CASCADE"`
+	User         User   `gorm:"foreignKey:UserID"`
+	PasswordHash string `gorm:"type:varchar(255);not null"`
+	PasswordSalt string `gorm:"type:varchar(255);not null"`
+}
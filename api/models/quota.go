@@ -0,0 +1,29 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// Who wrote a file in the homeshare, what storage usage is counted from. Path uses forward
+// slashes and is relative to HOME_SHARE_ROOT, files in the trash and version history included.
+type StoredFile struct {
+	gorm.Model
+	ID     uint   `gorm:"primaryKey;autoIncrement"`
+	Path   string `gorm:"type:varchar(768);uniqueIndex;not null"`
+	UserID uint   `gorm:"index;not null;constraint:OnDelete:CASCADE"`
+	User   User   `gorm:"foreignKey:UserID"`
+	Size   int64
+}
+
+// Storage limits for a user, or for the members of a group together. Only one of UserID
+// and GroupID is set. A limit of 0 means no limit.
+type Quota struct {
+	gorm.Model
+	ID        uint  `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID    *uint `gorm:"constraint:OnDelete:CASCADE" json:"userId"`
+	User      User  `gorm:"foreignKey:UserID" json:"-"`
+	GroupID   *uint `gorm:"constraint:OnDelete:CASCADE" json:"groupId"`
+	Group     Group `gorm:"foreignKey:GroupID" json:"-"`
+	SoftLimit int64 `json:"softLimit"` // Going over only warns
+	HardLimit int64 `json:"hardLimit"` // Writes that would go over are refused
+}
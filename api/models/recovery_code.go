@@ -0,0 +1,14 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// A single use code that stands in for a second factor, only a hash of it is kept
+type RecoveryCode struct {
+	gorm.Model
+	ID       uint   `gorm:"primaryKey;autoIncrement"`
+	UserID   uint   `gorm:"index;not null;constraint:OnDelete:CASCADE"`
+	User     User   `gorm:"foreignKey:UserID"`
+	CodeHash string `gorm:"type:varchar(64);not null"`
+}
@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// An in-progress tus upload, its bytes are staged under UPLOAD_DIR/tus until complete
+type ResumableUpload struct {
+	gorm.Model
+	ID            uint   `gorm:"primaryKey;autoIncrement"`
+	Token         string `gorm:"type:varchar(64);uniqueIndex;not null"`
+	CreatedUserID uint   `gorm:"not null;constraint:OnDelete:CASCADE"`
+	User          User   `gorm:"foreignKey:CreatedUserID"`
+	Path          string
+	FileName      string
+	Length        int64
+	ExpiresAt     time.Time
+}
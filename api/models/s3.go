@@ -0,0 +1,38 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// A key pair a user signs S3 requests with. The secret is kept as is since
+// checking a signature needs it, so it's only shown when the key is created.
+type S3AccessKey struct {
+	gorm.Model
+	ID          uint   `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID      uint   `gorm:"index;not null;constraint:OnDelete:CASCADE" json:"-"`
+	User        User   `gorm:"foreignKey:UserID" json:"-"`
+	Name        string `json:"name"`
+	AccessKeyID string `gorm:"type:varchar(64);uniqueIndex;not null" json:"accessKeyId"`
+	SecretKey   string `gorm:"not null" json:"-"`
+}
+
+// An in-progress S3 multipart upload, its parts are staged under UPLOAD_DIR/s3 until it's completed
+type S3MultipartUpload struct {
+	gorm.Model
+	ID       uint   `gorm:"primaryKey;autoIncrement"`
+	UploadID string `gorm:"type:varchar(64);uniqueIndex;not null"`
+	UserID   uint   `gorm:"index;not null;constraint:OnDelete:CASCADE"`
+	User     User   `gorm:"foreignKey:UserID"`
+	Bucket   string
+	Key      string `gorm:"type:text"`
+}
+
+// A part uploaded to an S3 multipart upload
+type S3MultipartPart struct {
+	gorm.Model
+	ID         uint   `gorm:"primaryKey;autoIncrement"`
+	UploadID   string `gorm:"type:varchar(64);uniqueIndex:idx_s3_part;not null"`
+	PartNumber int    `gorm:"uniqueIndex:idx_s3_part;not null"`
+	ETag       string
+	Size       int64
+}
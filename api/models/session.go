@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+)
+
+// A login session, kept in the database so it can be listed and revoked.
+// The cookie carries a random token, only a hash of it is kept.
+type Session struct {
+	ID         uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	TokenHash  string    `gorm:"type:varchar(64);uniqueIndex;not null" json:"-"`
+	UserID     *uint     `gorm:"index" json:"userId"` // nil until someone logs in on it
+	Data       []byte    `gorm:"type:blob" json:"-"`  // The session's values
+	UserAgent  string    `gorm:"type:text" json:"userAgent"`
+	IP         string    `gorm:"type:varchar(64)" json:"ip"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	ExpiresAt  time.Time `gorm:"index" json:"expiresAt"`
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// Site wide settings an admin can change, there is only ever one row
+type Settings struct {
+	gorm.Model
+	ID                 uint `gorm:"primaryKey;autoIncrement" json:"-"`
+	TrashRetentionDays int  `gorm:"default:30" json:"trashRetentionDays"`
+
+	// Version history, 0 means no limit
+	VersionKeepCount int `gorm:"default:10" json:"versionKeepCount"`
+	VersionKeepDays  int `gorm:"default:0" json:"versionKeepDays"`
+
+	// Whether admins can get into users' personal folders
+	AdminsCanAccessPersonalFolders bool `gorm:"default:false" json:"adminsCanAccessPersonalFolders"`
+
+	// Whether admins have to set up two factor authentication before they can use admin features
+	RequireAdminTwoFactor bool `gorm:"default:false" json:"requireAdminTwoFactor"`
+
+	// How many failed logins in a row lock an account and for how long, a threshold of 0 never locks
+	LockoutThreshold int `gorm:"default:10" json:"lockoutThreshold"`
+	LockoutMinutes   int `gorm:"default:15" json:"lockoutMinutes"`
+
+	// Password policy, checked whenever a password is set
+	PasswordMinLength        int  `gorm:"default:8" json:"passwordMinLength"`
+	PasswordRequireUppercase bool `gorm:"default:false" json:"passwordRequireUppercase"`
+	PasswordRequireLowercase bool `gorm:"default:false" json:"passwordRequireLowercase"`
+	PasswordRequireDigit     bool `gorm:"default:false" json:"passwordRequireDigit"`
+	PasswordRequireSymbol    bool `gorm:"default:false" json:"passwordRequireSymbol"`
+	PasswordHistoryCount     int  `gorm:"default:0" json:"passwordHistoryCount"`     // How many of the last passwords can't be used again, 0 allows any
+	PasswordCheckBreached    bool `gorm:"default:true" json:"passwordCheckBreached"` // Only once a breached password list is loaded
+
+	// Who can make an account: open, invite-only or closed. The first account can always be made.
+	RegistrationMode string `gorm:"type:varchar(16);default:open" json:"registrationMode"`
+
+	// Whether the files that were already in the homeshare have been counted towards storage usage
+	StoredFilesBackfilled bool `gorm:"default:false" json:"-"`
+}
+
+func GetSettings(db *gorm.DB) (Settings, error) {
+	var settings Settings
+	result := db.FirstOrCreate(&settings, Settings{ID: 1})
+	return settings, result.Error
+}
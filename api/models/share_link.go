@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// A public link to a file or directory that can be used without an account
+type ShareLink struct {
+	gorm.Model
+	ID            uint       `gorm:"primaryKey;autoIncrement" json:"id"`
+	Token         string     `gorm:"type:varchar(64);uniqueIndex;not null" json:"token"`
+	CreatedUserID uint       `gorm:"not null;constraint:OnDelete:CASCADE" json:"createdUserId"`
+	User          User       `gorm:"foreignKey:CreatedUserID" json:"-"`
+	Path          string     `json:"path"`
+	IsDir         bool       `json:"isDir"`
+	ExpiresAt     *time.Time `json:"expiresAt"`
+	PasswordHash  string     `gorm:"type:varchar(255)" json:"-"`
+	PasswordSalt  string     `gorm:"type:varchar(255)" json:"-"`
+	MaxDownloads  int        `json:"maxDownloads"` // 0 means unlimited
+	DownloadCount int        `json:"downloadCount"`
+}
@@ -0,0 +1,16 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// A public key a user can log in to SFTP with instead of their password
+type SSHKey struct {
+	gorm.Model
+	ID          uint   `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID      uint   `gorm:"index;not null;constraint:OnDelete:CASCADE" json:"-"`
+	User        User   `gorm:"foreignKey:UserID" json:"-"`
+	Name        string `json:"name"`
+	PublicKey   string `gorm:"type:text" json:"publicKey"` // authorized_keys format
+	Fingerprint string `gorm:"type:varchar(128);uniqueIndex;not null" json:"fingerprint"`
+}
@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// A deleted file or directory, kept under {share root}/.trash/{Token} until restored or purged
+type TrashItem struct {
+	gorm.Model
+	ID              uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	Token           string    `gorm:"type:varchar(64);uniqueIndex;not null" json:"-"`
+	OriginalPath    string    `json:"originalPath"`
+	Name            string    `json:"name"`
+	IsDir           bool      `json:"isDir"`
+	Size            int64     `json:"size"`
+	DeletedByUserID uint      `gorm:"not null;constraint:OnDelete:CASCADE" json:"deletedByUserId"`
+	DeletedBy       User      `gorm:"foreignKey:DeletedByUserID" json:"-"`
+	TrashedAt       time.Time `json:"trashedAt"`
+}
@@ -21,6 +21,16 @@ type User struct {
 	// Roles
 	IsAdmin bool `json:"isAdmin"`
 
+	// Two factor authentication, the secret is only in use once TOTPEnabled is set
+	TOTPSecret   string `json:"-"`
+	TOTPEnabled  bool   `gorm:"default:false" json:"totpEnabled"`
+	TOTPLastStep int64  `json:"-"` // The last time step a code was used for, so it can't be used again
+
+	// Lockout after too many failed logins
+	FailedLoginCount  int        `gorm:"default:0" json:"failedLoginCount"` // Since the last successful login
+	LastFailedLoginAt *time.Time `json:"lastFailedLoginAt"`
+	LockedUntil       *time.Time `json:"lockedUntil"`
+
 	// Ban
 	IsBanned  bool       `json:"isBanned"`
 	UnBanDate *time.Time `json:"unBanDate"`
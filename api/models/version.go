@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Previous contents of an overwritten file, kept under {share root}/.versions/{Token}
+type FileVersion struct {
+	gorm.Model
+	ID            uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	Token         string    `gorm:"type:varchar(64);uniqueIndex;not null" json:"-"`
+	Path          string    `gorm:"index" json:"path"`
+	Number        int       `json:"number"`
+	Size          int64     `json:"size"`
+	ModTime       time.Time `json:"modTime"`
+	CreatedUserID uint      `gorm:"not null;constraint:OnDelete:CASCADE" json:"createdUserId"`
+	User          User      `gorm:"foreignKey:CreatedUserID" json:"-"`
+}
@@ -9,5 +9,28 @@ func registerAdminRoutes(r *mux.Router, handler *handlers.Handler) {
 	r.HandleFunc("/admin/users", handler.GetUsersHandler).Methods("GET")
 	r.HandleFunc("/admin/user/{userId}/ban", handler.BanUserHandler).Methods("POST")
 	r.HandleFunc("/admin/user/{userId}/unban", handler.UnBanUserHandler).Methods("POST")
+	r.HandleFunc("/admin/user/{userId}/verify", handler.VerifyUserHandler).Methods("POST")
+	r.HandleFunc("/admin/user/{userId}/reset-2fa", handler.ResetTwoFactorHandler).Methods("POST")
+	r.HandleFunc("/admin/lockouts", handler.GetLockoutsHandler).Methods("GET")
+	r.HandleFunc("/admin/lockouts/{userId}", handler.ClearLockoutHandler).Methods("DELETE")
+	r.HandleFunc("/admin/login-attempts", handler.GetLoginAttemptsHandler).Methods("GET")
+	r.HandleFunc("/admin/settings", handler.GetSettingsHandler).Methods("GET")
+	r.HandleFunc("/admin/settings", handler.UpdateSettingsHandler).Methods("POST")
+	r.HandleFunc("/admin/access-rules", handler.GetAccessRulesHandler).Methods("GET")
+	r.HandleFunc("/admin/access-rules", handler.CreateAccessRuleHandler).Methods("POST")
+	r.HandleFunc("/admin/access-rules/{ruleId}", handler.UpdateAccessRuleHandler).Methods("POST")
+	r.HandleFunc("/admin/access-rules/{ruleId}", handler.DeleteAccessRuleHandler).Methods("DELETE")
+	r.HandleFunc("/admin/groups", handler.GetGroupsHandler).Methods("GET")
+	r.HandleFunc("/admin/groups", handler.CreateGroupHandler).Methods("POST")
+	r.HandleFunc("/admin/groups/{groupId}", handler.RenameGroupHandler).Methods("POST")
+	r.HandleFunc("/admin/groups/{groupId}", handler.DeleteGroupHandler).Methods("DELETE")
+	r.HandleFunc("/admin/groups/{groupId}/members", handler.AddGroupMemberHandler).Methods("POST")
+	r.HandleFunc("/admin/groups/{groupId}/members/{userId}", handler.RemoveGroupMemberHandler).Methods("DELETE")
+	r.HandleFunc("/admin/quotas", handler.GetQuotasHandler).Methods("GET")
+	r.HandleFunc("/admin/quotas", handler.SetQuotaHandler).Methods("POST")
+	r.HandleFunc("/admin/quotas/{quotaId}", handler.DeleteQuotaHandler).Methods("DELETE")
+	r.HandleFunc("/admin/invites", handler.GetInvitesHandler).Methods("GET")
+	r.HandleFunc("/admin/invites", handler.CreateInviteHandler).Methods("POST")
+	r.HandleFunc("/admin/invites/{inviteId}", handler.DeleteInviteHandler).Methods("DELETE")
 
 }
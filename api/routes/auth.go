@@ -7,15 +7,46 @@ import (
 
 func registerAuthRoutes(r *mux.Router, handler *handlers.Handler) {
 	r.HandleFunc("/register", handler.RegisterHandler).Methods("POST")
+	r.HandleFunc("/registration", handler.RegistrationHandler).Methods("GET")
 	r.HandleFunc("/login", handler.LoginHandler).Methods("POST")
+	r.HandleFunc("/login/2fa", handler.LoginTwoFactorHandler).Methods("POST")
+	r.HandleFunc("/login/passkey", handler.BeginPasskeyLoginHandler).Methods("POST")
+	r.HandleFunc("/login/passkey/finish", handler.FinishPasskeyLoginHandler).Methods("POST")
+	r.HandleFunc("/verify-email", handler.VerifyEmailHandler).Methods("POST")
+	r.HandleFunc("/forgot-password", handler.ForgotPasswordHandler).Methods("POST")
+	r.HandleFunc("/reset-password", handler.ResetPasswordHandler).Methods("POST")
+	r.HandleFunc("/password-policy", handler.PasswordPolicyHandler).Methods("GET")
 	r.HandleFunc("/check-session", handler.CheckSessionHandler).Methods("GET")
+	r.HandleFunc("/csrf-token", handler.CSRFTokenHandler).Methods("GET")
 	r.HandleFunc("/logout", handler.LogoutHandler).Methods("GET")
 
 	r.HandleFunc("/account", handler.AccountSettingsHandler).Methods("GET")
 	r.HandleFunc("/account/username", handler.UpdateUsernameHandler).Methods("POST")
 	r.HandleFunc("/account/pfp", handler.UpdateProfilePictureHandler).Methods("POST")
 	r.HandleFunc("/account/password", handler.UpdatePasswordHandler).Methods("POST")
+	r.HandleFunc("/account/email/verify", handler.SendVerificationEmailHandler).Methods("POST")
 	r.HandleFunc("/account/pfp", handler.GetProfilePictureHandler).Methods("GET")
 	r.HandleFunc("/account/pfp/{userID}", handler.GetProfilePictureHandler).Methods("GET")
 	r.HandleFunc("/account/pfp", handler.DeleteProfilePictureHandler).Methods("DELETE")
+	r.HandleFunc("/account/ssh-keys", handler.GetSSHKeysHandler).Methods("GET")
+	r.HandleFunc("/account/ssh-keys", handler.AddSSHKeyHandler).Methods("POST")
+	r.HandleFunc("/account/ssh-keys/{keyId}", handler.DeleteSSHKeyHandler).Methods("DELETE")
+	r.HandleFunc("/account/s3-keys", handler.GetS3KeysHandler).Methods("GET")
+	r.HandleFunc("/account/s3-keys", handler.CreateS3KeyHandler).Methods("POST")
+	r.HandleFunc("/account/s3-keys/{keyId}", handler.DeleteS3KeyHandler).Methods("DELETE")
+	r.HandleFunc("/account/tokens", handler.GetAPITokensHandler).Methods("GET")
+	r.HandleFunc("/account/tokens", handler.CreateAPITokenHandler).Methods("POST")
+	r.HandleFunc("/account/tokens/{tokenId}", handler.DeleteAPITokenHandler).Methods("DELETE")
+	r.HandleFunc("/account/2fa/totp", handler.EnrollTOTPHandler).Methods("POST")
+	r.HandleFunc("/account/2fa/totp/verify", handler.VerifyTOTPHandler).Methods("POST")
+	r.HandleFunc("/account/2fa/totp/disable", handler.DisableTOTPHandler).Methods("POST")
+	r.HandleFunc("/account/2fa/recovery-codes", handler.RegenerateRecoveryCodesHandler).Methods("POST")
+	r.HandleFunc("/account/passkeys", handler.GetPasskeysHandler).Methods("GET")
+	r.HandleFunc("/account/passkeys/register", handler.BeginPasskeyRegistrationHandler).Methods("POST")
+	r.HandleFunc("/account/passkeys/register/finish", handler.FinishPasskeyRegistrationHandler).Methods("POST")
+	r.HandleFunc("/account/passkeys/{passkeyId}", handler.RenamePasskeyHandler).Methods("POST")
+	r.HandleFunc("/account/passkeys/{passkeyId}", handler.DeletePasskeyHandler).Methods("DELETE")
+	r.HandleFunc("/account/sessions", handler.GetSessionsHandler).Methods("GET")
+	r.HandleFunc("/account/sessions", handler.DeleteSessionsHandler).Methods("DELETE")
+	r.HandleFunc("/account/sessions/{sessionId}", handler.DeleteSessionHandler).Methods("DELETE")
 }
@@ -0,0 +1,13 @@
+package routes
+
+import (
+	"github.com/PoppedBit/HomeShareDrive/handlers"
+	"github.com/gorilla/mux"
+)
+
+func registerDAVRoutes(r *mux.Router, handler *handlers.Handler) {
+	// WebDAV brings its own methods (PROPFIND, LOCK, MOVE, ...) so every method is let through
+	r.HandleFunc("/dav", handler.WebDAVHandler)
+	r.PathPrefix("/dav/").HandlerFunc(handler.WebDAVHandler)
+
+}
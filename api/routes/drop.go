@@ -0,0 +1,17 @@
+package routes
+
+import (
+	"github.com/PoppedBit/HomeShareDrive/handlers"
+	"github.com/gorilla/mux"
+)
+
+func registerDropRoutes(r *mux.Router, handler *handlers.Handler) {
+	r.HandleFunc("/drop-links", handler.GetDropLinksHandler).Methods("GET")
+	r.HandleFunc("/drop-links", handler.CreateDropLinkHandler).Methods("POST")
+	r.HandleFunc("/drop-links/{linkId}", handler.RevokeDropLinkHandler).Methods("DELETE")
+	r.HandleFunc("/drop-links/{linkId}/uploads", handler.GetDropUploadsHandler).Methods("GET")
+
+	// Public, no account needed
+	r.HandleFunc("/d/{token}", handler.PublicDropLinkHandler).Methods("GET")
+	r.HandleFunc("/d/{token}/upload", handler.DropUploadHandler).Methods("POST")
+}
@@ -10,11 +10,18 @@ func registerHomeShareRoutes(r *mux.Router, handler *handlers.Handler) {
 	r.HandleFunc("/create-directory", handler.CreateDirectoryHandler).Methods("POST")
 	r.HandleFunc("/delete-item", handler.DeleteItemHandler).Methods("DELETE")
 	r.HandleFunc("/rename-item", handler.RenameItemHandler).Methods("POST")
+	r.HandleFunc("/move-item", handler.MoveItemHandler).Methods("POST")
+	r.HandleFunc("/copy-item", handler.CopyItemHandler).Methods("POST")
+	r.HandleFunc("/copy-item/{jobId}", handler.CopyJobHandler).Methods("GET")
 	r.HandleFunc("/download-file", handler.DownloadFileHandler).Methods("GET")
+	r.HandleFunc("/download-archive", handler.DownloadArchiveHandler).Methods("GET")
 	r.HandleFunc("/upload-file", handler.UploadFileHandler).Methods("POST")
+	r.HandleFunc("/tus/", handler.TusOptionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/tus/", handler.TusCreateHandler).Methods("POST")
+	r.HandleFunc("/tus/{uploadId}", handler.TusOptionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/tus/{uploadId}", handler.TusHeadHandler).Methods("HEAD")
+	r.HandleFunc("/tus/{uploadId}", handler.TusPatchHandler).Methods("PATCH")
+	r.HandleFunc("/tus/{uploadId}", handler.TusDeleteHandler).Methods("DELETE")
 	r.HandleFunc("/ensure-thumbnails", handler.EnsureThumbnailsHandler).Methods("GET")
 	// TODO - Clean up thumbnails
-	// TODO - Move
-	// TODO - Copy
-	// TODO - download directory
 }
@@ -8,10 +8,20 @@ import (
 )
 
 func RegisterRoutes(r *mux.Router, handler *handlers.Handler) {
+	r.Use(handler.BearerTokenMiddleware)
+	r.Use(handler.BanMiddleware)
+	r.Use(handler.CSRFMiddleware)
+	r.Use(handler.AccessRulesMiddleware)
+
 	registerAdminRoutes(r, handler)
 	registerAuthRoutes(r, handler)
 	registerClientRoutes(r, handler)
 	registerHomeShareRoutes(r, handler)
+	registerTrashRoutes(r, handler)
+	registerVersionRoutes(r, handler)
+	registerShareRoutes(r, handler)
+	registerDropRoutes(r, handler)
+	registerDAVRoutes(r, handler)
 
 	r.PathPrefix("/app").Handler(http.StripPrefix("/app", http.FileServer(http.Dir("public"))))
 
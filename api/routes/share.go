@@ -0,0 +1,20 @@
+package routes
+
+import (
+	"github.com/PoppedBit/HomeShareDrive/handlers"
+	"github.com/gorilla/mux"
+)
+
+func registerShareRoutes(r *mux.Router, handler *handlers.Handler) {
+	r.HandleFunc("/share-links", handler.GetShareLinksHandler).Methods("GET")
+	r.HandleFunc("/share-links", handler.CreateShareLinkHandler).Methods("POST")
+	r.HandleFunc("/share-links/{linkId}", handler.RevokeShareLinkHandler).Methods("DELETE")
+
+	// Public, no account needed
+	r.HandleFunc("/s/{token}", handler.PublicShareLinkHandler).Methods("GET")
+	r.HandleFunc("/s/{token}/unlock", handler.UnlockShareLinkHandler).Methods("POST")
+	r.HandleFunc("/s/{token}/contents", handler.ShareLinkContentsHandler).Methods("GET")
+	r.HandleFunc("/s/{token}/download", handler.ShareLinkDownloadHandler).Methods("GET")
+	r.HandleFunc("/s/{token}/thumbnail", handler.ShareLinkThumbnailHandler).Methods("GET")
+	r.HandleFunc("/s/{token}/archive", handler.ShareLinkArchiveHandler).Methods("GET")
+}
@@ -0,0 +1,13 @@
+package routes
+
+import (
+	"github.com/PoppedBit/HomeShareDrive/handlers"
+	"github.com/gorilla/mux"
+)
+
+func registerTrashRoutes(r *mux.Router, handler *handlers.Handler) {
+	r.HandleFunc("/trash", handler.GetTrashHandler).Methods("GET")
+	r.HandleFunc("/trash", handler.EmptyTrashHandler).Methods("DELETE")
+	r.HandleFunc("/trash/{itemId}/restore", handler.RestoreTrashItemHandler).Methods("POST")
+	r.HandleFunc("/trash/{itemId}", handler.PurgeTrashItemHandler).Methods("DELETE")
+}
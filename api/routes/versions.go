@@ -0,0 +1,12 @@
+package routes
+
+import (
+	"github.com/PoppedBit/HomeShareDrive/handlers"
+	"github.com/gorilla/mux"
+)
+
+func registerVersionRoutes(r *mux.Router, handler *handlers.Handler) {
+	r.HandleFunc("/versions", handler.GetVersionsHandler).Methods("GET")
+	r.HandleFunc("/versions/{versionId}/download", handler.DownloadVersionHandler).Methods("GET")
+	r.HandleFunc("/versions/{versionId}/restore", handler.RestoreVersionHandler).Methods("POST")
+}
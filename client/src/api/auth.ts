@@ -1,4 +1,4 @@
-import { baseUrl, getDeleteConfig, getPostConfig, getRequestConfig } from 'api';
+import { baseUrl, getCsrfToken, getDeleteConfig, getPostConfig, getRequestConfig } from 'api';
 
 export const requestLogin = async (identifier: string, password: string) => {
   const data = {
@@ -14,6 +14,11 @@ export const requestCheckSession = async () => {
   return await fetch(`${baseUrl}/check-session`, config);
 };
 
+export const requestCsrfToken = async () => {
+  const config = getRequestConfig();
+  return await fetch(`${baseUrl}/csrf-token`, config);
+};
+
 export const requestLogout = async () => {
   const config = getRequestConfig();
   return await fetch(`${baseUrl}/logout`, config);
@@ -23,6 +28,7 @@ export interface RequestRegister {
   username: string;
   email: string;
   password: string;
+  inviteCode?: string;
 }
 
 export const requestRegister = async (data: RequestRegister) => {
@@ -49,6 +55,9 @@ export const requestUpdatePFP = async (file: File) => {
   formData.append('file', file);
   const postConfig = {
     method: 'POST',
+    headers: {
+      'X-CSRF-Token': getCsrfToken()
+    },
     body: formData
   };
   return await fetch(`${baseUrl}/account/pfp`, postConfig);
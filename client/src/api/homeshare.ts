@@ -1,4 +1,4 @@
-import { baseUrl, getDeleteConfig, getPostConfig, getRequestConfig } from 'api';
+import { baseUrl, getCsrfToken, getDeleteConfig, getPostConfig, getRequestConfig } from 'api';
 
 export const requestDirectoryContents = async (path: string) => {
   const config = getRequestConfig();
@@ -19,6 +19,9 @@ export const requestUploadFile = async (path: string, file: File) => {
   data.append('file', file);
   const config = {
     method: 'POST',
+    headers: {
+      'X-CSRF-Token': getCsrfToken()
+    },
     body: data
   };
   return await fetch(`${baseUrl}/upload-file?path=${path}`, config);
@@ -4,6 +4,15 @@ export * from './homeshare';
 
 export const baseUrl = import.meta.env.VITE_API_URL;
 
+// Sent with anything that isn't a GET, fetched from /csrf-token when the app loads
+let csrfToken = '';
+
+export const setCsrfToken = (token: string) => {
+  csrfToken = token;
+};
+
+export const getCsrfToken = () => csrfToken;
+
 export const getRequestConfig = () => {
   const config = {
     method: 'GET',
@@ -24,7 +33,8 @@ export const getPostConfig = (data: any = {}) => {
     mode: 'cors',
     credentials: 'include',
     headers: {
-      'Content-Type': 'application/json'
+      'Content-Type': 'application/json',
+      'X-CSRF-Token': csrfToken
     },
     body: JSON.stringify(data)
   };
@@ -39,7 +49,8 @@ export const getDeleteConfig = (data: any) => {
     credentials: 'include',
     headers: {
       Accept: 'application/json',
-      'Content-Type': 'application/json'
+      'Content-Type': 'application/json',
+      'X-CSRF-Token': csrfToken
     },
     body: JSON.stringify(data)
   };
@@ -52,7 +63,8 @@ export const getPatchConfig = (data: any) => {
     method: 'PATCH',
     credentials: 'include',
     headers: {
-      'Content-Type': 'application/json'
+      'Content-Type': 'application/json',
+      'X-CSRF-Token': csrfToken
     },
     body: JSON.stringify(data)
   };
@@ -1,13 +1,15 @@
 import {
   requestAccount,
   requestCheckSession,
+  requestCsrfToken,
   requestDeletePFP,
   requestLogin,
   requestLogout,
   requestRegister,
   requestUpdatePassword,
   requestUpdatePFP,
-  requestUpdateUsername
+  requestUpdateUsername,
+  setCsrfToken
 } from 'api';
 import { useState } from 'react';
 import { useDispatch } from 'react-redux';
@@ -20,6 +22,15 @@ import {
 import { setUser } from 'store/slices/user';
 import { TODO } from 'types/types';
 
+// A rejected password comes back as JSON listing the rules it broke, anything else as text
+const getPasswordError = async (response: Response) => {
+  if (response.headers.get('Content-Type')?.includes('application/json')) {
+    const { error, failures = [] } = await response.json();
+    return failures.length ? failures.map((failure: TODO) => failure.message).join('. ') : error;
+  }
+  return await response.text();
+};
+
 export const useLogin = () => {
   const dispatch = useDispatch();
   const [isSubmitting, setIsSubmitting] = useState<boolean>(false);
@@ -71,6 +82,12 @@ export const useCheckSession = () => {
     try {
       const response = await requestCheckSession();
 
+      const csrfResponse = await requestCsrfToken();
+      if (csrfResponse.status === 200) {
+        const { csrfToken } = await csrfResponse.json();
+        setCsrfToken(csrfToken);
+      }
+
       if (response.status === 200) {
         const data = await response.json();
         dispatch(setUser(data));
@@ -134,7 +151,7 @@ export const useRegister = () => {
   const handleSubmit = async (data: TODO) => {
     setIsSubmitting(true);
 
-    const { username, email, password, confirmPassword } = data;
+    const { username, email, password, confirmPassword, inviteCode } = data;
 
     try {
       // Email formatted correctly
@@ -175,14 +192,15 @@ export const useRegister = () => {
       const response = await requestRegister({
         username,
         email,
-        password
+        password,
+        inviteCode
       });
 
       if (response.status === 201) {
         dispatch(setSuccessMessage(`Account for ${email} created.`));
         navigate(`${import.meta.env.VITE_BASE_URL}/login`);
       } else {
-        const error = await response.text();
+        const error = await getPasswordError(response);
         dispatch(setErrorMessage(error));
       }
     } catch (e) {
@@ -306,7 +324,7 @@ export const useAccountSettings = () => {
       if (response.status === 200) {
         dispatch(setSuccessMessage('Password updated'));
       } else {
-        const error = await response.text();
+        const error = await getPasswordError(response);
         dispatch(setErrorMessage(error));
       }
     } catch (e) {
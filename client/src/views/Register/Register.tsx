@@ -2,11 +2,15 @@ import { useForm } from 'react-hook-form';
 import { Button, TextField } from '@mui/material';
 
 import { Form, PageHeader } from 'components';
-import { useNavigate } from 'react-router-dom';
+import { useNavigate, useSearchParams } from 'react-router-dom';
 import { useRegister } from 'hooks';
 
 const Register = () => {
-  const { register, handleSubmit } = useForm();
+  const [searchParams] = useSearchParams();
+  const { register, handleSubmit } = useForm({
+    // Invite links carry the code
+    defaultValues: { inviteCode: searchParams.get('invite') ?? '' }
+  });
   const navigate = useNavigate();
   const { isSubmitting, handleSubmit: handleSubmitRegister } = useRegister();
 
@@ -38,6 +42,11 @@ const Register = () => {
           fullWidth
           {...register('confirmPassword', { required: true })}
         />
+        <TextField
+          label="Invite Code"
+          fullWidth
+          {...register('inviteCode', { required: false })}
+        />
         <Button variant="contained" type="submit" disabled={isSubmitting}>
           Register
         </Button>